@@ -7,8 +7,12 @@ require (
 	github.com/ReneKroon/ttlcache/v2 v2.3.0
 	github.com/cespare/xxhash/v2 v2.1.1
 	github.com/getsentry/sentry-go v0.9.0
+	github.com/golang/snappy v0.0.1
+	github.com/golang/snappy v0.0.1
 	github.com/jessevdk/go-flags v1.4.0
 	github.com/json-iterator/go v1.1.11
+	github.com/klauspost/compress v1.9.7
+	github.com/klauspost/compress v1.9.7
 	github.com/miekg/dns v1.1.41 // indirect
 	github.com/opentracing/opentracing-go v1.1.0
 	github.com/prometheus/client_golang v1.8.0
@@ -17,6 +21,7 @@ require (
 	github.com/uber/jaeger-client-go v2.27.0+incompatible
 	github.com/uber/jaeger-lib v2.4.1+incompatible // indirect
 	github.com/wish/discovery v0.0.0-20190510213300-be3745886c68
+	github.com/xdg-go/scram v1.0.2
 	go.mongodb.org/mongo-driver v1.5.1
 	go.uber.org/automaxprocs v1.3.0
 	golang.org/x/net v0.0.0-20210331212208-0fccb6fa2b5c // indirect
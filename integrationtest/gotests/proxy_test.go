@@ -6,6 +6,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/wish/mongoproxy/integrationtest"
@@ -24,8 +25,7 @@ type Trainer struct {
 // TODO: better test suite (maybe re-use client library tests?)
 // tests copied from https://github.com/coinbase/mongobetween/blob/b7344eaf5bbd31ae83b83925282d4d7d7190d80e/proxy/proxy_test.go#L132
 func TestProxy(t *testing.T) {
-	// TODO: support retry writes?
-	client := integrationtest.SetupClient(t, options.Client().SetRetryWrites(false))
+	client := integrationtest.SetupClient(t)
 	collection := client.Database("test").Collection("trainers")
 	_, err := collection.DeleteMany(ctx, bson.D{{}})
 	assert.Nil(t, err)
@@ -74,3 +74,48 @@ func TestProxy(t *testing.T) {
 	// TODO
 	// proxy.Shutdown()
 }
+
+func TestTransaction(t *testing.T) {
+	client := integrationtest.SetupClient(t)
+	defer client.Disconnect(ctx)
+
+	collection := client.Database("test").Collection("transactions")
+	_, err := collection.DeleteMany(ctx, bson.D{{}})
+	assert.Nil(t, err)
+
+	session, err := client.StartSession()
+	assert.Nil(t, err)
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sctx mongo.SessionContext) (interface{}, error) {
+		if _, err := collection.InsertOne(sctx, bson.D{{"_id", 1}}); err != nil {
+			return nil, err
+		}
+		return collection.InsertOne(sctx, bson.D{{"_id", 2}})
+	})
+	// Transactions require a replica set (or sharded cluster) downstream
+	if cmdErr, ok := err.(mongo.CommandError); ok && cmdErr.Code == 20 {
+		t.Skip("downstream doesn't support transactions")
+	}
+	assert.Nil(t, err)
+
+	n, err := collection.CountDocuments(ctx, bson.D{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+
+	// An aborted transaction leaves nothing behind
+	err = mongo.WithSession(ctx, session, func(sctx mongo.SessionContext) error {
+		if err := session.StartTransaction(); err != nil {
+			return err
+		}
+		if _, err := collection.InsertOne(sctx, bson.D{{"_id", 3}}); err != nil {
+			return err
+		}
+		return session.AbortTransaction(sctx)
+	})
+	assert.Nil(t, err)
+
+	n, err = collection.CountDocuments(ctx, bson.D{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+}
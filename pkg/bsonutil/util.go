@@ -66,6 +66,37 @@ func Pop(in bson.D, keys ...string) (bson.D, interface{}, bool) {
 	return in, nil, false
 }
 
+// Set sets the value at the given (nested) keys, creating any intermediate
+// documents that don't exist. This returns false if an intermediate key
+// exists but isn't a document
+func Set(in bson.D, v interface{}, keys ...string) (bson.D, bool) {
+	if len(keys) < 1 {
+		return in, false
+	}
+
+	for i, item := range in {
+		if item.Key == keys[0] {
+			if len(keys) == 1 {
+				in[i].Value = v
+				return in, true
+			}
+			newIn, ok := item.Value.(bson.D)
+			if !ok {
+				return in, false
+			}
+			result, ok := Set(newIn, v, keys[1:]...)
+			in[i].Value = result
+			return in, ok
+		}
+	}
+
+	if len(keys) == 1 {
+		return append(in, primitive.E{keys[0], v}), true
+	}
+	result, ok := Set(bson.D{}, v, keys[1:]...)
+	return append(in, primitive.E{keys[0], result}), ok
+}
+
 // Ok returns the "ok" status of the result. This is required as mongo
 // is very inconsistent on the type it uses for "ok"; so this saves all
 // of the type switching across the codebase
@@ -85,3 +85,63 @@ func TestPop(t *testing.T) {
 		})
 	}
 }
+
+func TestSet(t *testing.T) {
+	tests := []struct {
+		in   bson.D
+		out  bson.D
+		keys []string
+		v    interface{}
+		ok   bool
+	}{
+		{
+			in:   bson.D{{"a", 1}},
+			out:  bson.D{{"a", 2}},
+			keys: []string{"a"},
+			v:    2,
+			ok:   true,
+		},
+		{
+			in:   bson.D{{"a", 1}},
+			out:  bson.D{{"a", 1}, {"b", 2}},
+			keys: []string{"b"},
+			v:    2,
+			ok:   true,
+		},
+		{
+			in:   bson.D{{"a", bson.D{{"b", 1}}}},
+			out:  bson.D{{"a", bson.D{{"b", 1}, {"c", 2}}}},
+			keys: []string{"a", "c"},
+			v:    2,
+			ok:   true,
+		},
+		{
+			in:   bson.D{},
+			out:  bson.D{{"a", bson.D{{"b", 2}}}},
+			keys: []string{"a", "b"},
+			v:    2,
+			ok:   true,
+		},
+		{
+			in:   bson.D{{"a", 1}},
+			out:  bson.D{{"a", 1}},
+			keys: []string{"a", "b"},
+			v:    2,
+			ok:   false,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			out, ok := Set(test.in, test.v, test.keys...)
+
+			if ok != test.ok {
+				t.Fatalf("Mismatch in ok: expected=%v actual=%v", test.ok, ok)
+			}
+
+			if !reflect.DeepEqual(out, test.out) {
+				t.Fatalf("Mismatch in out: expected=%v actual=%v", test.out, out)
+			}
+		})
+	}
+}
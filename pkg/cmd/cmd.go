@@ -2,11 +2,15 @@ package cmd
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -79,7 +83,9 @@ func Main() {
 	logrus.Debugf("Metrics bind started: %v", ml.Addr())
 	mux := http.NewServeMux()
 
-	ready := false
+	// ready is read by the health checks, so it is only accessed atomically
+	var ready int32
+	isReady := func() bool { return atomic.LoadInt32(&ready) == 1 }
 	go func() {
 		mux.Handle("/metrics", promhttp.Handler())
 
@@ -89,11 +95,11 @@ func Main() {
 		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
-		// TODO: better HC
-		// This is a dumb liveliness check endpoint. Currently this checks
-		// nothing and will always return 200 if the process is live.
+		// This is a dumb liveliness check endpoint, kept for existing
+		// deployments. It checks nothing and will always return 200 if the
+		// process is live; /livez and /readyz run actual checks.
 		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-			if !ready {
+			if !isReady() {
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			}
 		})
@@ -101,18 +107,52 @@ func Main() {
 	}()
 
 	// Start up the server
-	l, err := net.Listen("tcp", cfg.BindAddr) // TODO: allow multiple?
+	proxy, err := mongoproxy.NewProxy(nil, cfg)
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	proxy, err := mongoproxy.NewProxy(l, cfg)
-	if err != nil {
-		logrus.Fatal(err)
+	// reload reloads the config from the config file; it is used both for SIGHUP and
+	// the mongoproxyReloadConfig command
+	var reloadLock sync.Mutex
+	reload := func() error {
+		reloadLock.Lock()
+		defer reloadLock.Unlock()
+
+		newCfg, err := config.ConfigFromFile(opts.Config)
+		if err != nil {
+			return fmt.Errorf("error loading config: %v", err)
+		}
+		if listenersChanged(cfg.GetListeners(), newCfg.GetListeners()) {
+			logrus.Warnf("listeners (bindAddr, tls or listeners) changed; this requires a restart")
+		}
+		if err := proxy.Reload(newCfg); err != nil {
+			return err
+		}
+		cfg = newCfg
+		return nil
+	}
+	proxy.SetReloadFunc(reload)
+
+	// The admin API and health checks are served alongside the metrics
+	proxy.RegisterAdminHandlers(mux)
+	proxy.RegisterHealthHandlers(mux, isReady)
+
+	listeners := cfg.GetListeners()
+	if len(listeners) == 0 {
+		logrus.Fatal("no listeners configured; set bindAddr or listeners")
+	}
+	for _, lc := range listeners {
+		l, err := mongoproxy.Listen(lc)
+		if err != nil {
+			logrus.Fatalf("Error starting listener %s: %v", lc.Addr, err)
+		}
+		logrus.Infof("Listening on %s %s", lc.Network, l.Addr())
+		proxy.AddListener(lc.Name, l)
 	}
 
 	go func() {
-		ready = true
+		atomic.StoreInt32(&ready, 1)
 		if err := proxy.Serve(); err != nil && err != mongoproxy.ErrServerClosed {
 			logrus.Fatal(err)
 		}
@@ -124,9 +164,14 @@ func Main() {
 	for sig := range sigs {
 		switch sig {
 		case syscall.SIGHUP:
-			logrus.Infof("TODO: Reloading config")
+			logrus.Infof("Reloading config")
+			if err := reload(); err != nil {
+				logrus.Errorf("Error reloading config, keeping current config: %v", err)
+				continue
+			}
+			logrus.Infof("Reloaded config")
 		case syscall.SIGTERM, syscall.SIGINT:
-			ready = false
+			atomic.StoreInt32(&ready, 0)
 			logrus.Infof("received exit signal, starting graceful shutdown after %v", opts.TermSleep)
 			time.Sleep(opts.TermSleep)
 			logrus.Info("starting graceful shutdown NOW")
@@ -139,3 +184,22 @@ func Main() {
 		}
 	}
 }
+
+// listenersChanged returns whether any of the listener settings which require a
+// restart changed. Listener plugins are reloaded so they aren't compared.
+func listenersChanged(a, b []*config.ListenerConfig) bool {
+	if len(a) != len(b) {
+		return true
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name ||
+			a[i].Network != b[i].Network ||
+			a[i].Addr != b[i].Addr ||
+			a[i].SocketFileMode != b[i].SocketFileMode ||
+			!reflect.DeepEqual(a[i].TLS, b[i].TLS) ||
+			!reflect.DeepEqual(a[i].ProxyProtocol, b[i].ProxyProtocol) {
+			return true
+		}
+	}
+	return false
+}
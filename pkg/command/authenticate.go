@@ -0,0 +1,35 @@
+package command
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+)
+
+func init() {
+	Register("authenticate", func() Command {
+		return &Authenticate{}
+	})
+}
+
+// the struct for the 'authenticate' command.
+type Authenticate struct {
+	Authenticate int    `bson:"authenticate"`
+	Mechanism    string `bson:"mechanism"`
+	User         string `bson:"user,omitempty"`
+
+	Common `bson:",inline"`
+}
+
+func (m *Authenticate) FromBSOND(d bson.D) error {
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+
+	return nil
+}
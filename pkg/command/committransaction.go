@@ -0,0 +1,38 @@
+package command
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+)
+
+func init() {
+	Register("commitTransaction", func() Command {
+		return &CommitTransaction{}
+	})
+}
+
+// the struct for the 'commitTransaction' command.
+type CommitTransaction struct {
+	CommitTransaction int           `bson:"commitTransaction"`
+	WriteConcern      *WriteConcern `bson:"writeConcern,omitempty"`
+	// RecoveryToken is returned by mongos for a transaction to be committed/aborted through another mongos
+	RecoveryToken bson.D      `bson:"recoveryToken,omitempty"`
+	MaxTimeMS     *int64      `bson:"maxTimeMS,omitempty"`
+	Comment       interface{} `bson:"comment,omitempty"`
+
+	Common `bson:",inline"`
+}
+
+func (m *CommitTransaction) FromBSOND(d bson.D) error {
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type WriteConcern struct {
@@ -13,7 +14,8 @@ type WriteConcern struct {
 }
 
 type ReadConcern struct {
-	Level string `bson:"level,omitempty"`
+	Level            string               `bson:"level,omitempty"`
+	AfterClusterTime *primitive.Timestamp `bson:"afterClusterTime,omitempty"`
 }
 
 type ReadPreference struct {
@@ -18,6 +18,7 @@ type Delete struct {
 	Deletes      []bson.D      `bson:"deletes"`
 	Ordered      *bool         `bson:"ordered,omitempty"`
 	WriteConcern *WriteConcern `bson:"writeConcern,omitempty"`
+	ReadConcern  *ReadConcern  `bson:"readConcern,omitempty"`
 	Hint         interface{}   `bson:"hint,omitempty"`
 
 	Common `bson:",inline"`
@@ -28,6 +28,7 @@ type FindAndModify struct {
 	Upsert                   *bool         `bson:"upsert,omitempty"`
 	BypassDocumentValidation *bool         `bson:"bypassDocumentValidation,omitempty"`
 	WriteConcern             *WriteConcern `bson:"writeConcern,omitempty"`
+	ReadConcern              *ReadConcern  `bson:"readConcern,omitempty"`
 	Collation                *Collation    `bson:"collation,omitempty"`
 	ArrayFilters             interface{}   `bson:"arrayFilters,omitempty"` // TODO
 
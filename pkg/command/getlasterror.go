@@ -0,0 +1,43 @@
+package command
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+)
+
+func init() {
+	Register("getLastError", func() Command {
+		return &GetLastError{}
+	})
+
+	Register("getlasterror", func() Command {
+		return &GetLastError{}
+	})
+}
+
+// the struct for the 'getLastError' command.
+type GetLastError struct {
+	GetLastError       int `bson:"getLastError"`
+	GetLastErrorLegacy int `bson:"getlasterror"`
+
+	W        interface{} `bson:"w,omitempty"`
+	WTimeout *int64      `bson:"wtimeout,omitempty"`
+	J        *bool       `bson:"j,omitempty"`
+	FSync    *bool       `bson:"fsync,omitempty"`
+
+	Common `bson:",inline"`
+}
+
+func (m *GetLastError) FromBSOND(d bson.D) error {
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+
+	return nil
+}
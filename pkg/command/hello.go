@@ -0,0 +1,53 @@
+package command
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+)
+
+func init() {
+	Register("hello", func() Command {
+		return &Hello{}
+	})
+}
+
+// Hello mongo command
+type Hello struct {
+	Hello       int      `bson:"hello"`
+	HelloOk     bool     `bson:"helloOk"`
+	Client      bson.D   `bson:"client"` // TODO parse out
+	Compression []string `bson:"compression"`
+	// SaslSupportedMechs is the "<db>.<user>" the client wants the supported mechanisms for
+	SaslSupportedMechs string `bson:"saslSupportedMechs,omitempty"`
+	LoadBalanced       bool   `bson:"loadBalanced,omitempty"`
+	// DocumentSequences is set by clients which accept document sequences in replies
+	DocumentSequences *bool `bson:"mongoproxyDocumentSequences,omitempty"`
+
+	// TopologyVersion and MaxAwaitTimeMS are set for an awaitable hello
+	TopologyVersion *TopologyVersion `bson:"topologyVersion,omitempty"`
+	MaxAwaitTimeMS  *int64           `bson:"maxAwaitTimeMS,omitempty"`
+
+	Common `bson:",inline"`
+}
+
+// TopologyVersion is the version of the topology a client last saw
+type TopologyVersion struct {
+	ProcessID primitive.ObjectID `bson:"processId"`
+	Counter   int64              `bson:"counter"`
+}
+
+// From BSOND loads a command from a bson.D
+func (m *Hello) FromBSOND(d bson.D) error {
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+
+	return nil
+}
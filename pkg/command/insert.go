@@ -19,6 +19,7 @@ type Insert struct {
 	Ordered    *bool    `bson:"ordered,omitempty"`
 	//selector                 description.ServerSelector
 	WriteConcern             *WriteConcern `bson:"writeConcern,omitempty"`
+	ReadConcern              *ReadConcern  `bson:"readConcern,omitempty"`
 	BypassDocumentValidation *bool         `bson:"bypassDocumentValidation,omitempty"`
 
 	Common `bson:",inline"`
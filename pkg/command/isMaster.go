@@ -24,6 +24,14 @@ type IsMaster struct {
 	Client         bson.D   `bson:"client"` // TODO parse out
 	Compression    []string `bson:"compression"`
 	HostInfo       string   `bson:"hostInfo"`
+	// SaslSupportedMechs is the "<db>.<user>" the client wants the supported mechanisms for
+	SaslSupportedMechs string `bson:"saslSupportedMechs,omitempty"`
+	// DocumentSequences is set by clients which accept document sequences in replies
+	DocumentSequences *bool `bson:"mongoproxyDocumentSequences,omitempty"`
+
+	// TopologyVersion and MaxAwaitTimeMS are set for an awaitable isMaster
+	TopologyVersion *TopologyVersion `bson:"topologyVersion,omitempty"`
+	MaxAwaitTimeMS  *int64           `bson:"maxAwaitTimeMS,omitempty"`
 
 	Common `bson:",inline"`
 }
@@ -0,0 +1,33 @@
+package command
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+)
+
+func init() {
+	Register("mongoproxyListConnections", func() Command {
+		return &MongoproxyListConnections{}
+	})
+}
+
+// the struct for the 'mongoproxyListConnections' command: the client connections of the proxy
+type MongoproxyListConnections struct {
+	MongoproxyListConnections int `bson:"mongoproxyListConnections"`
+
+	Common `bson:",inline"`
+}
+
+func (m *MongoproxyListConnections) FromBSOND(d bson.D) error {
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package command
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+)
+
+func init() {
+	Register("mongoproxyListCursors", func() Command {
+		return &MongoproxyListCursors{}
+	})
+}
+
+// the struct for the 'mongoproxyListCursors' command: the cursors the proxy handed out to clients
+type MongoproxyListCursors struct {
+	MongoproxyListCursors int `bson:"mongoproxyListCursors"`
+
+	Common `bson:",inline"`
+}
+
+func (m *MongoproxyListCursors) FromBSOND(d bson.D) error {
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package command
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+)
+
+func init() {
+	Register("mongoproxyListSessions", func() Command {
+		return &MongoproxyListSessions{}
+	})
+}
+
+// the struct for the 'mongoproxyListSessions' command: the logical sessions the proxy tracks
+type MongoproxyListSessions struct {
+	MongoproxyListSessions int `bson:"mongoproxyListSessions"`
+
+	Common `bson:",inline"`
+}
+
+func (m *MongoproxyListSessions) FromBSOND(d bson.D) error {
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package command
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+)
+
+func init() {
+	Register("mongoproxyPluginState", func() Command {
+		return &MongoproxyPluginState{}
+	})
+}
+
+// the struct for the 'mongoproxyPluginState' command: the state reported by the plugins of the proxy
+type MongoproxyPluginState struct {
+	MongoproxyPluginState int `bson:"mongoproxyPluginState"`
+
+	Common `bson:",inline"`
+}
+
+func (m *MongoproxyPluginState) FromBSOND(d bson.D) error {
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+
+	return nil
+}
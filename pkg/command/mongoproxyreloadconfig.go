@@ -0,0 +1,33 @@
+package command
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+)
+
+func init() {
+	Register("mongoproxyReloadConfig", func() Command {
+		return &MongoproxyReloadConfig{}
+	})
+}
+
+// the struct for the 'mongoproxyReloadConfig' command: reload the config of the proxy
+type MongoproxyReloadConfig struct {
+	MongoproxyReloadConfig int `bson:"mongoproxyReloadConfig"`
+
+	Common `bson:",inline"`
+}
+
+func (m *MongoproxyReloadConfig) FromBSOND(d bson.D) error {
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+
+	return nil
+}
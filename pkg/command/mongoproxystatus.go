@@ -0,0 +1,33 @@
+package command
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+)
+
+func init() {
+	Register("mongoproxyStatus", func() Command {
+		return &MongoproxyStatus{}
+	})
+}
+
+// the struct for the 'mongoproxyStatus' command: the status of the proxy itself
+type MongoproxyStatus struct {
+	MongoproxyStatus int `bson:"mongoproxyStatus"`
+
+	Common `bson:",inline"`
+}
+
+func (m *MongoproxyStatus) FromBSOND(d bson.D) error {
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+
+	return nil
+}
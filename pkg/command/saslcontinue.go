@@ -0,0 +1,35 @@
+package command
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+)
+
+func init() {
+	Register("saslContinue", func() Command {
+		return &SaslContinue{}
+	})
+}
+
+// the struct for the 'saslContinue' command.
+type SaslContinue struct {
+	SaslContinue   int    `bson:"saslContinue"`
+	ConversationID int    `bson:"conversationId"`
+	Payload        []byte `bson:"payload"`
+
+	Common `bson:",inline"`
+}
+
+func (m *SaslContinue) FromBSOND(d bson.D) error {
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -12,13 +12,13 @@ func init() {
 	})
 }
 
-// the struct for the 'find' command.
+// the struct for the 'saslStart' command.
 type SaslStart struct {
-	SaslStart     int    `bson:"saslStart"`
-	Mechanism     string `bson:"mechanism"`
-	Payload       []byte `bson:"payload"`
-	AutoAuthorize int    `bson:"autoAuthorize,omitempty"`
-	Options       bson.D `bson:"options,omitempty"` // TODO: expand
+	SaslStart     int          `bson:"saslStart"`
+	Mechanism     string       `bson:"mechanism"`
+	Payload       []byte       `bson:"payload"`
+	AutoAuthorize int          `bson:"autoAuthorize,omitempty"`
+	Options       *SaslOptions `bson:"options,omitempty"`
 
 	Common `bson:",inline"`
 }
@@ -35,3 +35,8 @@ func (m *SaslStart) FromBSOND(d bson.D) error {
 
 	return nil
 }
+
+// SaslOptions are the options a client may send with saslStart
+type SaslOptions struct {
+	SkipEmptyExchange bool `bson:"skipEmptyExchange,omitempty"`
+}
@@ -12,13 +12,29 @@ func init() {
 	})
 }
 
-// the struct for the 'update' command.
+// the struct for the 'serverStatus' command.
 type ServerStatus struct {
 	ServerStatus int `bson:"serverStatus"`
 
+	// Sections are the sections the client included/excluded (e.g. {"metrics": 0})
+	Sections map[string]interface{} `bson:",inline"`
+
 	Common `bson:",inline"`
 }
 
+// IncludeSection returns whether the given section should be in the response;
+// sections are included unless the client excluded them
+func (m *ServerStatus) IncludeSection(name string) bool {
+	v, ok := m.Sections[name]
+	if !ok {
+		return true
+	}
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	return bsonutil.BoolNumber(v)
+}
+
 func (m *ServerStatus) FromBSOND(d bson.D) error {
 	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
 	if err != nil {
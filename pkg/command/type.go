@@ -16,16 +16,23 @@ func (t *OptionalDoc) IsZero() bool {
 }
 
 type Session struct {
-	LSID        bson.D       `bson:"lsid,omitempty"`
-	TxnNumber   *int64       `bson:"txnNumber,omitempty"`
-	StmtIDs     []int32      `bson:"stmtIds,omitempty"`
-	ClusterTime *ClusterTime `bson:"$clusterTime,omitempty"`
+	LSID             bson.D       `bson:"lsid,omitempty"`
+	TxnNumber        *int64       `bson:"txnNumber,omitempty"`
+	StartTransaction *bool        `bson:"startTransaction,omitempty"`
+	Autocommit       *bool        `bson:"autocommit,omitempty"`
+	StmtIDs          []int32      `bson:"stmtIds,omitempty"`
+	ClusterTime      *ClusterTime `bson:"$clusterTime,omitempty"`
 }
 
 func (s *Session) GetSession() *Session {
 	return s
 }
 
+// InTransaction returns whether the command is part of a multi-document transaction
+func (s *Session) InTransaction() bool {
+	return s.TxnNumber != nil && s.Autocommit != nil && !*s.Autocommit
+}
+
 type ClusterTime struct {
 	ClusterTime primitive.Timestamp `bson:"clusterTime,omitempty"`
 	Signature   bson.Raw            `bson:"signature,omitempty"`
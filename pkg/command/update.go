@@ -17,6 +17,7 @@ type Update struct {
 	Collection               string            `bson:"update"`
 	Updates                  []UpdateStatement `bson:"updates"`
 	WriteConcern             *WriteConcern     `bson:"writeConcern,omitempty"`
+	ReadConcern              *ReadConcern      `bson:"readConcern,omitempty"`
 	Ordered                  *bool             `bson:"ordered,omitempty"`
 	BypassDocumentValidation *bool             `bson:"bypassDocumentValidation,omitempty"`
 
@@ -0,0 +1,236 @@
+package mongoproxy
+
+import (
+	"encoding/hex"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// connectionInfo describes a client connection to the admin commands and API
+type connectionInfo struct {
+	ID          int64     `bson:"id"`
+	Addr        string    `bson:"addr"`
+	Listener    string    `bson:"listener"`
+	State       string    `bson:"state"`
+	StateSince  time.Time `bson:"stateSince"`
+	Created     time.Time `bson:"created"`
+	AgeMillis   int64     `bson:"ageMillis"`
+	Users       []string  `bson:"users"`
+	TLS         bool      `bson:"tls"`
+	LastCommand string    `bson:"lastCommand,omitempty"`
+}
+
+// cursorInfo describes a cursor open for a client to the admin commands and API
+type cursorInfo struct {
+	ID        int64     `bson:"id"`
+	NS        string    `bson:"ns"`
+	Client    string    `bson:"client"`
+	Users     []string  `bson:"users"`
+	LastUsed  time.Time `bson:"lastUsed"`
+	NoTimeout bool      `bson:"noCursorTimeout"`
+}
+
+// sessionInfo describes a logical session to the admin commands and API
+type sessionInfo struct {
+	ID           string    `bson:"id"`
+	Users        []string  `bson:"users"`
+	LastUsed     time.Time `bson:"lastUsed"`
+	Cursors      []int64   `bson:"cursors"`
+	PinnedServer string    `bson:"pinnedServer,omitempty"`
+}
+
+// SetReloadFunc sets the function mongoproxyReloadConfig uses to reload the config
+// from its source (e.g. the config file). Without one the current config is reloaded,
+// which reconfigures the plugins.
+func (p *Proxy) SetReloadFunc(f func() error) {
+	p.reloadLock.Lock()
+	defer p.reloadLock.Unlock()
+	p.reloadFunc = f
+}
+
+// handleAdminCommand handles the proxy admin (mongoproxy*) commands; false if cmd
+// isn't one of them
+func (p *Proxy) handleAdminCommand(cmd command.Command) (bson.D, bool) {
+	switch cmd.(type) {
+	case *command.MongoproxyStatus:
+		return p.status(), true
+
+	case *command.MongoproxyListConnections:
+		return bson.D{{"connections", p.listConnections()}, {"ok", 1}}, true
+
+	case *command.MongoproxyListCursors:
+		return bson.D{{"cursors", p.cursorCache.list()}, {"ok", 1}}, true
+
+	case *command.MongoproxyListSessions:
+		return bson.D{{"sessions", p.listSessions()}, {"ok", 1}}, true
+
+	case *command.MongoproxyReloadConfig:
+		if err := p.reloadConfig(); err != nil {
+			return mongoerror.OperationFailed.ErrMessage("error reloading config: " + err.Error()), true
+		}
+		return bson.D{{"ok", 1}}, true
+
+	case *command.MongoproxyPluginState:
+		return bson.D{{"plugins", p.pluginState()}, {"ok", 1}}, true
+	}
+
+	return nil, false
+}
+
+// status returns an overview of the proxy
+func (p *Proxy) status() bson.D {
+	uptime := time.Since(p.stats.start)
+
+	p.activeConnLock.Lock()
+	current := len(p.activeConn)
+	p.activeConnLock.Unlock()
+
+	listeners := make([]bson.D, len(p.listeners))
+	for i, ln := range p.listeners {
+		listeners[i] = bson.D{{"name", ln.name}, {"addr", ln.l.Addr().String()}}
+	}
+
+	pl := p.getPipeline()
+	names := make([]string, len(pl.plugins))
+	for i, plugin := range pl.plugins {
+		names[i] = plugin.Name()
+	}
+
+	return bson.D{
+		{"host", hostname()},
+		{"version", pl.cfg.Version},
+		{"pid", int64(os.Getpid())},
+		{"uptimeMillis", uptime.Milliseconds()},
+		{"listeners", listeners},
+		{"plugins", names},
+		{"connections", bson.D{
+			{"current", int64(current)},
+			{"totalCreated", atomic.LoadInt64(&p.stats.connectionsCreated)},
+		}},
+		{"cursors", bson.D{
+			{"open", int64(p.cursorCache.count())},
+			{"cached", int64(p.cursorCache.c.Count())},
+		}},
+		{"sessions", bson.D{
+			{"active", int64(p.sessions.count())},
+		}},
+		{"ok", 1},
+	}
+}
+
+// listConnections returns the active client connections ordered by id
+func (p *Proxy) listConnections() []connectionInfo {
+	p.activeConnLock.Lock()
+	conns := make([]*conn, 0, len(p.activeConn))
+	for c := range p.activeConn {
+		conns = append(conns, c)
+	}
+	p.activeConnLock.Unlock()
+
+	ret := make([]connectionInfo, len(conns))
+	for i, c := range conns {
+		state, since := c.getState()
+		ret[i] = connectionInfo{
+			ID:          c.id,
+			Addr:        c.cc.GetAddr(),
+			Listener:    c.cc.Listener,
+			State:       state.String(),
+			StateSince:  time.Unix(since, 0),
+			Created:     c.created.Truncate(time.Millisecond),
+			AgeMillis:   time.Since(c.created).Milliseconds(),
+			Users:       identityUsers(c.cc),
+			TLS:         c.cc.TLS != nil,
+			LastCommand: c.cc.LastCommand(),
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+// killConnection closes the client connection with the given id; false if there is
+// no such connection
+func (p *Proxy) killConnection(id int64) bool {
+	p.activeConnLock.Lock()
+	defer p.activeConnLock.Unlock()
+
+	for c := range p.activeConn {
+		if c.id == id {
+			logrus.Infof("Killing connection %d from %s", id, c.cc.GetAddr())
+			c.c.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// listSessions returns the tracked logical sessions
+func (p *Proxy) listSessions() []sessionInfo {
+	sessions := p.sessions.list()
+	ret := make([]sessionInfo, len(sessions))
+	for i, s := range sessions {
+		ret[i] = sessionInfo{
+			ID:           sessionID(s.Key),
+			Users:        s.Owner.Users,
+			LastUsed:     s.LastUsed().Truncate(time.Millisecond),
+			Cursors:      s.Cursors(),
+			PinnedServer: s.PinnedServer(),
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].LastUsed.After(ret[j].LastUsed) })
+	return ret
+}
+
+// reloadConfig reloads the config from its source
+func (p *Proxy) reloadConfig() error {
+	p.reloadLock.Lock()
+	f := p.reloadFunc
+	p.reloadLock.Unlock()
+
+	if f != nil {
+		return f()
+	}
+	return p.Reload(p.Config())
+}
+
+// pluginState returns the state of the plugins (in pipeline order) that report it
+func (p *Proxy) pluginState() []bson.D {
+	pl := p.getPipeline()
+	ret := make([]bson.D, 0, len(pl.plugins))
+	for _, plugin := range pl.plugins {
+		d := bson.D{{"name", plugin.Name()}}
+		if r, ok := plugin.(plugins.StateReporter); ok {
+			d = append(d, bson.E{"state", r.State()})
+		}
+		ret = append(ret, d)
+	}
+	return ret
+}
+
+// identityUsers returns the users the client is authenticated as
+func identityUsers(cc *plugins.ClientConnection) []string {
+	identities := cc.Identities()
+	users := make([]string, 0, len(identities))
+	for _, identity := range identities {
+		users = append(users, plugins.IdentityName(identity))
+	}
+	return users
+}
+
+// sessionID formats the key of a session (the id of its lsid, normally a UUID)
+func sessionID(key string) string {
+	b := []byte(key)
+	if len(b) != 16 {
+		return hex.EncodeToString(b)
+	}
+	return hex.EncodeToString(b[0:4]) + "-" + hex.EncodeToString(b[4:6]) + "-" + hex.EncodeToString(b[6:8]) + "-" +
+		hex.EncodeToString(b[8:10]) + "-" + hex.EncodeToString(b[10:])
+}
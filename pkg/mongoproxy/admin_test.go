@@ -0,0 +1,95 @@
+package mongoproxy
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+type statePlugin struct {
+	funcPlugin
+	state bson.D
+}
+
+func (s statePlugin) Name() string  { return "state" }
+func (s statePlugin) State() bson.D { return s.state }
+
+func TestAdminCommands(t *testing.T) {
+	cfg := &config.Config{}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := funcPlugin(func(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+		return next(ctx, r)
+	})
+	proxy.pipeline.Store(proxy.newPipeline(cfg, []plugins.Plugin{
+		next,
+		statePlugin{funcPlugin: next, state: bson.D{{"version", "abc"}}},
+	}))
+
+	cc := plugins.NewClientConnection()
+	run := func(cmd string) bson.D {
+		result, err := proxy.HandleMongo(context.Background(), &plugins.Request{CC: cc, CursorCache: proxy}, bson.D{{cmd, 1}, {"$db", "admin"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bsonutil.Ok(result) {
+			t.Fatalf("%s failed: %v", cmd, result)
+		}
+		return result
+	}
+
+	status := run("mongoproxyStatus")
+	if plugins, _ := bsonutil.Lookup(status, "plugins"); !reflect.DeepEqual(plugins, []string{"func", "state"}) {
+		t.Fatalf("unexpected plugins in status: %v", status)
+	}
+
+	if cursors, _ := bsonutil.Lookup(run("mongoproxyListCursors"), "cursors"); !reflect.DeepEqual(cursors, []cursorInfo{}) {
+		t.Fatalf("unexpected cursors: %v", cursors)
+	}
+	if sessions, _ := bsonutil.Lookup(run("mongoproxyListSessions"), "sessions"); !reflect.DeepEqual(sessions, []sessionInfo{}) {
+		t.Fatalf("unexpected sessions: %v", sessions)
+	}
+
+	state, _ := bsonutil.Lookup(run("mongoproxyPluginState"), "plugins")
+	expected := []bson.D{
+		{{"name", "func"}},
+		{{"name", "state"}, {"state", bson.D{{"version", "abc"}}}},
+	}
+	if !reflect.DeepEqual(state, expected) {
+		t.Fatalf("unexpected plugin state: %v", state)
+	}
+
+	// Reload uses the reload func if set
+	reloads := 0
+	proxy.SetReloadFunc(func() error {
+		reloads++
+		return nil
+	})
+	run("mongoproxyReloadConfig")
+	if reloads != 1 {
+		t.Fatalf("expected 1 reload, got %d", reloads)
+	}
+
+	proxy.SetReloadFunc(func() error { return errors.New("bad config") })
+	result, err := proxy.HandleMongo(context.Background(), &plugins.Request{CC: cc, CursorCache: proxy}, bson.D{{"mongoproxyReloadConfig", 1}, {"$db", "admin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bsonutil.Ok(result) {
+		t.Fatalf("expected reload to fail: %v", result)
+	}
+}
@@ -0,0 +1,88 @@
+package mongoproxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The admin API is a JSON (relaxed extended JSON) API for inspecting and managing a
+// single proxy, meant to be served alongside the metrics:
+//
+//	GET    /admin/connections       the active client connections
+//	DELETE /admin/connections/<id>  close the client connection with the given id
+//	GET    /admin/cursors           the cursors open for clients
+//	GET    /admin/config            the effective config (with secrets redacted)
+//	GET    /admin/plugins           the state of the plugins (e.g. loaded config versions)
+
+// RegisterAdminHandlers registers the admin API handlers on mux
+func (p *Proxy) RegisterAdminHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/connections", adminGet(func() (bson.D, int) {
+		return bson.D{{"connections", p.listConnections()}}, http.StatusOK
+	}))
+	mux.HandleFunc("/admin/connections/", p.adminKillConnection)
+	mux.HandleFunc("/admin/cursors", adminGet(func() (bson.D, int) {
+		return bson.D{{"cursors", p.cursorCache.list()}}, http.StatusOK
+	}))
+	mux.HandleFunc("/admin/config", adminGet(func() (bson.D, int) {
+		cfg, err := p.Config().Redacted()
+		if err != nil {
+			return adminError(err.Error()), http.StatusInternalServerError
+		}
+		return cfg, http.StatusOK
+	}))
+	mux.HandleFunc("/admin/plugins", adminGet(func() (bson.D, int) {
+		return bson.D{{"plugins", p.pluginState()}}, http.StatusOK
+	}))
+}
+
+func (p *Proxy) adminKillConnection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		writeAdminJSON(w, adminError("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/admin/connections/"), 10, 64)
+	if err != nil {
+		writeAdminJSON(w, adminError("invalid connection id"), http.StatusBadRequest)
+		return
+	}
+	if !p.killConnection(id) {
+		writeAdminJSON(w, adminError("no such connection"), http.StatusNotFound)
+		return
+	}
+	writeAdminJSON(w, bson.D{{"killed", id}}, http.StatusOK)
+}
+
+// adminGet returns a handler for a read-only admin endpoint
+func adminGet(f func() (bson.D, int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", http.MethodGet)
+			writeAdminJSON(w, adminError("method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+		d, status := f()
+		writeAdminJSON(w, d, status)
+	}
+}
+
+func adminError(msg string) bson.D {
+	return bson.D{{"error", msg}}
+}
+
+func writeAdminJSON(w http.ResponseWriter, d bson.D, status int) {
+	b, err := bson.MarshalExtJSON(d, false, false)
+	if err != nil {
+		logrus.Errorf("Error marshalling admin response: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(b, '\n'))
+}
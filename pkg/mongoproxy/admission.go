@@ -0,0 +1,151 @@
+package mongoproxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongowire"
+)
+
+var (
+	clientConnectionRejectedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_client_connections_rejected_total",
+		Help: "The total number of client connections rejected by connection limits",
+	}, []string{"reason"})
+)
+
+const (
+	rejectAcceptRate          = "accept_rate"
+	rejectMaxConnections      = "max_connections"
+	rejectMaxConnectionsPerIP = "max_connections_per_ip"
+)
+
+// rejectTimeout bounds how long a rejected client has to send its first message, and
+// maxRejecting the number of rejected clients waited on at once
+var (
+	rejectTimeout = 5 * time.Second
+	maxRejecting  = int32(100)
+)
+
+// rejectMaxMessageSize is the largest first message read from a rejected client (plenty
+// for a hello); larger messages are closed on without a reply
+const rejectMaxMessageSize = mongowire.HeaderLen + 16<<10
+
+// admission enforces the client connection limits from the config
+type admission struct {
+	limiter *rate.Limiter
+
+	lock  sync.Mutex
+	total int
+	perIP map[string]int
+
+	// rejecting is the number of rejected connections being replied to
+	rejecting int32
+}
+
+func newAdmission(cfg *config.Config) *admission {
+	return &admission{
+		limiter: rate.NewLimiter(acceptLimit(cfg)),
+		perIP:   make(map[string]int),
+	}
+}
+
+func acceptLimit(cfg *config.Config) (rate.Limit, int) {
+	if cfg.AcceptRate > 0 {
+		return rate.Limit(cfg.AcceptRate), cfg.AcceptBurst
+	}
+	return rate.Inf, 0
+}
+
+// configure updates the accept rate limit from cfg
+func (a *admission) configure(cfg *config.Config) {
+	limit, burst := acceptLimit(cfg)
+	a.limiter.SetLimit(limit)
+	a.limiter.SetBurst(burst)
+}
+
+// allowAccept returns whether a new connection is within the accept rate
+func (a *admission) allowAccept() bool {
+	if a.limiter.Allow() {
+		return true
+	}
+	clientConnectionRejectedCounter.WithLabelValues(rejectAcceptRate).Inc()
+	return false
+}
+
+// acquire admits a connection from ip ("" if it didn't come from an IP), returning
+// false if this would exceed the connection limits. An admitted connection must
+// be released once closed.
+func (a *admission) acquire(cfg *config.Config, ip string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if cfg.MaxConnections > 0 && a.total >= cfg.MaxConnections {
+		clientConnectionRejectedCounter.WithLabelValues(rejectMaxConnections).Inc()
+		return false
+	}
+	if ip != "" && cfg.MaxConnectionsPerIP > 0 && a.perIP[ip] >= cfg.MaxConnectionsPerIP {
+		clientConnectionRejectedCounter.WithLabelValues(rejectMaxConnectionsPerIP).Inc()
+		return false
+	}
+
+	a.total++
+	if ip != "" {
+		a.perIP[ip]++
+	}
+	return true
+}
+
+func (a *admission) release(ip string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.total--
+	if ip != "" {
+		if a.perIP[ip] <= 1 {
+			delete(a.perIP, ip)
+		} else {
+			a.perIP[ip]--
+		}
+	}
+}
+
+// reject closes a connection rejected by the connection limits. Rather than an
+// unexplained reset the client's first message is replied to with errmsg (the limit is
+// likely to be lifted again, so the error is one drivers consider transient). If too
+// many rejected connections are already being replied to the connection is just closed.
+func (p *Proxy) reject(c net.Conn, errmsg string) {
+	defer c.Close()
+	if atomic.AddInt32(&p.admission.rejecting, 1) > maxRejecting {
+		atomic.AddInt32(&p.admission.rejecting, -1)
+		return
+	}
+	defer atomic.AddInt32(&p.admission.rejecting, -1)
+
+	c.SetDeadline(time.Now().Add(rejectTimeout))
+	req, err := mongowire.ReadRequestLimit(c, rejectMaxMessageSize)
+	if err != nil {
+		return
+	}
+	rc := &conn{p: p, c: c, cc: plugins.NewClientConnection()}
+	p.replyError(rc, *req.GetHeader(), req.GetHeader().OpCode, mongoerror.ExceededTimeLimit.ErrMessage(errmsg), func(reply mongowire.WireSerializer) error {
+		return reply.WriteTo(c)
+	})
+}
+
+// addrIP returns the IP of addr, or "" if it isn't an IP address (e.g. a unix socket)
+func addrIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	return ""
+}
@@ -0,0 +1,154 @@
+package mongoproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongowire"
+)
+
+func TestAdmission(t *testing.T) {
+	cfg := &config.Config{MaxConnections: 3, MaxConnectionsPerIP: 2, AcceptRate: 1}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+	a := newAdmission(cfg)
+
+	if !a.acquire(cfg, "10.0.0.1") || !a.acquire(cfg, "10.0.0.1") {
+		t.Fatalf("connections within the limits rejected")
+	}
+	if a.acquire(cfg, "10.0.0.1") {
+		t.Fatalf("per IP limit not enforced")
+	}
+	// Unix socket clients have no IP, so only the global limit applies
+	if !a.acquire(cfg, "") {
+		t.Fatalf("connection within the limits rejected")
+	}
+	if a.acquire(cfg, "10.0.0.2") {
+		t.Fatalf("global limit not enforced")
+	}
+
+	a.release("10.0.0.1")
+	if !a.acquire(cfg, "10.0.0.1") {
+		t.Fatalf("connection rejected after release")
+	}
+
+	// A burst of 1 (the default for a rate of 1/s)
+	if !a.allowAccept() {
+		t.Fatalf("accept rejected within rate")
+	}
+	if a.allowAccept() {
+		t.Fatalf("accept rate not enforced")
+	}
+
+	// Removing the limit on reload
+	cfg = &config.Config{}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+	a.configure(cfg)
+	if !a.allowAccept() || !a.acquire(cfg, "10.0.0.1") {
+		t.Fatalf("connection rejected without limits")
+	}
+}
+
+func TestAdmissionServe(t *testing.T) {
+	cfg := &config.Config{MaxConnectionsPerIP: 1}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewProxy(l, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve()
+	defer proxy.Shutdown(context.TODO())
+
+	first, err := net.Dial("tcp", proxy.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	// Wait for the first connection to be admitted
+	for i := 0; ; i++ {
+		proxy.admission.lock.Lock()
+		total := proxy.admission.total
+		proxy.admission.lock.Unlock()
+		if total == 1 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("connection not admitted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The second connection's first message is replied to with an error, then the
+	// connection is closed by the proxy
+	second, err := net.Dial("tcp", proxy.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetDeadline(time.Now().Add(5 * time.Second))
+	hello := &mongowire.OP_MSG{
+		Header:   mongowire.MessageHeader{RequestID: 42, OpCode: mongowire.OpMsg},
+		Sections: []mongowire.MSGSection{mongowire.MSGSection_Body{bson.D{{"hello", 1}, {"$db", "admin"}}}},
+	}
+	if err := hello.WriteTo(second); err != nil {
+		t.Fatal(err)
+	}
+	req, err := mongowire.ReadRequest(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := req.GetOpMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := reply.Sections[0].(mongowire.MSGSection_Body).Document
+	if code, _ := bsonutil.Lookup(result, "code"); reply.Header.ResponseTo != 42 || bsonutil.Ok(result) || code != int32(mongoerror.ExceededTimeLimit) {
+		t.Fatalf("unexpected reply: %v", result)
+	}
+	if errmsg, _ := bsonutil.Lookup(result, "errmsg"); !strings.Contains(errmsg.(string), "too many connections") {
+		t.Fatalf("unexpected reply: %v", result)
+	}
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected connection to be closed, got %v", err)
+	}
+
+	// A rejected connection whose first message is larger than a hello is closed
+	// without reading the message
+	third, err := net.Dial("tcp", proxy.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	// Less than rejectTimeout, which the proxy would wait for the rest of the message
+	third.SetDeadline(time.Now().Add(time.Second))
+	hdr, err := mongowire.MessageHeader{MessageLength: rejectMaxMessageSize + 1, RequestID: 42, OpCode: mongowire.OpMsg}.ToWire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := third.Write(hdr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := third.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected connection to be closed, got %v", err)
+	}
+}
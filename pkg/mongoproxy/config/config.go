@@ -1,18 +1,28 @@
 package config
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongowire"
 )
 
 // DefaultConfig is a base default config
 var DefaultConfig = Config{
 	RequestLengthLimit: 1024,
+	Version:            "4.3.1",
 }
 
 // ConfigFromFile loads a config (based on DefaultConfig) from the given path
@@ -43,10 +53,60 @@ type Config struct {
 	// IdleCursorTimeoutMillis
 	IdleCursorTimeoutMillis *string `bson:"idleCursorTimeoutMillis"`
 	IdleCursorTimeout       time.Duration
+	// CursorTimeouts override IdleCursorTimeout for the cursors of a namespace
+	CursorTimeouts []*CursorTimeoutConfig `bson:"cursorTimeouts"`
+
+	// MaxCursors is the max number of cursors open for clients (0 for no limit). When
+	// a cursor is opened beyond the limit the least recently used cursor is killed
+	MaxCursors int `bson:"maxCursors"`
+	// MaxCursorsPerConnection is the max number of cursors opened by a single client
+	// connection (0 for no limit); enforced the same way as MaxCursors
+	MaxCursorsPerConnection int `bson:"maxCursorsPerConnection"`
 
 	InternalIdentity *plugins.StaticIdentity `bson:"internalIdentity"`
 
+	// TLS enables TLS on the client listener
+	TLS *TLSConfig `bson:"tls"`
+	// ProxyProtocol enables PROXY protocol headers on the client listener
+	ProxyProtocol *ProxyProtocolConfig `bson:"proxyProtocol"`
+
+	// Listeners are the client listeners. If BindAddr is set it is added (with TLS)
+	// as the first listener.
+	Listeners []*ListenerConfig `bson:"listeners"`
+
 	RequestLengthLimit int `bson:"requestLengthLimit"`
+
+	// MaxMessageSizeBytes is the max size of a message from a client (including the
+	// header); larger messages close the connection. This is advertised to clients as
+	// maxMessageSizeBytes. Default 48000000 (as mongod)
+	MaxMessageSizeBytes int `bson:"maxMessageSizeBytes"`
+
+	// Version is the mongo version reported to clients (buildInfo, serverStatus); this
+	// should match the version of the downstream mongo
+	Version string `bson:"version"`
+	// VersionArray is the parsed Version (e.g. [4, 3, 1, 0])
+	VersionArray []int32
+
+	// MaxConnections is the max number of open client connections (0 for no limit)
+	MaxConnections int `bson:"maxConnections"`
+	// MaxConnectionsPerIP is the max number of open client connections from a single
+	// client IP (0 for no limit)
+	MaxConnectionsPerIP int `bson:"maxConnectionsPerIP"`
+	// AcceptRate is the max number of new client connections accepted per second, with
+	// bursts of up to AcceptBurst (default AcceptRate) connections (0 for no limit)
+	AcceptRate  float64 `bson:"acceptRate"`
+	AcceptBurst int     `bson:"acceptBurst"`
+
+	// UnacknowledgedWriteQueueSize is the number of unacknowledged (w:0) writes queued per
+	// client connection before we stop reading from the client. Default 1000
+	UnacknowledgedWriteQueueSize int `bson:"unacknowledgedWriteQueueSize"`
+
+	// DocumentSequenceThreshold is the size (in bytes) above which a cursor batch in an
+	// OP_MSG reply is sent as a document sequence (kind 1) section instead of within the
+	// body. Drivers don't decode document sequences in replies, so this only applies to
+	// clients which opt in with mongoproxyDocumentSequences in their hello. Disabled by
+	// default
+	DocumentSequenceThreshold int `bson:"documentSequenceThreshold"`
 }
 
 // Load will load all configuration
@@ -61,21 +121,212 @@ func (c *Config) Load() error {
 		c.IdleCursorTimeout = time.Minute * 30 // Default timeout
 	}
 
+	for _, t := range c.CursorTimeouts {
+		if err := t.Load(); err != nil {
+			return err
+		}
+	}
+	if c.MaxCursors < 0 || c.MaxCursorsPerConnection < 0 {
+		return fmt.Errorf("cursor limits must not be negative")
+	}
+
+	if c.Version == "" {
+		c.Version = DefaultConfig.Version
+	}
+	versionArray, err := parseVersion(c.Version)
+	if err != nil {
+		return err
+	}
+	c.VersionArray = versionArray
+
+	if c.MaxConnections < 0 || c.MaxConnectionsPerIP < 0 || c.AcceptRate < 0 || c.AcceptBurst < 0 {
+		return fmt.Errorf("connection limits must not be negative")
+	}
+	if c.AcceptRate > 0 && c.AcceptBurst == 0 {
+		c.AcceptBurst = int(math.Ceil(c.AcceptRate))
+	}
+
+	if c.MaxMessageSizeBytes < 0 {
+		return fmt.Errorf("maxMessageSizeBytes must not be negative")
+	}
+	if c.MaxMessageSizeBytes == 0 {
+		c.MaxMessageSizeBytes = mongowire.DefaultMaxMessageSize
+	}
+
+	if c.UnacknowledgedWriteQueueSize <= 0 {
+		c.UnacknowledgedWriteQueueSize = 1000
+	}
+
+	if c.TLS != nil {
+		if err := c.TLS.Load(); err != nil {
+			return err
+		}
+	}
+	if c.ProxyProtocol != nil {
+		if err := c.ProxyProtocol.Load(); err != nil {
+			return err
+		}
+	}
+
+	names := make(map[string]struct{}, len(c.Listeners))
+	for _, l := range c.Listeners {
+		if err := l.Load(); err != nil {
+			return err
+		}
+		if _, ok := names[l.Name]; ok {
+			return fmt.Errorf("duplicate listener %s", l.Name)
+		}
+		names[l.Name] = struct{}{}
+	}
+
+	return nil
+}
+
+// redactedKeys are the (lowercase) config keys whose values are secrets
+var redactedKeys = map[string]struct{}{
+	"credentials": {},
+	"password":    {},
+	"pwd":         {},
+	"secret":      {},
+	"token":       {},
+	"salt":        {},
+	"storedkey":   {},
+	"serverkey":   {},
+}
+
+// Redacted returns the effective config as a document with the secrets (e.g. user
+// credentials or the credentials in connection strings) redacted
+func (c *Config) Redacted() (bson.D, error) {
+	b, err := bson.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err := bson.Unmarshal(b, &d); err != nil {
+		return nil, err
+	}
+	return redactDoc(d), nil
+}
+
+func redactDoc(d bson.D) bson.D {
+	for i, e := range d {
+		if _, ok := redactedKeys[strings.ToLower(e.Key)]; ok {
+			d[i].Value = "REDACTED"
+			continue
+		}
+		d[i].Value = redactValue(e.Value)
+	}
+	return d
+}
+
+func redactValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case bson.D:
+		return redactDoc(val)
+	case primitive.A:
+		for i := range val {
+			val[i] = redactValue(val[i])
+		}
+		return val
+	case string:
+		return plugins.RedactAddr(val)
+	}
+	return v
+}
+
+// GetListeners returns all the client listeners, including the one from BindAddr
+func (c *Config) GetListeners() []*ListenerConfig {
+	if c.BindAddr == "" {
+		return c.Listeners
+	}
+
+	return append([]*ListenerConfig{{
+		Network:       "tcp",
+		Addr:          c.BindAddr,
+		TLS:           c.TLS,
+		ProxyProtocol: c.ProxyProtocol,
+	}}, c.Listeners...)
+}
+
+// CursorTimeout returns the idle timeout for cursors on the namespace ns. A timeout
+// for the collection takes precedence over one for the database.
+func (c *Config) CursorTimeout(ns string) time.Duration {
+	db := strings.SplitN(ns, ".", 2)[0]
+	timeout := c.IdleCursorTimeout
+	for _, t := range c.CursorTimeouts {
+		switch t.Namespace {
+		case ns:
+			return t.Timeout
+		case db:
+			timeout = t.Timeout
+		}
+	}
+	return timeout
+}
+
+// CursorTimeoutConfig is the idle cursor timeout for a namespace
+type CursorTimeoutConfig struct {
+	// Namespace is either a collection ("db.collection") or a database ("db")
+	Namespace string `bson:"namespace"`
+	// IdleTimeout is the duration (e.g. "10m") after which an idle cursor is killed
+	IdleTimeout string `bson:"idleTimeout"`
+	Timeout     time.Duration
+}
+
+// Load validates the config and parses IdleTimeout
+func (c *CursorTimeoutConfig) Load() error {
+	if c.Namespace == "" {
+		return fmt.Errorf("cursor timeout requires a namespace")
+	}
+	d, err := time.ParseDuration(c.IdleTimeout)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("cursor timeout for %s must be positive", c.Namespace)
+	}
+	c.Timeout = d
 	return nil
 }
 
+// parseVersion parses a version string (e.g. "4.4.1") into the versionArray
+// returned by buildInfo
+func parseVersion(v string) ([]int32, error) {
+	// Ignore any suffix (e.g. "-rc0")
+	parts := strings.Split(strings.SplitN(v, "-", 2)[0], ".")
+	if len(parts) > 4 {
+		return nil, fmt.Errorf("invalid version %s", v)
+	}
+
+	versionArray := make([]int32, 4)
+	for i, part := range parts {
+		n, err := strconv.ParseInt(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %s: %v", v, err)
+		}
+		versionArray[i] = int32(n)
+	}
+	return versionArray, nil
+}
+
 // GetPlugins returns a list of plugin instances for the given config
 func (c *Config) GetPlugins() ([]plugins.Plugin, error) {
-	ps := make([]plugins.Plugin, len(c.Plugins))
-	for i, config := range c.Plugins {
+	return getPlugins(c.Plugins)
+}
+
+func getPlugins(configs []PluginConfig) ([]plugins.Plugin, error) {
+	ps := make([]plugins.Plugin, len(configs))
+	for i, config := range configs {
 		p, ok := plugins.GetPlugin(config.Name)
 		if !ok {
 			return nil, fmt.Errorf("unknown plugin %s", config.Name)
 		}
+		ps[i] = p
 		if err := p.Configure(config.Config); err != nil {
+			// Release anything the plugins (including a partially configured one) are holding
+			plugins.ClosePlugins(context.TODO(), ps[:i+1])
 			return nil, err
 		}
-		ps[i] = p
 	}
 
 	return ps, nil
@@ -85,3 +336,189 @@ type PluginConfig struct {
 	Name   string `bson:"name"`
 	Config bson.D `bson:"config"`
 }
+
+// ListenerConfig is the configuration for a client listener
+type ListenerConfig struct {
+	// Name identifies the listener (e.g. in logs). Defaults to the Addr
+	Name string `bson:"name"`
+	// Network is either "tcp" (default) or "unix"
+	Network string `bson:"network"`
+	// Addr is the address to listen on: host:port for tcp or the socket path for unix
+	Addr string `bson:"addr"`
+	// SocketMode is the file mode (octal, e.g. "0660") of a unix socket
+	SocketMode *string `bson:"socketMode"`
+	// TLS enables TLS on the listener
+	TLS *TLSConfig `bson:"tls"`
+	// ProxyProtocol enables PROXY protocol headers on the listener (tcp only)
+	ProxyProtocol *ProxyProtocolConfig `bson:"proxyProtocol"`
+	// Plugins, if set, is the plugin pipeline used for clients of this listener
+	// instead of the top-level plugins
+	Plugins []PluginConfig `bson:"plugins"`
+
+	SocketFileMode os.FileMode
+}
+
+// Load will validate and load the listener configuration
+func (c *ListenerConfig) Load() error {
+	if c.Addr == "" {
+		return fmt.Errorf("listener requires an addr")
+	}
+	if c.Name == "" {
+		c.Name = c.Addr
+	}
+
+	switch c.Network {
+	case "":
+		c.Network = "tcp"
+	case "tcp", "unix":
+	default:
+		return fmt.Errorf("unknown listener network %s", c.Network)
+	}
+
+	if c.SocketMode != nil {
+		if c.Network != "unix" {
+			return fmt.Errorf("socketMode is only valid for unix listeners")
+		}
+		mode, err := strconv.ParseUint(*c.SocketMode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid socketMode %s: %v", *c.SocketMode, err)
+		}
+		c.SocketFileMode = os.FileMode(mode)
+	}
+
+	if c.TLS != nil {
+		if err := c.TLS.Load(); err != nil {
+			return err
+		}
+	}
+
+	if c.ProxyProtocol != nil {
+		if c.Network != "tcp" {
+			return fmt.Errorf("proxyProtocol is only valid for tcp listeners")
+		}
+		if err := c.ProxyProtocol.Load(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetPlugins returns a list of plugin instances for the listener's plugins
+func (c *ListenerConfig) GetPlugins() ([]plugins.Plugin, error) {
+	return getPlugins(c.Plugins)
+}
+
+// ProxyProtocolConfig is the configuration for PROXY protocol (v1 and v2) headers
+// sent by a load balancer in front of the proxy
+type ProxyProtocolConfig struct {
+	// TrustedCIDRs are the networks allowed to send a PROXY protocol header (e.g.
+	// the load balancers). Connections from these must send the header; connections
+	// from anywhere else are used as-is
+	TrustedCIDRs []string `bson:"trustedCIDRs"`
+	// HeaderTimeout is how long to wait for the header. Default 10s
+	HeaderTimeout *string `bson:"headerTimeout"`
+
+	TrustedNets           []*net.IPNet
+	HeaderTimeoutDuration time.Duration
+}
+
+// Load will validate and load the PROXY protocol configuration
+func (c *ProxyProtocolConfig) Load() error {
+	if len(c.TrustedCIDRs) == 0 {
+		return fmt.Errorf("proxyProtocol requires trustedCIDRs")
+	}
+
+	c.TrustedNets = make([]*net.IPNet, len(c.TrustedCIDRs))
+	for i, cidr := range c.TrustedCIDRs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		c.TrustedNets[i] = n
+	}
+
+	if c.HeaderTimeout != nil {
+		d, err := time.ParseDuration(*c.HeaderTimeout)
+		if err != nil {
+			return err
+		}
+		c.HeaderTimeoutDuration = d
+	} else {
+		c.HeaderTimeoutDuration = 10 * time.Second
+	}
+
+	return nil
+}
+
+// Trusted returns whether ip is allowed to send a PROXY protocol header
+func (c *ProxyProtocolConfig) Trusted(ip net.IP) bool {
+	for _, n := range c.TrustedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TLSConfig is the TLS configuration for a client listener
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM encoded server certificate and key
+	CertFile string `bson:"certFile"`
+	KeyFile  string `bson:"keyFile"`
+	// ClientCAFile is an optional PEM bundle used to verify client certificates
+	ClientCAFile string `bson:"clientCAFile"`
+	// ClientAuth is one of "none", "request", "verifyIfGiven" or "require". Defaults
+	// to "verifyIfGiven" if a ClientCAFile is set and "none" otherwise
+	ClientAuth string `bson:"clientAuth"`
+	// ReloadInterval is how often the certificate files are checked for changes. Default 1m
+	ReloadInterval *string `bson:"reloadInterval"`
+
+	ClientAuthType         tls.ClientAuthType
+	ReloadIntervalDuration time.Duration
+}
+
+// Load will validate and load the TLS configuration
+func (c *TLSConfig) Load() error {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return fmt.Errorf("tls requires certFile and keyFile")
+	}
+
+	switch c.ClientAuth {
+	case "":
+		if c.ClientCAFile != "" {
+			c.ClientAuthType = tls.VerifyClientCertIfGiven
+		} else {
+			c.ClientAuthType = tls.NoClientCert
+		}
+	case "none":
+		c.ClientAuthType = tls.NoClientCert
+	case "request":
+		c.ClientAuthType = tls.RequestClientCert
+	case "verifyIfGiven":
+		c.ClientAuthType = tls.VerifyClientCertIfGiven
+	case "require":
+		c.ClientAuthType = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("unknown tls clientAuth %s", c.ClientAuth)
+	}
+
+	if c.ClientCAFile == "" && (c.ClientAuthType == tls.VerifyClientCertIfGiven || c.ClientAuthType == tls.RequireAndVerifyClientCert) {
+		return fmt.Errorf("tls clientAuth %s requires a clientCAFile", c.ClientAuth)
+	}
+
+	if c.ReloadInterval != nil {
+		d, err := time.ParseDuration(*c.ReloadInterval)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("tls reloadInterval must be positive")
+		}
+		c.ReloadIntervalDuration = d
+	} else {
+		c.ReloadIntervalDuration = time.Minute
+	}
+
+	return nil
+}
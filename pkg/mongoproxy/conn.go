@@ -1,9 +1,13 @@
 package mongoproxy
 
 import (
+	"context"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
 )
 
 type ConnState int
@@ -27,8 +31,14 @@ func (c ConnState) String() string {
 }
 
 type conn struct {
-	p *Proxy
-	c net.Conn
+	p     *Proxy
+	c     net.Conn
+	cc    *plugins.ClientConnection
+	unack *unackQueue
+
+	// id identifies the connection to admin commands
+	id      int64
+	created time.Time
 
 	curState struct{ atomic uint64 } // packed (unixtime<<8|uint8(ConnState))
 }
@@ -55,3 +65,122 @@ func (c *conn) getState() (state ConnState, unixSec int64) {
 	packedState := atomic.LoadUint64(&c.curState.atomic)
 	return ConnState(packedState & 0xff), int64(packedState >> 8)
 }
+
+// aLongTimeAgo is a non-zero time, far in the past, used for immediate
+// cancellation of a pending read
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connReader is the io.Reader for a client connection. While a request is being
+// handled connReader does a background read on the connection so that we notice
+// when the client goes away; at which point the connection's context is cancelled
+// (this is the same approach net/http takes).
+type connReader struct {
+	c      net.Conn
+	cancel context.CancelFunc
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	inRead  bool
+	aborted bool // set when abortPendingRead is stopping the background read
+	hasByte bool // a byte was read by the background read
+	byteBuf [1]byte
+	err     error // sticky error from the background read
+}
+
+func newConnReader(c net.Conn, cancel context.CancelFunc) *connReader {
+	cr := &connReader{
+		c:      c,
+		cancel: cancel,
+	}
+	cr.cond = sync.NewCond(&cr.lock)
+	return cr
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+	cr.lock.Lock()
+	if cr.inRead {
+		cr.lock.Unlock()
+		panic("invalid concurrent Read call")
+	}
+	if cr.err != nil {
+		err := cr.err
+		cr.lock.Unlock()
+		return 0, err
+	}
+	if len(p) == 0 {
+		cr.lock.Unlock()
+		return 0, nil
+	}
+	if cr.hasByte {
+		p[0] = cr.byteBuf[0]
+		cr.hasByte = false
+		cr.lock.Unlock()
+		return 1, nil
+	}
+	cr.inRead = true
+	cr.lock.Unlock()
+
+	n, err := cr.c.Read(p)
+
+	cr.lock.Lock()
+	cr.inRead = false
+	cr.lock.Unlock()
+	cr.cond.Broadcast()
+
+	return n, err
+}
+
+// startBackgroundRead starts watching the connection for the client going away.
+// It must be stopped with abortPendingRead before calling Read again.
+func (cr *connReader) startBackgroundRead() {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if cr.inRead {
+		panic("invalid concurrent Read call")
+	}
+	// If we already have data (or an error) there is nothing to watch for
+	if cr.hasByte || cr.err != nil {
+		return
+	}
+	cr.inRead = true
+	cr.c.SetReadDeadline(time.Time{})
+	go cr.backgroundRead()
+}
+
+func (cr *connReader) backgroundRead() {
+	n, err := cr.c.Read(cr.byteBuf[:])
+
+	cr.lock.Lock()
+	if n == 1 {
+		// The client sent more data (e.g. a pipelined request); we'll return it from
+		// the next Read
+		cr.hasByte = true
+	}
+	if ne, ok := err.(net.Error); ok && cr.aborted && ne.Timeout() {
+		// Ignore the timeout error from abortPendingRead
+	} else if err != nil {
+		// The client went away (or the connection is otherwise broken); cancel
+		// the work being done on its behalf
+		cr.err = err
+		cr.cancel()
+	}
+	cr.aborted = false
+	cr.inRead = false
+	cr.lock.Unlock()
+	cr.cond.Broadcast()
+}
+
+// abortPendingRead stops a background read started by startBackgroundRead
+func (cr *connReader) abortPendingRead() {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if !cr.inRead {
+		return
+	}
+	cr.aborted = true
+	cr.c.SetReadDeadline(aLongTimeAgo)
+	for cr.inRead {
+		cr.cond.Wait()
+	}
+	cr.c.SetReadDeadline(time.Time{})
+}
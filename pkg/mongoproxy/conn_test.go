@@ -0,0 +1,86 @@
+package mongoproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnReader(t *testing.T) {
+	t.Run("pipelined", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cr := newConnReader(server, cancel)
+
+		cr.startBackgroundRead()
+		go client.Write([]byte("ab"))
+		// Give the background read time to consume the first byte
+		time.Sleep(10 * time.Millisecond)
+		cr.abortPendingRead()
+
+		if ctx.Err() != nil {
+			t.Fatalf("context cancelled with a live client")
+		}
+
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(cr, b); err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "ab" {
+			t.Fatalf("unexpected data read: %q", b)
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cr := newConnReader(server, cancel)
+
+		cr.startBackgroundRead()
+		cr.abortPendingRead()
+
+		if ctx.Err() != nil {
+			t.Fatalf("context cancelled by abortPendingRead")
+		}
+
+		// The connection must still be usable after the abort
+		go client.Write([]byte("a"))
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(cr, b); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer server.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cr := newConnReader(server, cancel)
+
+		cr.startBackgroundRead()
+		client.Close()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Fatalf("context not cancelled after client disconnect")
+		}
+		cr.abortPendingRead()
+
+		if _, err := cr.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("expected error reading from closed connection")
+		}
+	})
+}
@@ -0,0 +1,279 @@
+package mongoproxy
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ReneKroon/ttlcache/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var (
+	cursorsOpenGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_cursors_open",
+		Help: "The number of cursors open for clients",
+	})
+	cursorsExpiredCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mongoproxy_cursors_expired_total",
+		Help: "The total number of cursors killed after being idle for the cursor timeout",
+	})
+	cursorsKilledCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_cursors_killed_total",
+		Help: "The total number of cursors killed before being exhausted (other than by timeout)",
+	}, []string{"reason"})
+)
+
+const (
+	killClient                  = "client"
+	killMaxCursors              = "max_cursors"
+	killMaxCursorsPerConnection = "max_cursors_per_connection"
+)
+
+// openCursor is the state of a cursor handed out to a client
+type openCursor struct {
+	cc        *plugins.ClientConnection
+	ns        string
+	lastUsed  time.Time
+	noTimeout bool
+}
+
+// cursorCache holds the cursor entries shared by the proxy and plugins. Cursors
+// handed out to clients are tracked to enforce the cursor limits and timeouts from
+// the config; cursors which expire or are evicted are killed downstream.
+type cursorCache struct {
+	c *ttlcache.Cache
+
+	// kill kills a cursor downstream and closes it
+	kill func(cursorID int64)
+
+	// lock protects the fields below; it must not be held while calling into c as c
+	// holds its own lock while calling our callbacks
+	lock    sync.Mutex
+	cfg     *config.Config
+	rand    *rand.Rand
+	open    map[int64]*openCursor
+	perConn map[*plugins.ClientConnection]int
+}
+
+func newCursorCache(cfg *config.Config, kill func(cursorID int64)) *cursorCache {
+	c := &cursorCache{
+		c:       ttlcache.NewCache(),
+		kill:    kill,
+		cfg:     cfg,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		open:    make(map[int64]*openCursor),
+		perConn: make(map[*plugins.ClientConnection]int),
+	}
+
+	c.c.SetTTL(cfg.IdleCursorTimeout) // default TTL -- config
+	c.c.SetLoaderFunction(func(key string) (interface{}, time.Duration, error) {
+		cursorID, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return nil, time.Duration(0), err
+		}
+
+		return plugins.NewCursorCacheEntry(cursorID), time.Duration(0), nil
+	})
+	// noCursorTimeout cursors are never expired
+	c.c.SetCheckExpirationCallback(func(key string, value interface{}) bool {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		o, ok := c.open[value.(*plugins.CursorCacheEntry).ID]
+		return !ok || !o.noTimeout
+	})
+	// expiration handler to send killCursor commands
+	c.c.SetExpirationReasonCallback(func(key string, reason ttlcache.EvictionReason, value interface{}) {
+		logrus.Tracef("expire cursor %s", key)
+		if reason != ttlcache.Expired {
+			return
+		}
+
+		entry := value.(*plugins.CursorCacheEntry)
+		if c.untrack(entry.ID) {
+			cursorsExpiredCounter.Inc()
+		}
+
+		// If the cursor expired (we timed out waiting) we want to kill the downstream cursor as we remove it from the cache.
+		// The entry has already been removed; put it back so the backend can find the downstream cursor to kill
+		if entry.Downstream == nil {
+			return
+		}
+		c.c.Set(key, entry)
+		c.kill(entry.ID)
+	})
+
+	return c
+}
+
+// configure updates the cursor limits and timeouts from cfg. Timeouts only apply
+// to cursors opened after the change.
+func (c *cursorCache) configure(cfg *config.Config) {
+	c.c.SetTTL(cfg.IdleCursorTimeout)
+
+	c.lock.Lock()
+	c.cfg = cfg
+	c.lock.Unlock()
+}
+
+// get returns the entry for cursorID, creating it if it doesn't exist
+func (c *cursorCache) get(cursorID int64) *plugins.CursorCacheEntry {
+	v, err := c.c.Get(strconv.FormatInt(cursorID, 10))
+	if err != nil {
+		// Only possible once the cache is closed; hand out an entry nobody else will see
+		logrus.Errorf("Error getting cursor %d: %v", cursorID, err)
+		return plugins.NewCursorCacheEntry(cursorID)
+	}
+
+	c.lock.Lock()
+	if o, ok := c.open[cursorID]; ok {
+		o.lastUsed = time.Now()
+	}
+	c.lock.Unlock()
+
+	return v.(*plugins.CursorCacheEntry)
+}
+
+// newCursor mints a random cursor ID (as mongod does) for a cursor opened downstream
+func (c *cursorCache) newCursor() *plugins.CursorCacheEntry {
+	for {
+		c.lock.Lock()
+		cursorID := c.rand.Int63()
+		c.lock.Unlock()
+		if cursorID == 0 {
+			continue
+		}
+		// An entry already in use has been handed to a client or mapped downstream
+		entry := c.get(cursorID)
+		if entry.Owner == nil && entry.Downstream == nil {
+			return entry
+		}
+	}
+}
+
+// close removes the cursor from the cache
+func (c *cursorCache) close(cursorID int64) {
+	c.untrack(cursorID)
+	c.c.Remove(strconv.FormatInt(cursorID, 10))
+}
+
+// count returns the number of cursors open for clients
+func (c *cursorCache) count() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.open)
+}
+
+// isOpen returns whether the cursor is open for a client
+func (c *cursorCache) isOpen(cursorID int64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, ok := c.open[cursorID]
+	return ok
+}
+
+// list returns the cursors open for clients ordered by id
+func (c *cursorCache) list() []cursorInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cursors := make([]cursorInfo, 0, len(c.open))
+	for id, o := range c.open {
+		cursors = append(cursors, cursorInfo{
+			ID:        id,
+			NS:        o.ns,
+			Client:    o.cc.GetAddr(),
+			Users:     identityUsers(o.cc),
+			LastUsed:  o.lastUsed.Truncate(time.Millisecond),
+			NoTimeout: o.noTimeout,
+		})
+	}
+	sort.Slice(cursors, func(i, j int) bool { return cursors[i].ID < cursors[j].ID })
+	return cursors
+}
+
+// opened tracks a cursor handed out to cc on the namespace ns. If this puts cc or
+// the proxy over the cursor limits the least recently used cursors are killed.
+func (c *cursorCache) opened(cursorID int64, cc *plugins.ClientConnection, ns string, noTimeout bool) {
+	entry := c.get(cursorID)
+
+	c.lock.Lock()
+	cfg := c.cfg
+	if _, ok := c.open[cursorID]; !ok {
+		c.open[cursorID] = &openCursor{cc: cc, ns: ns, lastUsed: time.Now(), noTimeout: noTimeout}
+		c.perConn[cc]++
+		cursorsOpenGauge.Inc()
+	}
+
+	var evicted []int64
+	if cfg.MaxCursorsPerConnection > 0 {
+		for c.perConn[cc] > cfg.MaxCursorsPerConnection {
+			id := c.leastRecentlyUsed(cc)
+			c.untrackLocked(id)
+			evicted = append(evicted, id)
+			cursorsKilledCounter.WithLabelValues(killMaxCursorsPerConnection).Inc()
+		}
+	}
+	if cfg.MaxCursors > 0 {
+		for len(c.open) > cfg.MaxCursors {
+			id := c.leastRecentlyUsed(nil)
+			c.untrackLocked(id)
+			evicted = append(evicted, id)
+			cursorsKilledCounter.WithLabelValues(killMaxCursors).Inc()
+		}
+	}
+	c.lock.Unlock()
+
+	c.c.SetWithTTL(strconv.FormatInt(cursorID, 10), entry, cfg.CursorTimeout(ns))
+
+	for _, id := range evicted {
+		logrus.Debugf("Killing cursor %d over the cursor limits", id)
+		go c.kill(id)
+	}
+}
+
+// leastRecentlyUsed returns the open cursor (of cc if set) which was used least
+// recently. This must be called with the lock held.
+func (c *cursorCache) leastRecentlyUsed(cc *plugins.ClientConnection) int64 {
+	var (
+		cursorID int64
+		lastUsed time.Time
+	)
+	for id, o := range c.open {
+		if cc != nil && o.cc != cc {
+			continue
+		}
+		if cursorID == 0 || o.lastUsed.Before(lastUsed) {
+			cursorID = id
+			lastUsed = o.lastUsed
+		}
+	}
+	return cursorID
+}
+
+// untrack stops tracking the cursor as open, returning whether it was
+func (c *cursorCache) untrack(cursorID int64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.untrackLocked(cursorID)
+}
+
+func (c *cursorCache) untrackLocked(cursorID int64) bool {
+	o, ok := c.open[cursorID]
+	if !ok {
+		return false
+	}
+	delete(c.open, cursorID)
+	c.perConn[o.cc]--
+	if c.perConn[o.cc] <= 0 {
+		delete(c.perConn, o.cc)
+	}
+	cursorsOpenGauge.Dec()
+	return true
+}
@@ -0,0 +1,122 @@
+package mongoproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestCursorCacheLimits(t *testing.T) {
+	cfg := &config.Config{MaxCursors: 3, MaxCursorsPerConnection: 2}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	killed := make(chan int64, 10)
+	var c *cursorCache
+	c = newCursorCache(cfg, func(cursorID int64) {
+		killed <- cursorID
+		c.close(cursorID)
+	})
+
+	expectKilled := func(cursorID int64) {
+		select {
+		case id := <-killed:
+			if id != cursorID {
+				t.Fatalf("expected cursor %d to be killed, got %d", cursorID, id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("cursor %d was not killed", cursorID)
+		}
+	}
+
+	a := plugins.NewClientConnection()
+	b := plugins.NewClientConnection()
+
+	c.opened(1, a, "test.foo", false)
+	time.Sleep(time.Millisecond)
+	c.opened(2, a, "test.foo", false)
+	time.Sleep(time.Millisecond)
+	// Using 1 makes 2 the least recently used
+	c.get(1)
+	time.Sleep(time.Millisecond)
+
+	// Over the per connection limit
+	c.opened(3, a, "test.foo", false)
+	expectKilled(2)
+	if n := c.count(); n != 2 {
+		t.Fatalf("expected 2 open cursors, got %d", n)
+	}
+
+	// Other connections have their own limit, but share the global one
+	c.opened(4, b, "test.foo", false)
+	time.Sleep(time.Millisecond)
+	c.opened(5, b, "test.foo", false)
+	expectKilled(1)
+	if n := c.count(); n != 3 {
+		t.Fatalf("expected 3 open cursors, got %d", n)
+	}
+
+	// Closed cursors no longer count
+	c.close(3)
+	c.opened(6, a, "test.foo", false)
+	select {
+	case id := <-killed:
+		t.Fatalf("unexpected kill of cursor %d", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCursorCacheTimeouts(t *testing.T) {
+	cfg := &config.Config{CursorTimeouts: []*config.CursorTimeoutConfig{
+		{Namespace: "test", IdleTimeout: "1h"},
+		{Namespace: "test.fast", IdleTimeout: "100ms"},
+	}}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	for ns, expected := range map[string]time.Duration{
+		"test.fast":  100 * time.Millisecond,
+		"test.foo":   time.Hour,
+		"other.fast": cfg.IdleCursorTimeout,
+	} {
+		if timeout := cfg.CursorTimeout(ns); timeout != expected {
+			t.Fatalf("expected timeout %v for %s, got %v", expected, ns, timeout)
+		}
+	}
+
+	killed := make(chan int64, 10)
+	var c *cursorCache
+	c = newCursorCache(cfg, func(cursorID int64) {
+		killed <- cursorID
+		c.close(cursorID)
+	})
+
+	cc := plugins.NewClientConnection()
+	for cursorID, ns := range map[int64]string{1: "test.fast", 2: "test.foo", 3: "test.fast"} {
+		c.get(cursorID).Downstream = &plugins.CursorDownstream{ID: cursorID}
+		// noCursorTimeout cursors never expire
+		c.opened(cursorID, cc, ns, cursorID == 3)
+	}
+
+	select {
+	case id := <-killed:
+		if id != 1 {
+			t.Fatalf("expected cursor 1 to expire, got %d", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cursor did not expire")
+	}
+
+	select {
+	case id := <-killed:
+		t.Fatalf("unexpected expiry of cursor %d", id)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if n := c.count(); n != 2 {
+		t.Fatalf("expected 2 open cursors, got %d", n)
+	}
+}
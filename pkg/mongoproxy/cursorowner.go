@@ -0,0 +1,95 @@
+package mongoproxy
+
+import (
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// checkCursorOwner returns an error doc if the request uses a cursor that was
+// created by a different client (user or session); this matches mongod which only
+// allows the creator of a cursor to iterate or kill it.
+func (p *Proxy) checkCursorOwner(req *plugins.Request) bson.D {
+	if req.CC == nil || req.CC == p.internalCC {
+		return nil
+	}
+
+	switch cmd := req.Command.(type) {
+	case *command.GetMore:
+		entry := p.GetCursor(cmd.CursorID)
+		// If there is no owner then this proxy never handed out the cursor
+		if entry.Owner == nil {
+			p.CloseCursor(cmd.CursorID)
+			return mongoerror.CursorNotFound.ErrMessage("cursor id " + strconv.FormatInt(cmd.CursorID, 10) + " not found")
+		}
+		if !entry.Owner.CoauthorizedWith(req.CC) {
+			return mongoerror.Unauthorized.ErrMessage("cursor id " + strconv.FormatInt(cmd.CursorID, 10) + " was not created by the authenticated user")
+		}
+		if !entry.Owner.SameSession(cmd.GetSession().LSID) {
+			return mongoerror.CursorNotFound.ErrMessage("cursor id " + strconv.FormatInt(cmd.CursorID, 10) + " not found in this session")
+		}
+
+	case *command.KillCursors:
+		for _, v := range cmd.Cursors {
+			cursorID, ok := v.(int64)
+			if !ok {
+				continue
+			}
+			// Cursors without an owner were never handed out; downstream will report them not found
+			entry := p.GetCursor(cursorID)
+			if entry.Owner != nil && !entry.Owner.CoauthorizedWith(req.CC) {
+				return mongoerror.Unauthorized.ErrMessage("not authorized to kill cursor with id " + strconv.FormatInt(cursorID, 10))
+			}
+		}
+	}
+
+	return nil
+}
+
+// recordCursor records a cursor (if any) handed out to the client in the response:
+// its owner, and that it is open for the cursor limits and timeouts
+func (p *Proxy) recordCursor(req *plugins.Request, resp bson.D) {
+	if req.CC == nil || req.CC == p.internalCC {
+		return
+	}
+	switch req.Command.(type) {
+	case *command.GetMore:
+		return
+	case *command.KillCursors:
+		if v, ok := bsonutil.Lookup(resp, "cursorsKilled"); ok {
+			if killed, ok := v.(primitive.A); ok {
+				cursorsKilledCounter.WithLabelValues(killClient).Add(float64(len(killed)))
+			}
+		}
+		return
+	}
+
+	v, ok := bsonutil.Lookup(resp, "cursor", "id")
+	if !ok {
+		return
+	}
+	cursorID, ok := v.(int64)
+	if !ok || cursorID == 0 {
+		return
+	}
+
+	entry := p.GetCursor(cursorID)
+	if entry.Owner != nil {
+		return
+	}
+	entry.Owner = plugins.NewCursorOwner(req.CC, req.Command.GetSession().LSID)
+
+	ns, _ := bsonutil.Lookup(resp, "cursor", "ns")
+	nsStr, _ := ns.(string)
+	noTimeout := false
+	if find, ok := req.Command.(*command.Find); ok {
+		noTimeout = bsonutil.GetBoolDefault(find.NoCursorTimeout, false)
+	}
+	p.cursorCache.opened(cursorID, req.CC, nsStr, noTimeout)
+}
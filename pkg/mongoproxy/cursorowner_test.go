@@ -0,0 +1,98 @@
+package mongoproxy
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestCursorOwner(t *testing.T) {
+	cfg := &config.Config{}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.pipeline.Store(proxy.newPipeline(cfg, []plugins.Plugin{
+		funcPlugin(func(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+			switch r.Command.(type) {
+			case *command.Find:
+				return bson.D{
+					{"cursor", bson.D{{"id", int64(5)}, {"ns", "test.foo"}, {"firstBatch", bson.A{}}}},
+					{"ok", 1},
+				}, nil
+			case *command.GetMore:
+				return bson.D{
+					{"cursor", bson.D{{"id", int64(5)}, {"ns", "test.foo"}, {"nextBatch", bson.A{}}}},
+					{"ok", 1},
+				}, nil
+			default:
+				return bson.D{{"ok", 1}}, nil
+			}
+		}),
+	}))
+
+	lsid := bson.D{{"id", primitive.Binary{Subtype: 4, Data: []byte("0123456789abcdef")}}}
+	otherLSID := bson.D{{"id", primitive.Binary{Subtype: 4, Data: []byte("fedcba9876543210")}}}
+
+	owner := plugins.NewClientConnection()
+	owner.SetIdentities([]plugins.ClientIdentity{plugins.NewStaticIdentity("test", "alice")})
+	other := plugins.NewClientConnection()
+	other.SetIdentities([]plugins.ClientIdentity{plugins.NewStaticIdentity("test", "bob")})
+
+	run := func(cc *plugins.ClientConnection, d bson.D) bson.D {
+		result, err := proxy.HandleMongo(context.Background(), &plugins.Request{CC: cc, CursorCache: proxy}, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	code := func(result bson.D) int {
+		for _, e := range result {
+			if e.Key == "code" {
+				return e.Value.(int)
+			}
+		}
+		return 0
+	}
+
+	// A cursor we never handed out
+	if c := code(run(owner, bson.D{{"getMore", int64(7)}, {"collection", "foo"}, {"$db", "test"}, {"lsid", lsid}})); c != int(mongoerror.CursorNotFound) {
+		t.Fatalf("expected CursorNotFound for unknown cursor, got %d", c)
+	}
+
+	run(owner, bson.D{{"find", "foo"}, {"$db", "test"}, {"lsid", lsid}})
+
+	tests := []struct {
+		name string
+		cc   *plugins.ClientConnection
+		d    bson.D
+		code int
+	}{
+		{"other user getMore", other, bson.D{{"getMore", int64(5)}, {"collection", "foo"}, {"$db", "test"}, {"lsid", lsid}}, int(mongoerror.Unauthorized)},
+		{"other session getMore", owner, bson.D{{"getMore", int64(5)}, {"collection", "foo"}, {"$db", "test"}, {"lsid", otherLSID}}, int(mongoerror.CursorNotFound)},
+		{"no session getMore", owner, bson.D{{"getMore", int64(5)}, {"collection", "foo"}, {"$db", "test"}}, int(mongoerror.CursorNotFound)},
+		{"other user killCursors", other, bson.D{{"killCursors", "foo"}, {"cursors", bson.A{int64(5)}}, {"$db", "test"}}, int(mongoerror.Unauthorized)},
+		{"owner getMore", owner, bson.D{{"getMore", int64(5)}, {"collection", "foo"}, {"$db", "test"}, {"lsid", lsid}}, 0},
+		{"owner killCursors", owner, bson.D{{"killCursors", "foo"}, {"cursors", bson.A{int64(5)}}, {"$db", "test"}, {"lsid", lsid}}, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if c := code(run(test.cc, test.d)); c != test.code {
+				t.Fatalf("expected code %d, got %d", test.code, c)
+			}
+		})
+	}
+}
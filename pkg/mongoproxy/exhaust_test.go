@@ -0,0 +1,97 @@
+package mongoproxy
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongowire"
+)
+
+func TestExhaustOpMsg(t *testing.T) {
+	cfg := &config.Config{}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cursor is exhausted after 3 batches
+	batches := 0
+	proxy.pipeline.Store(proxy.newPipeline(cfg, []plugins.Plugin{
+		funcPlugin(func(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+			getMore, ok := r.Command.(*command.GetMore)
+			if !ok {
+				t.Fatalf("unexpected command: %T", r.Command)
+			}
+			batches++
+			cursorID := getMore.CursorID
+			if batches == 3 {
+				cursorID = 0
+			}
+			return bson.D{
+				{"cursor", bson.D{
+					{"id", cursorID},
+					{"ns", "test.foo"},
+					{"nextBatch", bson.A{bson.D{{"_id", batches}}}},
+				}},
+				{"ok", 1},
+			}, nil
+		}),
+	}))
+
+	b, err := (&mongowire.OP_MSG{
+		Header: mongowire.MessageHeader{RequestID: 42, OpCode: mongowire.OpMsg},
+		Flags:  mongowire.MsgFlagExhaustAllowed,
+		Sections: []mongowire.MSGSection{
+			mongowire.MSGSection_Body{Document: bson.D{
+				{"getMore", int64(3)},
+				{"collection", "foo"},
+				{"$db", "test"},
+			}},
+		},
+	}).ToWire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := mongowire.ReadRequest(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc := plugins.NewClientConnection()
+	c := &conn{p: proxy, cc: cc, unack: newUnackQueue(proxy, cc, cfg.UnacknowledgedWriteQueueSize)}
+	defer c.unack.close()
+	// The cursor was handed out to this client
+	proxy.GetCursor(3).Owner = plugins.NewCursorOwner(cc, nil)
+
+	var replies []*mongowire.OP_MSG
+	if err := proxy.handleOp(context.Background(), c, req, func(r mongowire.WireSerializer) error {
+		replies = append(replies, r.(*mongowire.OP_MSG))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(replies) != 3 {
+		t.Fatalf("expected 3 replies, got %d", len(replies))
+	}
+	responseTo := int32(42)
+	for i, reply := range replies {
+		if reply.Header.ResponseTo != responseTo {
+			t.Fatalf("reply %d: expected responseTo %d, got %d", i, responseTo, reply.Header.ResponseTo)
+		}
+		if moreToCome := i < len(replies)-1; reply.Flags.MoreToCome() != moreToCome {
+			t.Fatalf("reply %d: expected moreToCome=%v", i, moreToCome)
+		}
+		responseTo = reply.Header.RequestID
+	}
+}
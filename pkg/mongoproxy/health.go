@@ -0,0 +1,104 @@
+package mongoproxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// healthCheckTimeout bounds how long a single health check may take
+var healthCheckTimeout = 5 * time.Second
+
+// healthCheck is the outcome of one of the checks of /livez or /readyz
+type healthCheck struct {
+	Name  string `bson:"name"`
+	OK    bool   `bson:"ok"`
+	Error string `bson:"error,omitempty"`
+}
+
+func newHealthCheck(name string, err error) healthCheck {
+	if err != nil {
+		return healthCheck{Name: name, Error: err.Error()}
+	}
+	return healthCheck{Name: name, OK: true}
+}
+
+// RegisterHealthHandlers registers the liveness (/livez) and readiness (/readyz)
+// checks on mux. ready reports whether the proxy should receive traffic at all (e.g.
+// false once it is shutting down); on top of that the proxy is only ready if all the
+// plugins implementing plugins.HealthChecker are healthy.
+func (p *Proxy) RegisterHealthHandlers(mux *http.ServeMux, ready func() bool) {
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, p.liveness())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, p.readiness(r.Context(), ready()))
+	})
+}
+
+// liveness checks that the proxy can still handle requests. This doesn't depend on the
+// downstream as restarting the proxy wouldn't fix it.
+func (p *Proxy) liveness() []healthCheck {
+	pl, err := p.acquirePipeline()
+	if err == nil {
+		pl.release()
+	}
+	return []healthCheck{newHealthCheck("pipeline", err)}
+}
+
+// readiness runs the health checks of the plugins (concurrently)
+func (p *Proxy) readiness(ctx context.Context, ready bool) []healthCheck {
+	checks := []healthCheck{{Name: "serving", OK: ready}}
+	if !ready {
+		checks[0].Error = "not serving"
+	}
+
+	pl, err := p.acquirePipeline()
+	if err != nil {
+		return append(checks, newHealthCheck("pipeline", err))
+	}
+	defer pl.release()
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	results := make([]healthCheck, len(pl.plugins))
+	for i, plugin := range pl.plugins {
+		checker, ok := plugin.(plugins.HealthChecker)
+		if !ok {
+			continue
+		}
+		results[i].Name = plugin.Name()
+		wg.Add(1)
+		go func(i int, checker plugins.HealthChecker) {
+			defer wg.Done()
+			results[i] = newHealthCheck(results[i].Name, checker.HealthCheck(ctx))
+		}(i, checker)
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		if result.Name != "" {
+			checks = append(checks, result)
+		}
+	}
+	return checks
+}
+
+// writeHealth writes the outcome of the checks; the status is 503 if any failed
+func writeHealth(w http.ResponseWriter, checks []healthCheck) {
+	status, code := "ok", http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			status, code = "failed", http.StatusServiceUnavailable
+			break
+		}
+	}
+	writeAdminJSON(w, bson.D{{"status", status}, {"checks", checks}}, code)
+}
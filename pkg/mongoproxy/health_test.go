@@ -0,0 +1,65 @@
+package mongoproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+type healthPlugin struct {
+	funcPlugin
+	err error
+}
+
+func (h *healthPlugin) Name() string                          { return "health" }
+func (h *healthPlugin) HealthCheck(ctx context.Context) error { return h.err }
+
+func TestHealth(t *testing.T) {
+	cfg := &config.Config{}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	health := &healthPlugin{}
+	proxy.pipeline.Store(proxy.newPipeline(cfg, []plugins.Plugin{health}))
+
+	ready := true
+	mux := http.NewServeMux()
+	proxy.RegisterHealthHandlers(mux, func() bool { return ready })
+
+	check := func(path string, expectedStatus int, expectedBody string) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != expectedStatus || !strings.Contains(w.Body.String(), expectedBody) {
+			t.Fatalf("%s: unexpected response %d: %s", path, w.Code, w.Body.String())
+		}
+	}
+
+	check("/livez", http.StatusOK, `"status":"ok"`)
+	check("/readyz", http.StatusOK, `{"name":"health","ok":true}`)
+
+	// An unhealthy plugin only affects readiness
+	health.err = errors.New("no reachable server")
+	check("/livez", http.StatusOK, `"status":"ok"`)
+	check("/readyz", http.StatusServiceUnavailable, `{"name":"health","ok":false,"error":"no reachable server"}`)
+
+	health.err = nil
+	ready = false
+	check("/readyz", http.StatusServiceUnavailable, `{"name":"serving","ok":false,"error":"not serving"}`)
+
+	// Once shut down the proxy isn't live either
+	if err := proxy.Shutdown(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	check("/livez", http.StatusServiceUnavailable, `"status":"failed"`)
+}
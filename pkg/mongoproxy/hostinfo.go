@@ -0,0 +1,142 @@
+package mongoproxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// hostname returns the hostname of the host the proxy is running on
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return h
+}
+
+// hostInfo returns the hostInfo response for the host the proxy is running on. Most
+// of this comes from /proc so some fields are missing on other platforms.
+func hostInfo() bson.D {
+	system := bson.D{
+		{"currentTime", time.Now().Truncate(time.Millisecond)},
+		{"hostname", hostname()},
+		{"cpuAddrSize", strconv.IntSize},
+	}
+	if memSize, ok := memTotalBytes(); ok {
+		memSizeMB := memSize / 1024 / 1024
+		system = append(system, bson.E{"memSizeMB", memSizeMB})
+
+		memLimitMB := memSizeMB
+		if limit, ok := memLimitBytes(); ok && limit/1024/1024 < memSizeMB {
+			memLimitMB = limit / 1024 / 1024
+		}
+		system = append(system, bson.E{"memLimitMB", memLimitMB})
+	}
+	system = append(system,
+		bson.E{"numCores", runtime.NumCPU()},
+		bson.E{"cpuArch", runtime.GOARCH},
+		bson.E{"numaEnabled", false},
+	)
+
+	osInfo := bson.D{
+		{"type", strings.Title(runtime.GOOS)},
+		{"name", osName()},
+	}
+	if v, ok := readTrimmed("/proc/sys/kernel/osrelease"); ok {
+		osInfo = append(osInfo, bson.E{"version", v})
+	}
+
+	extra := bson.D{}
+	if v, ok := readTrimmed("/proc/version"); ok {
+		extra = append(extra, bson.E{"versionString", v})
+	}
+	if v, ok := readTrimmed("/proc/sys/kernel/osrelease"); ok {
+		extra = append(extra, bson.E{"kernelVersion", v})
+	}
+	extra = append(extra,
+		bson.E{"goVersion", runtime.Version()},
+		bson.E{"pageSize", int64(os.Getpagesize())},
+	)
+
+	return bson.D{
+		{"system", system},
+		{"os", osInfo},
+		{"extra", extra},
+		{"ok", 1},
+	}
+}
+
+func readTrimmed(path string) (string, bool) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(b)), true
+}
+
+// osName returns the name of the OS distribution (e.g. "Ubuntu 20.04.1 LTS")
+func osName() string {
+	f, err := os.Open("/etc/os-release")
+	if err != nil {
+		return runtime.GOOS
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v := strings.TrimPrefix(scanner.Text(), "PRETTY_NAME="); v != scanner.Text() {
+			return strings.Trim(v, `"`)
+		}
+	}
+	return runtime.GOOS
+}
+
+// memTotalBytes returns the total memory of the host
+func memTotalBytes() (int64, bool) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// MemTotal:       16303428 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			return kb * 1024, true
+		}
+	}
+	return 0, false
+}
+
+// memLimitBytes returns the memory limit of our cgroup (if there is one)
+func memLimitBytes() (int64, bool) {
+	for _, path := range []string{
+		"/sys/fs/cgroup/memory.max",                   // cgroup v2
+		"/sys/fs/cgroup/memory/memory.limit_in_bytes", // cgroup v1
+	} {
+		v, ok := readTrimmed(path)
+		if !ok {
+			continue
+		}
+		limit, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			// "max" means no limit
+			return 0, false
+		}
+		return limit, true
+	}
+	return 0, false
+}
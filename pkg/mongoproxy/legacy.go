@@ -0,0 +1,157 @@
+package mongoproxy
+
+import (
+	"context"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongowire"
+)
+
+// The legacy write opcodes (OP_INSERT, OP_UPDATE and OP_DELETE) have no reply; clients
+// that want to know the outcome follow them with getLastError on the same connection.
+// We translate them into the equivalent write commands so they run through the
+// plugins like any other write, and keep the result on the connection for
+// getLastError.
+
+func (p *Proxy) handleOpInsert(cc *plugins.ClientConnection, m *mongowire.OP_INSERT) {
+	docs := make(primitive.A, len(m.Documents))
+	for i, doc := range m.Documents {
+		docs[i] = doc
+	}
+	p.handleLegacyWrite(cc, "insert", m.FullCollectionName, bson.D{
+		{"documents", docs},
+		{"ordered", !m.Flags.ContinueOnError()},
+	})
+}
+
+func (p *Proxy) handleOpUpdate(cc *plugins.ClientConnection, m *mongowire.OP_UPDATE) {
+	p.handleLegacyWrite(cc, "update", m.FullCollectionName, bson.D{
+		{"updates", primitive.A{bson.D{
+			{"q", m.Selector},
+			{"u", m.Update},
+			{"upsert", m.Flags.Upsert()},
+			{"multi", m.Flags.MultiUpdate()},
+		}}},
+	})
+}
+
+func (p *Proxy) handleOpDelete(cc *plugins.ClientConnection, m *mongowire.OP_DELETE) {
+	limit := 0
+	if m.Flags.SingleRemove() {
+		limit = 1
+	}
+	p.handleLegacyWrite(cc, "delete", m.FullCollectionName, bson.D{
+		{"deletes", primitive.A{bson.D{
+			{"q", m.Selector},
+			{"limit", limit},
+		}}},
+	})
+}
+
+// handleLegacyWrite runs the write command (name) on the namespace with the given
+// arguments and records the outcome as the connection's last error
+func (p *Proxy) handleLegacyWrite(cc *plugins.ClientConnection, name, ns string, args bson.D) {
+	names := strings.SplitN(ns, ".", 2)
+	if len(names) != 2 || names[0] == "" || names[1] == "" {
+		cc.LastError = legacyLastError(name, mongoerror.InvalidNamespace.ErrMessage("Invalid namespace specified '"+ns+"'"))
+		return
+	}
+
+	cmd := append(bson.D{{name, names[1]}}, args...)
+	cmd = append(cmd, bson.E{"$db", names[0]})
+
+	// The client doesn't wait for the write, so it must be run even if the client
+	// goes away; we don't use the connection's context for it
+	result, err := p.HandleMongo(context.Background(), &plugins.Request{CC: cc, CursorCache: p}, cmd)
+	if err != nil {
+		logrus.Errorf("Error handling legacy %s: %v", name, err)
+		result = mongoerror.InternalError.ErrMessage(err.Error())
+	}
+	cc.LastError = legacyLastError(name, result)
+}
+
+// legacyLastError converts the result of a write command into the getLastError
+// response for the legacy write it was translated from
+func legacyLastError(name string, result bson.D) bson.D {
+	ret := bson.D{}
+
+	// Inserts don't report n
+	var n int64
+	if name != "insert" {
+		v, _ := bsonutil.Lookup(result, "n")
+		n = toInt64(v)
+	}
+	ret = append(ret, bson.E{"n", n})
+
+	var errmsg, code interface{}
+	if !bsonutil.Ok(result) {
+		errmsg, _ = bsonutil.Lookup(result, "errmsg")
+		code, _ = bsonutil.Lookup(result, "code")
+	} else if v, ok := bsonutil.Lookup(result, "writeErrors"); ok {
+		// Legacy writes report the last error
+		if writeErrors, ok := v.(primitive.A); ok && len(writeErrors) > 0 {
+			if writeError, ok := writeErrors[len(writeErrors)-1].(bson.D); ok {
+				errmsg, _ = bsonutil.Lookup(writeError, "errmsg")
+				code, _ = bsonutil.Lookup(writeError, "code")
+			}
+		}
+	} else if v, ok := bsonutil.Lookup(result, "writeConcernError"); ok {
+		if wce, ok := v.(bson.D); ok {
+			errmsg, _ = bsonutil.Lookup(wce, "errmsg")
+			code, _ = bsonutil.Lookup(wce, "code")
+			if toInt64(code) == int64(mongoerror.WriteConcernFailed) {
+				ret = append(ret, bson.E{"wtimeout", true})
+			}
+		}
+	}
+
+	if name == "update" && errmsg == nil {
+		upserted, hasUpserted := bsonutil.Lookup(result, "upserted")
+		if hasUpserted {
+			if ups, ok := upserted.(primitive.A); ok && len(ups) > 0 {
+				if up, ok := ups[0].(bson.D); ok {
+					id, _ := bsonutil.Lookup(up, "_id")
+					ret = append(ret, bson.E{"upserted", id})
+				}
+			}
+		}
+		ret = append(ret, bson.E{"updatedExisting", n > 0 && !hasUpserted})
+	}
+
+	ret = append(ret, bson.E{"err", errmsg})
+	if code != nil {
+		ret = append(ret, bson.E{"code", code})
+	}
+	return append(ret, bson.E{"ok", 1})
+}
+
+// getLastError returns the outcome of the last legacy write of the client. The write
+// concern of getLastError can't be applied after the fact; the writes were sent with
+// the default write concern.
+func (p *Proxy) getLastError(cc *plugins.ClientConnection) bson.D {
+	if cc == nil || cc.LastError == nil {
+		return bson.D{{"n", int64(0)}, {"err", nil}, {"ok", 1}}
+	}
+	return cc.LastError
+}
+
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
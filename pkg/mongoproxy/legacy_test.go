@@ -0,0 +1,112 @@
+package mongoproxy
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongowire"
+)
+
+func TestLegacyWrites(t *testing.T) {
+	cfg := &config.Config{}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received command.Command
+	proxy.pipeline.Store(proxy.newPipeline(cfg, []plugins.Plugin{
+		funcPlugin(func(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+			switch cmd := r.Command.(type) {
+			case *command.Insert:
+				received = cmd
+				return bson.D{
+					{"n", int32(1)},
+					{"writeErrors", primitive.A{bson.D{{"index", int32(1)}, {"code", int32(11000)}, {"errmsg", "E11000 duplicate key error"}}}},
+					{"ok", 1},
+				}, nil
+			case *command.Update:
+				received = cmd
+				return bson.D{
+					{"n", int32(1)},
+					{"nModified", int32(0)},
+					{"upserted", primitive.A{bson.D{{"index", int32(0)}, {"_id", "a"}}}},
+					{"ok", 1},
+				}, nil
+			case *command.Delete:
+				received = cmd
+				return bson.D{{"n", int32(2)}, {"ok", 1}}, nil
+			}
+			return next(ctx, r)
+		}),
+	}))
+
+	cc := plugins.NewClientConnection()
+	getLastError := func() bson.D {
+		result, err := proxy.HandleMongo(context.Background(), &plugins.Request{CC: cc, CursorCache: proxy}, bson.D{{"getLastError", 1}, {"$db", "test"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// Nothing written yet
+	if result := getLastError(); !reflect.DeepEqual(result, bson.D{{"n", int64(0)}, {"err", nil}, {"ok", 1}}) {
+		t.Fatalf("unexpected getLastError before any write: %v", result)
+	}
+
+	proxy.handleOpInsert(cc, &mongowire.OP_INSERT{
+		Flags:              1, // ContinueOnError
+		FullCollectionName: "test.foo.bar",
+		Documents:          []bson.D{{{"_id", 1}}, {{"_id", 1}}},
+	})
+	insert, ok := received.(*command.Insert)
+	if !ok || insert.Collection != "foo.bar" || insert.Database != "test" || len(insert.Documents) != 2 || insert.Ordered == nil || *insert.Ordered {
+		t.Fatalf("unexpected insert: %+v", received)
+	}
+	if result := getLastError(); !reflect.DeepEqual(result, bson.D{{"n", int64(0)}, {"err", "E11000 duplicate key error"}, {"code", int32(11000)}, {"ok", 1}}) {
+		t.Fatalf("unexpected getLastError after insert: %v", result)
+	}
+
+	proxy.handleOpUpdate(cc, &mongowire.OP_UPDATE{
+		FullCollectionName: "test.foo",
+		Flags:              1, // Upsert
+		Selector:           bson.D{{"_id", "a"}},
+		Update:             bson.D{{"$set", bson.D{{"x", 1}}}},
+	})
+	if _, ok := received.(*command.Update); !ok {
+		t.Fatalf("unexpected update: %+v", received)
+	}
+	if result := getLastError(); !reflect.DeepEqual(result, bson.D{{"n", int64(1)}, {"upserted", "a"}, {"updatedExisting", false}, {"err", nil}, {"ok", 1}}) {
+		t.Fatalf("unexpected getLastError after update: %v", result)
+	}
+
+	proxy.handleOpDelete(cc, &mongowire.OP_DELETE{FullCollectionName: "test.foo", Selector: bson.D{{"x", 1}}})
+	if _, ok := received.(*command.Delete); !ok {
+		t.Fatalf("unexpected delete: %+v", received)
+	}
+	if result := getLastError(); !reflect.DeepEqual(result, bson.D{{"n", int64(2)}, {"err", nil}, {"ok", 1}}) {
+		t.Fatalf("unexpected getLastError after delete: %v", result)
+	}
+
+	// An invalid namespace never reaches the plugins
+	received = nil
+	proxy.handleOpDelete(cc, &mongowire.OP_DELETE{FullCollectionName: "foo", Selector: bson.D{}})
+	if received != nil {
+		t.Fatalf("unexpected command for invalid namespace: %+v", received)
+	}
+	if errmsg, _ := getLastError()[1].Value.(string); errmsg == "" {
+		t.Fatal("expected an error for an invalid namespace")
+	}
+}
@@ -0,0 +1,81 @@
+package mongoproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+)
+
+// Listen opens the client listener described by cfg, wrapping it with PROXY
+// protocol and TLS if configured. Closing the listener stops any TLS certificate
+// reloading.
+func Listen(cfg *config.ListenerConfig) (net.Listener, error) {
+	if cfg.Network == "unix" {
+		if err := removeStaleSocket(cfg.Addr); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen(cfg.Network, cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Network == "unix" && cfg.SocketFileMode != 0 {
+		if err := os.Chmod(cfg.Addr, cfg.SocketFileMode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	// The PROXY protocol header comes before the TLS handshake
+	if cfg.ProxyProtocol != nil {
+		l = &proxyProtocolListener{Listener: l, cfg: cfg.ProxyProtocol}
+	}
+
+	if cfg.TLS != nil {
+		tlsListener, certReloader, err := NewTLSListener(l, cfg.TLS)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		return &tlsReloadListener{Listener: tlsListener, r: certReloader}, nil
+	}
+
+	return l, nil
+}
+
+// removeStaleSocket removes a unix socket left behind by a previous process. If
+// something is still listening on the socket we leave it alone.
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+
+	return os.Remove(path)
+}
+
+// tlsReloadListener is a TLS listener which stops its CertReloader on Close
+type tlsReloadListener struct {
+	net.Listener
+	r *CertReloader
+}
+
+func (l *tlsReloadListener) Close() error {
+	l.r.Close()
+	return l.Listener.Close()
+}
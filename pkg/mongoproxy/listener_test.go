@@ -0,0 +1,103 @@
+package mongoproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongowire"
+)
+
+func TestListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "mongoproxy.sock")
+
+	socketMode := "0600"
+	cfg := &config.Config{
+		Listeners: []*config.ListenerConfig{
+			{Addr: "localhost:0"},
+			{
+				Name:       "local",
+				Network:    "unix",
+				Addr:       sock,
+				SocketMode: &socketMode,
+				// The unix listener filters "ping"
+				Plugins: []config.PluginConfig{{
+					Name:   "filtercommand",
+					Config: bson.D{{"filterCommands", bson.A{"ping"}}},
+				}},
+			},
+		},
+	}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lc := range cfg.GetListeners() {
+		l, err := Listen(lc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy.AddListener(lc.Name, l)
+	}
+	go proxy.Serve()
+	defer proxy.Shutdown(context.TODO())
+
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected socket mode: %v %v", fi, err)
+	}
+
+	ping := func(network, addr string) bool {
+		c, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		req := &mongowire.OP_MSG{
+			Header: mongowire.MessageHeader{RequestID: 1, OpCode: mongowire.OpMsg},
+			Sections: []mongowire.MSGSection{
+				mongowire.MSGSection_Body{Document: bson.D{{"ping", 1}, {"$db", "admin"}}},
+			},
+		}
+		if err := req.WriteTo(c); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := mongowire.ReadRequest(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := reply.GetOpMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bsonutil.Ok(m.Sections[0].(mongowire.MSGSection_Body).Document)
+	}
+
+	if !ping("tcp", proxy.Addr()) {
+		t.Fatalf("ping failed on tcp listener")
+	}
+	if ping("unix", sock) {
+		t.Fatalf("ping not filtered on unix listener")
+	}
+
+	// A socket in use must not be replaced
+	if _, err := Listen(cfg.Listeners[1]); err == nil {
+		t.Fatalf("expected error listening on a socket in use")
+	}
+}
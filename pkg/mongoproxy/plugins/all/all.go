@@ -1,6 +1,7 @@
 package all
 
 import (
+	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/authn"
 	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/authz"
 	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/dedupe"
 	_ "github.com/wish/mongoproxy/pkg/mongoproxy/plugins/defaults"
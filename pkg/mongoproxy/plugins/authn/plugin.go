@@ -0,0 +1,175 @@
+package authn
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var (
+	authnTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_authn_total",
+		Help: "The total number of authentication attempts",
+	}, []string{"mechanism", "success"})
+)
+
+type contextKey string
+
+func (c contextKey) String() string {
+	return "authn context key " + string(c)
+}
+
+var (
+	contextKeyConversation = contextKey("authn.conversation")
+)
+
+const Name = "authn"
+
+func init() {
+	plugins.Register(func() plugins.Plugin {
+		return &AuthnPlugin{}
+	})
+}
+
+type AuthnPluginConfig struct {
+	// Users is the local user store clients can authenticate against
+	Users []UserConfig `bson:"users"`
+	// X509 configures mapping client certificates to identities for MONGODB-X509
+	X509 *X509Config `bson:"x509"`
+}
+
+// UserConfig is a single user in the local user store. The credentials are in
+// the same format as the `credentials` field of mongod's admin.system.users
+type UserConfig struct {
+	User        string            `bson:"user"`
+	DB          string            `bson:"db"`
+	Roles       []string          `bson:"roles"`
+	Credentials CredentialsConfig `bson:"credentials"`
+}
+
+type CredentialsConfig struct {
+	SCRAMSHA1   *ScramCredentialConfig `bson:"SCRAM-SHA-1,omitempty"`
+	SCRAMSHA256 *ScramCredentialConfig `bson:"SCRAM-SHA-256,omitempty"`
+}
+
+// ScramCredentialConfig is a hashed SCRAM credential; salt, storedKey and serverKey are base64 encoded
+type ScramCredentialConfig struct {
+	IterationCount int    `bson:"iterationCount"`
+	Salt           string `bson:"salt"`
+	StoredKey      string `bson:"storedKey"`
+	ServerKey      string `bson:"serverKey"`
+}
+
+// This is a plugin that handles authenticating clients at the proxy
+type AuthnPlugin struct {
+	conf AuthnPluginConfig
+
+	users     map[string]*user // db.user -> user
+	x509Rules []*x509Rule
+}
+
+func (p *AuthnPlugin) Name() string { return Name }
+
+// Configure configures this plugin with the given configuration object. Returns
+// an error if the configuration is invalid for the plugin.
+func (p *AuthnPlugin) Configure(d bson.D) error {
+	// Load config
+	dec, err := bson.NewDecoder(bsonutil.NewStrictValueReader(d))
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&p.conf); err != nil {
+		return err
+	}
+
+	p.users = make(map[string]*user, len(p.conf.Users))
+	for _, userConf := range p.conf.Users {
+		u, err := newUser(userConf)
+		if err != nil {
+			return err
+		}
+		if _, ok := p.users[u.key()]; ok {
+			return fmt.Errorf("duplicate user %s", u.key())
+		}
+		p.users[u.key()] = u
+	}
+
+	if p.conf.X509 != nil {
+		p.x509Rules = make([]*x509Rule, len(p.conf.X509.Rules))
+		for i, ruleConf := range p.conf.X509.Rules {
+			rule, err := newX509Rule(ruleConf)
+			if err != nil {
+				return err
+			}
+			p.x509Rules[i] = rule
+		}
+	}
+
+	return nil
+}
+
+func (p *AuthnPlugin) lookupUser(db, username string) (*user, bool) {
+	u, ok := p.users[db+"."+username]
+	return u, ok
+}
+
+// Process is the function executed when a message is called in the pipeline.
+func (p *AuthnPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	switch cmd := r.Command.(type) {
+	case *command.IsMaster:
+		result, err := next(ctx, r)
+		if err != nil {
+			return result, err
+		}
+		return p.saslSupportedMechs(result, cmd.SaslSupportedMechs), nil
+
+	case *command.Hello:
+		result, err := next(ctx, r)
+		if err != nil {
+			return result, err
+		}
+		return p.saslSupportedMechs(result, cmd.SaslSupportedMechs), nil
+
+	case *command.SaslStart:
+		return p.saslStart(r, cmd), nil
+
+	case *command.SaslContinue:
+		return p.saslContinue(r, cmd), nil
+
+	case *command.Authenticate:
+		return p.authenticate(r, cmd), nil
+	}
+
+	return next(ctx, r)
+}
+
+// saslSupportedMechs adds the mechanisms supported by the user (sent as "<db>.<user>")
+// to a hello/isMaster result
+func (p *AuthnPlugin) saslSupportedMechs(result bson.D, dbUser string) bson.D {
+	if dbUser == "" {
+		return result
+	}
+
+	parts := strings.SplitN(dbUser, ".", 2)
+	if len(parts) != 2 {
+		return result
+	}
+	if u, ok := p.lookupUser(parts[0], parts[1]); ok {
+		mechs := make(primitive.A, 0, len(u.mechanisms()))
+		for _, m := range u.mechanisms() {
+			mechs = append(mechs, m)
+		}
+		result = append(result, bson.E{"saslSupportedMechs", mechs})
+	}
+	return result
+}
@@ -0,0 +1,253 @@
+package authn
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"net/url"
+	"testing"
+
+	"github.com/xdg-go/scram"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func scramCredentialConfig(t *testing.T, hashGen scram.HashGeneratorFcn, username, password string) bson.D {
+	client, err := hashGen.NewClient(username, password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred := client.GetStoredCredentials(scram.KeyFactors{Salt: "saltsaltsalt", Iters: 4096})
+	return bson.D{
+		{"iterationCount", int32(cred.Iters)},
+		{"salt", base64.StdEncoding.EncodeToString([]byte(cred.Salt))},
+		{"storedKey", base64.StdEncoding.EncodeToString(cred.StoredKey)},
+		{"serverKey", base64.StdEncoding.EncodeToString(cred.ServerKey)},
+	}
+}
+
+func TestScram(t *testing.T) {
+	d := &AuthnPlugin{}
+	if err := d.Configure(bson.D{
+		{"users", primitive.A{
+			bson.D{
+				{"user", "app"},
+				{"db", "admin"},
+				{"roles", primitive.A{"reader"}},
+				{"credentials", bson.D{
+					{"SCRAM-SHA-1", scramCredentialConfig(t, scram.SHA1, "app", "secret")},
+					{"SCRAM-SHA-256", scramCredentialConfig(t, scram.SHA256, "app", "secret")},
+				}},
+			},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	p := plugins.BuildPipeline([]plugins.Plugin{d}, func(_ context.Context, r *plugins.Request) (bson.D, error) {
+		return bson.D{{"ok", 1}}, nil
+	})
+
+	tests := []struct {
+		mechanism         string
+		hashGen           scram.HashGeneratorFcn
+		password          string
+		skipEmptyExchange bool
+		ok                bool
+	}{
+		{ScramSHA256, scram.SHA256, "secret", true, true},
+		{ScramSHA256, scram.SHA256, "secret", false, true},
+		{ScramSHA1, scram.SHA1, "secret", true, true},
+		{ScramSHA256, scram.SHA256, "wrong", true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mechanism, func(t *testing.T) {
+			cc := plugins.NewClientConnection()
+
+			client, err := test.hashGen.NewClient("app", test.password, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conv := client.NewConversation()
+
+			payload, err := conv.Step("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := p(context.TODO(), &plugins.Request{
+				CC:          cc,
+				CommandName: "saslStart",
+				Command: &command.SaslStart{
+					SaslStart: 1,
+					Mechanism: test.mechanism,
+					Payload:   []byte(payload),
+					Options:   &command.SaslOptions{SkipEmptyExchange: test.skipEmptyExchange},
+					Common:    command.Common{Database: "admin"},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for {
+				if !bsonutil.Ok(result) {
+					break
+				}
+				done, _ := bsonutil.Lookup(result, "done")
+				if done.(bool) {
+					break
+				}
+				serverPayload, _ := bsonutil.Lookup(result, "payload")
+				payload, err := conv.Step(string(serverPayload.(primitive.Binary).Data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				result, err = p(context.TODO(), &plugins.Request{
+					CC:          cc,
+					CommandName: "saslContinue",
+					Command: &command.SaslContinue{
+						SaslContinue:   1,
+						ConversationID: 1,
+						Payload:        []byte(payload),
+					},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if bsonutil.Ok(result) != test.ok {
+				t.Fatalf("mismatch in auth result expected=%v actual=%v", test.ok, result)
+			}
+
+			if test.ok {
+				if len(cc.Identities()) != 1 || plugins.IdentityName(cc.Identities()[0]) != "app@admin" || cc.Identities()[0].Roles()[0] != "reader" {
+					t.Fatalf("identity not set: %v", cc.Identities())
+				}
+			} else if len(cc.Identities()) != 0 {
+				t.Fatalf("identity set on failed auth: %v", cc.Identities())
+			}
+		})
+	}
+}
+
+func TestX509(t *testing.T) {
+	d := &AuthnPlugin{}
+	if err := d.Configure(bson.D{
+		{"x509", bson.D{
+			{"rules", primitive.A{
+				bson.D{
+					{"subject", "^CN=([^,]+),OU=services,O=Example$"},
+					{"user", "service-$1"},
+					{"roles", primitive.A{"readWrite"}},
+				},
+				bson.D{
+					{"san", "^spiffe://example.com/admin$"},
+					{"user", "admin"},
+					{"roles", primitive.A{"root"}},
+				},
+			}},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	p := plugins.BuildPipeline([]plugins.Plugin{d}, func(_ context.Context, r *plugins.Request) (bson.D, error) {
+		return bson.D{{"ok", 1}}, nil
+	})
+
+	adminURI, _ := url.Parse("spiffe://example.com/admin")
+
+	tests := []struct {
+		name     string
+		cert     *x509.Certificate
+		db       string
+		user     string
+		ok       bool
+		identity string
+	}{
+		{
+			name:     "subject",
+			cert:     &x509.Certificate{Subject: pkix.Name{CommonName: "api", OrganizationalUnit: []string{"services"}, Organization: []string{"Example"}}},
+			db:       "$external",
+			ok:       true,
+			identity: "service-api",
+		},
+		{
+			name:     "subject_user",
+			cert:     &x509.Certificate{Subject: pkix.Name{CommonName: "api", OrganizationalUnit: []string{"services"}, Organization: []string{"Example"}}},
+			db:       "$external",
+			user:     "CN=api,OU=services,O=Example",
+			ok:       true,
+			identity: "service-api",
+		},
+		{
+			name:     "san",
+			cert:     &x509.Certificate{Subject: pkix.Name{CommonName: "someone"}, URIs: []*url.URL{adminURI}},
+			db:       "$external",
+			ok:       true,
+			identity: "admin",
+		},
+		{
+			name: "user_mismatch",
+			cert: &x509.Certificate{Subject: pkix.Name{CommonName: "api", OrganizationalUnit: []string{"services"}, Organization: []string{"Example"}}},
+			db:   "$external",
+			user: "other",
+		},
+		{
+			name: "no_match",
+			cert: &x509.Certificate{Subject: pkix.Name{CommonName: "someone"}},
+			db:   "$external",
+		},
+		{
+			name: "wrong_db",
+			cert: &x509.Certificate{Subject: pkix.Name{CommonName: "api", OrganizationalUnit: []string{"services"}, Organization: []string{"Example"}}},
+			db:   "admin",
+		},
+		{
+			name: "no_cert",
+			db:   "$external",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cc := plugins.NewClientConnection()
+			if test.cert != nil {
+				cc.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{test.cert}}}
+			}
+
+			result, err := p(context.TODO(), &plugins.Request{
+				CC: cc,
+				Command: &command.Authenticate{
+					Authenticate: 1,
+					Mechanism:    MongoDBX509,
+					User:         test.user,
+					Common:       command.Common{Database: test.db},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if bsonutil.Ok(result) != test.ok {
+				t.Fatalf("mismatch in auth result expected=%v actual=%v", test.ok, result)
+			}
+
+			if test.ok {
+				if len(cc.Identities()) != 1 || plugins.IdentityName(cc.Identities()[0]) != test.identity+"@$external" {
+					t.Fatalf("unexpected identities: %v", cc.Identities())
+				}
+			} else if len(cc.Identities()) != 0 {
+				t.Fatalf("unexpected identities: %v", cc.Identities())
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package authn
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xdg-go/scram"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const (
+	ScramSHA1   = "SCRAM-SHA-1"
+	ScramSHA256 = "SCRAM-SHA-256"
+)
+
+var scramHashes = map[string]scram.HashGeneratorFcn{
+	ScramSHA1:   scram.SHA1,
+	ScramSHA256: scram.SHA256,
+}
+
+// scramConversation is the state of an in-progress saslStart/saslContinue exchange.
+// mongod only allows a single conversation per connection, so we do the same.
+type scramConversation struct {
+	id                int
+	mechanism         string
+	db                string
+	skipEmptyExchange bool
+
+	conv *scram.ServerConversation
+	user *user
+}
+
+func authenticationFailed() bson.D {
+	return mongoerror.AuthenticationFailed.ErrMessage("Authentication failed.")
+}
+
+func (p *AuthnPlugin) saslStart(r *plugins.Request, cmd *command.SaslStart) bson.D {
+	// Any new saslStart replaces an in-progress conversation
+	delete(r.CC.Map, contextKeyConversation)
+
+	hashGen, ok := scramHashes[cmd.Mechanism]
+	if !ok {
+		authnTotal.WithLabelValues(cmd.Mechanism, "false").Inc()
+		return mongoerror.BadValue.ErrMessage("Received authentication for mechanism " + cmd.Mechanism + " which is not enabled")
+	}
+
+	db := cmd.Database
+	if db == "" {
+		db = "admin"
+	}
+
+	c := &scramConversation{
+		id:        1,
+		mechanism: cmd.Mechanism,
+		db:        db,
+	}
+	if cmd.Options != nil {
+		c.skipEmptyExchange = cmd.Options.SkipEmptyExchange
+	}
+
+	server, err := hashGen.NewServer(func(username string) (scram.StoredCredentials, error) {
+		u, ok := p.lookupUser(db, username)
+		if !ok {
+			return scram.StoredCredentials{}, fmt.Errorf("unknown user %s.%s", db, username)
+		}
+		cred, ok := u.scram[c.mechanism]
+		if !ok {
+			return scram.StoredCredentials{}, fmt.Errorf("user %s has no %s credentials", u.key(), c.mechanism)
+		}
+		c.user = u
+		return cred, nil
+	})
+	if err != nil {
+		logrus.Errorf("Error creating scram server: %v", err)
+		return authenticationFailed()
+	}
+	c.conv = server.NewConversation()
+
+	response, err := c.conv.Step(string(cmd.Payload))
+	if err != nil {
+		logrus.Debugf("saslStart failed: %v", err)
+		authnTotal.WithLabelValues(c.mechanism, "false").Inc()
+		return authenticationFailed()
+	}
+
+	r.CC.Map[contextKeyConversation] = c
+
+	return c.reply(response, false)
+}
+
+func (p *AuthnPlugin) saslContinue(r *plugins.Request, cmd *command.SaslContinue) bson.D {
+	v, ok := r.CC.Map[contextKeyConversation]
+	if !ok {
+		return mongoerror.ProtocolError.ErrMessage("No SASL session state found")
+	}
+	c := v.(*scramConversation)
+
+	if cmd.ConversationID != c.id {
+		delete(r.CC.Map, contextKeyConversation)
+		return mongoerror.ProtocolError.ErrMessage("Mismatched conversation id")
+	}
+
+	// The server-final message has already been sent; this is the empty exchange
+	// that closes out the conversation
+	if c.conv.Done() {
+		delete(r.CC.Map, contextKeyConversation)
+		if !c.conv.Valid() {
+			return authenticationFailed()
+		}
+		return c.reply("", true)
+	}
+
+	response, err := c.conv.Step(string(cmd.Payload))
+	if err != nil || !c.conv.Valid() {
+		logrus.Debugf("saslContinue failed: %v", err)
+		delete(r.CC.Map, contextKeyConversation)
+		authnTotal.WithLabelValues(c.mechanism, "false").Inc()
+		return authenticationFailed()
+	}
+
+	authnTotal.WithLabelValues(c.mechanism, "true").Inc()
+	r.CC.AddIdentity(plugins.NewUserIdentity(Name, c.user.name, c.user.db, c.user.roles...))
+
+	if c.skipEmptyExchange {
+		delete(r.CC.Map, contextKeyConversation)
+		return c.reply(response, true)
+	}
+
+	return c.reply(response, false)
+}
+
+func (c *scramConversation) reply(payload string, done bool) bson.D {
+	return bson.D{
+		{"conversationId", c.id},
+		{"done", done},
+		{"payload", primitive.Binary{Data: []byte(payload)}},
+		{"ok", 1},
+	}
+}
@@ -0,0 +1,92 @@
+package authn
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/xdg-go/scram"
+)
+
+type user struct {
+	name  string
+	db    string
+	roles []string
+
+	scram map[string]scram.StoredCredentials // mechanism -> credentials
+}
+
+func newUser(c UserConfig) (*user, error) {
+	if c.User == "" {
+		return nil, fmt.Errorf("user missing name")
+	}
+
+	u := &user{
+		name:  c.User,
+		db:    c.DB,
+		roles: c.Roles,
+		scram: make(map[string]scram.StoredCredentials),
+	}
+	if u.db == "" {
+		u.db = "admin"
+	}
+
+	for mechanism, credConf := range map[string]*ScramCredentialConfig{
+		ScramSHA1:   c.Credentials.SCRAMSHA1,
+		ScramSHA256: c.Credentials.SCRAMSHA256,
+	} {
+		if credConf == nil {
+			continue
+		}
+		cred, err := credConf.storedCredentials()
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s credentials for user %s: %v", mechanism, u.key(), err)
+		}
+		u.scram[mechanism] = cred
+	}
+
+	if len(u.scram) == 0 {
+		return nil, fmt.Errorf("user %s has no credentials", u.key())
+	}
+
+	return u, nil
+}
+
+func (u *user) key() string { return u.db + "." + u.name }
+
+// mechanisms returns the mechanisms this user can authenticate with (in order of preference)
+func (u *user) mechanisms() []string {
+	mechs := make([]string, 0, len(u.scram))
+	for _, m := range []string{ScramSHA256, ScramSHA1} {
+		if _, ok := u.scram[m]; ok {
+			mechs = append(mechs, m)
+		}
+	}
+	return mechs
+}
+
+func (c *ScramCredentialConfig) storedCredentials() (scram.StoredCredentials, error) {
+	var (
+		cred scram.StoredCredentials
+		err  error
+	)
+
+	if c.IterationCount <= 0 {
+		return cred, fmt.Errorf("iterationCount must be positive")
+	}
+	cred.Iters = c.IterationCount
+
+	salt, err := base64.StdEncoding.DecodeString(c.Salt)
+	if err != nil {
+		return cred, fmt.Errorf("salt: %v", err)
+	}
+	cred.Salt = string(salt)
+
+	if cred.StoredKey, err = base64.StdEncoding.DecodeString(c.StoredKey); err != nil {
+		return cred, fmt.Errorf("storedKey: %v", err)
+	}
+	if cred.ServerKey, err = base64.StdEncoding.DecodeString(c.ServerKey); err != nil {
+		return cred, fmt.Errorf("serverKey: %v", err)
+	}
+
+	return cred, nil
+}
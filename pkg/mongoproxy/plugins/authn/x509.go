@@ -0,0 +1,163 @@
+package authn
+
+import (
+	"crypto/x509"
+	"fmt"
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+const MongoDBX509 = "MONGODB-X509"
+
+type X509Config struct {
+	// Rules are evaluated in order, the first matching rule determines the identity
+	Rules []X509RuleConfig `bson:"rules"`
+}
+
+// X509RuleConfig maps a client certificate to an identity. A rule matches if all of the
+// configured patterns match; at least one of Subject or SAN must be set.
+type X509RuleConfig struct {
+	// Subject is a regex matched against the RFC 2253 subject of the certificate
+	Subject string `bson:"subject"`
+	// SAN is a regex matched against each DNS, URI and email SAN of the certificate
+	SAN string `bson:"san"`
+	// User is the user name of the identity; it may reference capture groups of the
+	// matching pattern (e.g. "$1"). Defaults to the certificate subject
+	User string `bson:"user"`
+	// Roles are the roles given to the identity
+	Roles []string `bson:"roles"`
+}
+
+type x509Rule struct {
+	subject *regexp.Regexp
+	san     *regexp.Regexp
+	user    string
+	roles   []string
+}
+
+func newX509Rule(c X509RuleConfig) (*x509Rule, error) {
+	if c.Subject == "" && c.SAN == "" {
+		return nil, fmt.Errorf("x509 rule requires a subject or san pattern")
+	}
+
+	rule := &x509Rule{
+		user:  c.User,
+		roles: c.Roles,
+	}
+
+	var err error
+	if c.Subject != "" {
+		if rule.subject, err = regexp.Compile(c.Subject); err != nil {
+			return nil, err
+		}
+	}
+	if c.SAN != "" {
+		if rule.san, err = regexp.Compile(c.SAN); err != nil {
+			return nil, err
+		}
+	}
+
+	return rule, nil
+}
+
+// match returns the user for the certificate if the rule matches
+func (r *x509Rule) match(cert *x509.Certificate) (string, bool) {
+	subject := cert.Subject.String()
+
+	var (
+		pattern  *regexp.Regexp
+		src      string
+		submatch []int
+	)
+
+	if r.subject != nil {
+		submatch = r.subject.FindStringSubmatchIndex(subject)
+		if submatch == nil {
+			return "", false
+		}
+		pattern, src = r.subject, subject
+	}
+
+	if r.san != nil {
+		var sanSubmatch []int
+		var san string
+		for _, san = range certificateSANs(cert) {
+			if sanSubmatch = r.san.FindStringSubmatchIndex(san); sanSubmatch != nil {
+				break
+			}
+		}
+		if sanSubmatch == nil {
+			return "", false
+		}
+		// The subject pattern takes precedence for expanding the user
+		if pattern == nil {
+			pattern, src, submatch = r.san, san, sanSubmatch
+		}
+	}
+
+	if r.user == "" {
+		return subject, true
+	}
+
+	return string(pattern.ExpandString(nil, r.user, src, submatch)), true
+}
+
+func certificateSANs(cert *x509.Certificate) []string {
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.URIs)+len(cert.EmailAddresses))
+	sans = append(sans, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	sans = append(sans, cert.EmailAddresses...)
+	return sans
+}
+
+func (p *AuthnPlugin) authenticate(r *plugins.Request, cmd *command.Authenticate) bson.D {
+	if cmd.Mechanism != MongoDBX509 {
+		authnTotal.WithLabelValues(cmd.Mechanism, "false").Inc()
+		return mongoerror.BadValue.ErrMessage("Unsupported mechanism " + cmd.Mechanism + " for authenticate")
+	}
+
+	if cmd.Database != "$external" {
+		authnTotal.WithLabelValues(cmd.Mechanism, "false").Inc()
+		return mongoerror.BadValue.ErrMessage("X.509 authentication must always use the $external database.")
+	}
+
+	// We only trust certificates that were verified against the client CA
+	if r.CC.TLS == nil || len(r.CC.TLS.VerifiedChains) == 0 {
+		authnTotal.WithLabelValues(cmd.Mechanism, "false").Inc()
+		return mongoerror.ProtocolError.ErrMessage("No verified subject name available from client")
+	}
+	cert := r.CC.TLS.VerifiedChains[0][0]
+
+	for _, rule := range p.x509Rules {
+		user, ok := rule.match(cert)
+		if !ok {
+			continue
+		}
+
+		// mongod requires the user (if given) to match the certificate; we accept
+		// either the subject or the mapped user name
+		if cmd.User != "" && cmd.User != user && cmd.User != cert.Subject.String() {
+			logrus.Debugf("X.509 user mismatch: requested=%s mapped=%s", cmd.User, user)
+			break
+		}
+
+		authnTotal.WithLabelValues(cmd.Mechanism, "true").Inc()
+		r.CC.AddIdentity(plugins.NewUserIdentity(Name, user, cmd.Database, rule.roles...))
+		return bson.D{
+			{"dbname", cmd.Database},
+			{"user", user},
+			{"ok", 1},
+		}
+	}
+
+	authnTotal.WithLabelValues(cmd.Mechanism, "false").Inc()
+	return authenticationFailed()
+}
@@ -2,9 +2,12 @@ package authz
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"io/ioutil"
 	"path"
+	"strconv"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/sirupsen/logrus"
@@ -31,17 +34,26 @@ var (
 	}, []string{"db", "collection", "command"})
 
 	OPEN_COMMAND = map[string]struct{}{
+		"hello":            {},
 		"isMaster":         {},
 		"ismaster":         {},
 		"buildInfo":        {},
 		"buildinfo":        {},
 		"connectionStatus": {},
 		"saslStart":        {},
+		"saslContinue":     {},
+		"authenticate":     {},
 		"getnonce":         {},
 		"logout":           {},
 		"ping":             {},
 		"dbStats":          {},
 		"dbstats":          {},
+		// The commands of a transaction are authorized individually
+		"commitTransaction": {},
+		"abortTransaction":  {},
+		// Only reports the outcome of the client's own legacy writes
+		"getLastError": {},
+		"getlasterror": {},
 	}
 )
 
@@ -77,6 +89,10 @@ type AuthzPluginConfig struct {
 type AuthzPlugin struct {
 	conf AuthzPluginConfig
 	a    authzlib.Authz
+
+	watcher *fsnotify.Watcher
+
+	loadState plugins.LoadState
 }
 
 func (p *AuthzPlugin) Name() string { return Name }
@@ -90,9 +106,46 @@ func (p *AuthzPlugin) LoadConfig() (err error) {
 		}
 	}()
 
+	defer func() {
+		var version string
+		if err == nil {
+			version = configVersion(p.conf.Paths)
+		}
+		p.loadState.Record(version, err)
+	}()
+
 	return p.a.LoadConfig(context.TODO(), p.conf.Paths, nil)
 }
 
+// configVersion returns a hash of the config files in paths
+func configVersion(paths []string) string {
+	h := xxhash.New()
+	for _, pth := range paths {
+		for _, name := range []string{"roles.json", "policies.json"} {
+			b, err := ioutil.ReadFile(path.Join(pth, name))
+			if err != nil {
+				continue
+			}
+			h.Write(b)
+		}
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// State returns the state of the loaded config
+func (p *AuthzPlugin) State() bson.D {
+	return append(bson.D{{"paths", p.conf.Paths}}, p.loadState.State()...)
+}
+
+// HealthCheck returns an error if the last (re)load of the config failed; the
+// previously loaded config is still being enforced
+func (p *AuthzPlugin) HealthCheck(ctx context.Context) error {
+	if err := p.loadState.Err(); err != nil {
+		return fmt.Errorf("error loading config: %v", err)
+	}
+	return nil
+}
+
 // Configure configures this plugin with the given configuration object. Returns
 // an error if the configuration is invalid for the plugin.
 func (p *AuthzPlugin) Configure(d bson.D) error {
@@ -111,10 +164,14 @@ func (p *AuthzPlugin) Configure(d bson.D) error {
 		return err
 	}
 
-	// start watch
+	return nil
+}
+
+// Start starts watching the config paths, reloading the config on change
+func (p *AuthzPlugin) Start(_ context.Context) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	go func() {
@@ -138,13 +195,25 @@ func (p *AuthzPlugin) Configure(d bson.D) error {
 
 	for _, pth := range p.conf.Paths {
 		if err := watcher.Add(path.Dir(pth)); err != nil {
+			watcher.Close()
 			return err
 		}
 	}
+	p.watcher = watcher
 
 	return nil
 }
 
+// Close stops watching the config paths
+func (p *AuthzPlugin) Close(_ context.Context) error {
+	if p.watcher == nil {
+		return nil
+	}
+	err := p.watcher.Close()
+	p.watcher = nil
+	return err
+}
+
 func (p *AuthzPlugin) resourcesForCommand(r *plugins.Request, c command.Command) map[authzlib.AuthorizationMethod][]authzlib.Resource {
 	resourceMap := make(map[authzlib.AuthorizationMethod][]authzlib.Resource)
 
@@ -436,6 +505,22 @@ func (p *AuthzPlugin) resourcesForCommand(r *plugins.Request, c command.Command)
 			},
 		}
 
+	// Proxy admin commands
+	case *command.MongoproxyStatus, *command.MongoproxyListConnections, *command.MongoproxyListCursors,
+		*command.MongoproxyListSessions, *command.MongoproxyPluginState:
+		resourceMap[authzlib.Read] = []authzlib.Resource{
+			{
+				Global: true,
+			},
+		}
+
+	case *command.MongoproxyReloadConfig:
+		resourceMap[authzlib.Update] = []authzlib.Resource{
+			{
+				Global: true,
+			},
+		}
+
 	case *command.ShardCollection:
 		resourceMap[authzlib.Update] = []authzlib.Resource{
 			{
@@ -497,7 +582,7 @@ func (p *AuthzPlugin) Process(ctx context.Context, r *plugins.Request, next plug
 	}
 
 	// Now we do the batch of authorization calls
-	identities := r.CC.Identities
+	identities := r.CC.Identities()
 	roles := make([]string, 0, 100)
 	rolesM := make(map[string]struct{})
 	// If there is no identity on the connection then we set a "canned" UNAUTHENTICATED_ROLE
@@ -574,7 +574,7 @@ func BenchmarkPlugin(b *testing.B) {
 			}
 
 			for x, g := range test.good {
-				r.CC.Identities = g
+				r.CC.SetIdentities(g)
 				b.Run("good:"+strconv.Itoa(x), func(b *testing.B) {
 					for xx := 0; xx < b.N; xx++ {
 						p(context.TODO(), r)
@@ -582,7 +582,7 @@ func BenchmarkPlugin(b *testing.B) {
 				})
 			}
 			for x, bad := range test.bad {
-				r.CC.Identities = bad
+				r.CC.SetIdentities(bad)
 				b.Run("bad:"+strconv.Itoa(x), func(b *testing.B) {
 					for xx := 0; xx < b.N; xx++ {
 						p(context.TODO(), r)
@@ -647,7 +647,7 @@ func BenchmarkPluginDefaultPolicies(b *testing.B) {
 				CommandName: test.cmd[0].Key,
 				Command:     cmd,
 			}
-			r.CC.Identities = []plugins.ClientIdentity{&stubClientIdentity{U: "unknown", R: []string{"unknown"}}}
+			r.CC.SetIdentities([]plugins.ClientIdentity{&stubClientIdentity{U: "unknown", R: []string{"unknown"}}})
 
 			b.ResetTimer()
 			for x := 0; x < b.N; x++ {
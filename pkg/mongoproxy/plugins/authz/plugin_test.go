@@ -19,7 +19,13 @@ func newStubCursorCache() *stubCursorCache {
 }
 
 type stubCursorCache struct {
-	m map[int64]*plugins.CursorCacheEntry
+	m      map[int64]*plugins.CursorCacheEntry
+	nextID int64
+}
+
+func (c *stubCursorCache) NewCursor() *plugins.CursorCacheEntry {
+	c.nextID++
+	return c.GetCursor(c.nextID)
 }
 
 func (c *stubCursorCache) GetCursor(cursorID int64) *plugins.CursorCacheEntry {
@@ -41,6 +47,7 @@ type stubClientIdentity struct {
 
 func (i *stubClientIdentity) Type() string    { return "stub" }
 func (i *stubClientIdentity) User() string    { return i.U }
+func (i *stubClientIdentity) DB() string      { return "" }
 func (i *stubClientIdentity) Roles() []string { return i.R }
 
 func TestPluginGetMore(t *testing.T) {
@@ -144,8 +151,8 @@ func TestPluginGetMore(t *testing.T) {
 			okV := 1
 
 			for _, g := range test.good {
-				r.CC.Identities = g
-				getMoreR.CC.Identities = g
+				r.CC.SetIdentities(g)
+				getMoreR.CC.SetIdentities(g)
 				result, err := p(context.TODO(), r)
 				if err != nil {
 					t.Fatal(err)
@@ -174,8 +181,8 @@ func TestPluginGetMore(t *testing.T) {
 			}
 			okV = 0
 			for _, b := range test.bad {
-				r.CC.Identities = b
-				getMoreR.CC.Identities = b
+				r.CC.SetIdentities(b)
+				getMoreR.CC.SetIdentities(b)
 				result, err := p(context.TODO(), r)
 
 				if err != nil {
@@ -772,7 +779,7 @@ func TestPlugin(t *testing.T) {
 			okV := 1
 
 			for _, g := range test.good {
-				r.CC.Identities = g
+				r.CC.SetIdentities(g)
 				result, err := p(context.TODO(), r)
 
 				if err != nil {
@@ -788,7 +795,7 @@ func TestPlugin(t *testing.T) {
 			}
 			okV = 0
 			for _, b := range test.bad {
-				r.CC.Identities = b
+				r.CC.SetIdentities(b)
 				result, err := p(context.TODO(), r)
 
 				if err != nil {
@@ -860,7 +867,7 @@ func TestPluginDefaultNamespacesPolicies(t *testing.T) {
 				CommandName: test.cmd[0].Key,
 				Command:     cmd,
 			}
-			r.CC.Identities = []plugins.ClientIdentity{&stubClientIdentity{U: "unknown", R: []string{"unknown"}}}
+			r.CC.SetIdentities([]plugins.ClientIdentity{&stubClientIdentity{U: "unknown", R: []string{"unknown"}}})
 
 			result, err := p(context.TODO(), r)
 			if err != nil {
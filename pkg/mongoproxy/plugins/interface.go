@@ -2,11 +2,16 @@ package plugins
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"go.mongodb.org/mongo-driver/bson"
 
+	"github.com/wish/mongoproxy/pkg/bsonutil"
 	"github.com/wish/mongoproxy/pkg/command"
 )
 
@@ -26,6 +31,38 @@ type Plugin interface {
 	Process(context.Context, *Request, PipelineFunc) (bson.D, error)
 }
 
+// Starter is an optional interface for plugins which run background work (e.g.
+// polling or watching files). Start is called after every plugin in the pipeline
+// has been configured and before the pipeline handles any requests.
+type Starter interface {
+	Start(context.Context) error
+}
+
+// Closer is an optional interface for plugins which hold resources. Close is
+// called once the pipeline is no longer used: on shutdown or once a reload has
+// drained all requests from the pipeline it replaced. It is also called if the
+// pipeline fails to load, so Close must work on a plugin which was configured (or
+// not even that) but never started.
+type Closer interface {
+	Close(context.Context) error
+}
+
+// SessionSupporter is an optional interface for plugins which send commands to a
+// downstream. LogicalSessionTimeoutMinutes returns the downstream's session timeout,
+// or false if it doesn't support sessions; the proxy only advertises sessions to
+// clients if all of these plugins do.
+type SessionSupporter interface {
+	LogicalSessionTimeoutMinutes() (int64, bool)
+}
+
+// HealthChecker is an optional interface for plugins which can be unable to serve
+// requests, e.g. if the downstream can't be reached. HealthCheck returns an error if
+// the plugin is unhealthy; the proxy isn't ready for traffic unless all of these
+// plugins are healthy.
+type HealthChecker interface {
+	HealthCheck(context.Context) error
+}
+
 func NewCursorCacheEntry(id int64) *CursorCacheEntry {
 	return &CursorCacheEntry{
 		ID:  id,
@@ -34,6 +71,8 @@ func NewCursorCacheEntry(id int64) *CursorCacheEntry {
 }
 
 type CursorCache interface {
+	// NewCursor returns the entry for a new cursor with an ID minted by the proxy
+	NewCursor() *CursorCacheEntry
 	GetCursor(cursorID int64) *CursorCacheEntry
 	CloseCursor(cursorID int64)
 }
@@ -42,10 +81,74 @@ type CursorCacheEntry struct {
 	ID             int64
 	CursorConsumed int
 
+	// Owner is the client that created the cursor (nil if the cursor wasn't
+	// created through the proxy)
+	Owner *CursorOwner
+
+	// Downstream is the cursor this entry maps to (nil if the cursor wasn't
+	// opened by a backend plugin)
+	Downstream *CursorDownstream
+
 	// Map is storage that resets on cursor change
 	Map map[interface{}]interface{}
 }
 
+// CursorDownstream is the location of a cursor the proxy handed out under its own ID
+type CursorDownstream struct {
+	// Backend identifies the cluster the cursor is open on (e.g. the mongo plugin's mongoAddr)
+	Backend string
+	// Server is the address of the server within the backend
+	Server string
+	// ID is the cursor ID on the server
+	ID int64
+}
+
+// CursorOwner identifies the client that created a cursor
+type CursorOwner struct {
+	// Users are the users the client was authenticated as (see IdentityName)
+	Users []string
+	// LSID is the session the cursor was created in (nil if there was none)
+	LSID bson.D
+}
+
+// NewCursorOwner returns the owner of a cursor created by the client in the given session
+func NewCursorOwner(cc *ClientConnection, lsid bson.D) *CursorOwner {
+	o := &CursorOwner{LSID: lsid}
+	for _, identity := range cc.Identities() {
+		o.Users = append(o.Users, IdentityName(identity))
+	}
+	return o
+}
+
+// CoauthorizedWith returns whether the client shares an authenticated user with the
+// owner (or neither is authenticated). This matches the check mongod does before
+// letting a client use a cursor.
+func (o *CursorOwner) CoauthorizedWith(cc *ClientConnection) bool {
+	identities := cc.Identities()
+	if len(o.Users) == 0 && len(identities) == 0 {
+		return true
+	}
+	for _, identity := range identities {
+		name := IdentityName(identity)
+		for _, u := range o.Users {
+			if name == u {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SameSession returns whether lsid is the session the cursor was created in
+func (o *CursorOwner) SameSession(lsid bson.D) bool {
+	if o.LSID == nil || lsid == nil {
+		return o.LSID == nil && lsid == nil
+	}
+	ownerID, _ := bsonutil.Lookup(o.LSID, "id")
+	id, _ := bsonutil.Lookup(lsid, "id")
+	return reflect.DeepEqual(ownerID, id)
+}
+
 // Request encapsulates a mongo request
 type Request struct {
 	CC *ClientConnection
@@ -56,6 +159,9 @@ type Request struct {
 	CommandName string
 	Command     command.Command
 
+	// Session is the logical session the command is part of (nil if none)
+	Session *Session
+
 	// Map of arbitrary data for plugins to store stuff in
 	Map map[string]interface{}
 }
@@ -71,17 +177,113 @@ func NewClientConnection() *ClientConnection {
 type ClientConnection struct {
 	// Address of client connection
 	Addr net.Addr
-	// According to the docs (https://docs.mongodb.com/manual/core/authentication/#authentication-methods) multiple logins should
-	// have the credentials for all until a logout happens; for now we aren't doing that.
-	Identities []ClientIdentity
+	// TLS is the state of the TLS connection (nil if the client didn't connect with TLS)
+	TLS *tls.ConnectionState
+	// Listener is the name of the listener the client connected to ("" for the default)
+	Listener string
+	// LastError is the outcome of the last legacy write (OP_INSERT, OP_UPDATE or
+	// OP_DELETE) of the client, as reported by getLastError
+	LastError bson.D
 
 	// Map is storage that resets on cursor change
 	Map map[interface{}]interface{}
+
+	// lastCommand is the name of the last command run by the client
+	lastCommand atomic.Value
+
+	// mu guards the fields below, which are also read from other connections (e.g.
+	// the admin commands and API)
+	mu sync.Mutex
+	// identities accumulate as the client authenticates (as the docs describe:
+	// https://docs.mongodb.com/manual/core/authentication/#authentication-methods), with
+	// one per user, until the client logs out
+	identities []ClientIdentity
+	// documentSequences is whether the client accepts document sequences in replies
+	documentSequences bool
+	// compressors are the compressors negotiated with the client
+	compressors []string
+}
+
+// Identities returns the identities the client is authenticated as (nil if none).
+// The returned slice must not be modified.
+func (c *ClientConnection) Identities() []ClientIdentity {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.identities
+}
+
+// SetIdentities replaces the identities of the client (nil to log out)
+func (c *ClientConnection) SetIdentities(identities []ClientIdentity) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.identities = identities
+}
+
+// DocumentSequences returns whether the client accepts document sequences (kind 1
+// sections) in OP_MSG replies, as negotiated in its hello
+func (c *ClientConnection) DocumentSequences() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.documentSequences
+}
+
+// SetDocumentSequences records whether the client accepts document sequences in replies
+func (c *ClientConnection) SetDocumentSequences(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.documentSequences = enabled
+}
+
+// Compressors returns the compressors negotiated in the client's hello. The returned
+// slice must not be modified.
+func (c *ClientConnection) Compressors() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.compressors
+}
+
+// SetCompressors records the compressors negotiated with the client
+func (c *ClientConnection) SetCompressors(compressors []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.compressors = compressors
+}
+
+// AddIdentity adds the identity to the client, replacing any previous identity for
+// the same user (in the same database)
+func (c *ClientConnection) AddIdentity(identity ClientIdentity) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The slice is copied as readers may still hold the previous one
+	identities := make([]ClientIdentity, 0, len(c.identities)+1)
+	replaced := false
+	for _, existing := range c.identities {
+		if existing.Type() == identity.Type() && IdentityName(existing) == IdentityName(identity) {
+			existing, replaced = identity, true
+		}
+		identities = append(identities, existing)
+	}
+	if !replaced {
+		identities = append(identities, identity)
+	}
+	c.identities = identities
+}
+
+// SetLastCommand records the name of the command the client is running
+func (c *ClientConnection) SetLastCommand(name string) {
+	c.lastCommand.Store(name)
+}
+
+// LastCommand returns the name of the last command run by the client ("" if none)
+func (c *ClientConnection) LastCommand() string {
+	name, _ := c.lastCommand.Load().(string)
+	return name
 }
 
 func (c *ClientConnection) GetUsername() string {
 	var usernames []string
-	for _, identity := range c.Identities {
+	for _, identity := range c.Identities() {
 		usernames = append(usernames, identity.User())
 	}
 	var username string
@@ -113,9 +315,19 @@ func (c *ClientConnection) Close() {}
 type ClientIdentity interface {
 	Type() string // Where the identity came from
 	User() string
+	DB() string // The database the user authenticated against ("" if none)
 	Roles() []string
 }
 
+// IdentityName returns the user of the identity qualified by its database, as user@db
+// (the same name in different databases is a different user)
+func IdentityName(identity ClientIdentity) string {
+	if identity.DB() == "" {
+		return identity.User()
+	}
+	return identity.User() + "@" + identity.DB()
+}
+
 func NewStaticIdentity(t, u string, rs ...string) *StaticIdentity {
 	return &StaticIdentity{
 		T:  t,
@@ -124,12 +336,24 @@ func NewStaticIdentity(t, u string, rs ...string) *StaticIdentity {
 	}
 }
 
+// NewUserIdentity returns the identity of user u, authenticated against db
+func NewUserIdentity(t, u, db string, rs ...string) *StaticIdentity {
+	return &StaticIdentity{
+		T:  t,
+		U:  u,
+		D:  db,
+		RS: rs,
+	}
+}
+
 type StaticIdentity struct {
 	T  string   `bson"type"`
 	U  string   `bson:"user"`
+	D  string   `bson:"db"`
 	RS []string `bson:"roles"`
 }
 
 func (i *StaticIdentity) Type() string    { return i.T }
 func (i *StaticIdentity) User() string    { return i.U }
+func (i *StaticIdentity) DB() string      { return i.D }
 func (i *StaticIdentity) Roles() []string { return i.RS }
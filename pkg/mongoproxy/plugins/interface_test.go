@@ -0,0 +1,22 @@
+package plugins
+
+import "testing"
+
+func TestCoauthorizedWith(t *testing.T) {
+	alice := NewClientConnection()
+	alice.AddIdentity(NewUserIdentity("test", "alice", "admin"))
+	owner := NewCursorOwner(alice, nil)
+
+	// The same user name in another database is a different user
+	otherAlice := NewClientConnection()
+	otherAlice.AddIdentity(NewUserIdentity("test", "alice", "app"))
+	if owner.CoauthorizedWith(otherAlice) {
+		t.Fatal("alice@app is coauthorized with alice@admin")
+	}
+
+	// Once authenticated as the owner too (identities accumulate) it is
+	otherAlice.AddIdentity(NewUserIdentity("test", "alice", "admin"))
+	if len(otherAlice.Identities()) != 2 || !owner.CoauthorizedWith(otherAlice) {
+		t.Fatalf("unexpected identities: %v", otherAlice.Identities())
+	}
+}
@@ -0,0 +1,42 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+)
+
+// StartPlugins calls Start on every plugin implementing Starter in pipeline
+// order. If a plugin fails to start, all plugins (including those which weren't
+// started, as they may hold resources from Configure) are closed and the error
+// returned.
+func StartPlugins(ctx context.Context, ps []Plugin) error {
+	for _, p := range ps {
+		starter, ok := p.(Starter)
+		if !ok {
+			continue
+		}
+		if err := starter.Start(ctx); err != nil {
+			ClosePlugins(ctx, ps)
+			return fmt.Errorf("error starting plugin %s: %v", p.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// ClosePlugins calls Close on every plugin implementing Closer in pipeline
+// order. All plugins are closed even if some fail; the first error is returned.
+func ClosePlugins(ctx context.Context, ps []Plugin) error {
+	var firstErr error
+	for _, p := range ps {
+		closer, ok := p.(Closer)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(ctx); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("error closing plugin %s: %v", p.Name(), err)
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,66 @@
+package plugins_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins/authz"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins/mongo"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins/schema"
+)
+
+type lifecyclePlugin struct {
+	name     string
+	startErr error
+	events   *[]string
+}
+
+func (p *lifecyclePlugin) Name() string           { return p.name }
+func (p *lifecyclePlugin) Configure(bson.D) error { return nil }
+func (p *lifecyclePlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	return next(ctx, r)
+}
+func (p *lifecyclePlugin) Start(context.Context) error {
+	*p.events = append(*p.events, "start "+p.name)
+	return p.startErr
+}
+func (p *lifecyclePlugin) Close(context.Context) error {
+	*p.events = append(*p.events, "close "+p.name)
+	return nil
+}
+
+func TestStartPluginsFailure(t *testing.T) {
+	var events []string
+	err := plugins.StartPlugins(context.TODO(), []plugins.Plugin{
+		&lifecyclePlugin{name: "a", events: &events},
+		&lifecyclePlugin{name: "b", startErr: errors.New("failed"), events: &events},
+		&lifecyclePlugin{name: "c", events: &events},
+	})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	// All the plugins are closed, including those never started
+	if expected := []string{"start a", "start b", "close a", "close b", "close c"}; !reflect.DeepEqual(events, expected) {
+		t.Fatalf("expected %v, got %v", expected, events)
+	}
+}
+
+// TestCloseUnstarted checks that the plugins implementing Closer can be closed
+// without having been started
+func TestCloseUnstarted(t *testing.T) {
+	for _, p := range []plugins.Plugin{
+		&authz.AuthzPlugin{},
+		&mongo.MongoPlugin{},
+		&schema.SchemaPlugin{},
+	} {
+		if err := plugins.ClosePlugins(context.TODO(), []plugins.Plugin{p}); err != nil {
+			t.Errorf("%s: %v", p.Name(), err)
+		}
+	}
+}
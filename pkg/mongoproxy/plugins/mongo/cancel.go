@@ -0,0 +1,138 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+)
+
+var (
+	cancelCleanupTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_plugins_mongo_cancel_cleanup_total",
+		Help: "The total number of downstream cleanups done after a client went away",
+	}, []string{"action", "success"})
+
+	// CancelCleanupTimeout is how long we'll spend cleaning up downstream after a client went away
+	CancelCleanupTimeout = 10 * time.Second
+)
+
+// rawCommand is a command.Command for commands the plugin itself sends downstream
+type rawCommand struct {
+	bson.D
+}
+
+func (c *rawCommand) GetSession() *command.Session { return nil }
+func (c *rawCommand) FromBSOND(d bson.D) error     { c.D = d; return nil }
+func (c *rawCommand) MarshalBSON() ([]byte, error) { return bson.Marshal(c.D) }
+
+// cleanupCancelled cleans up the downstream work of a command whose client went
+// away. If the command completed, a cursor it opened will never be consumed and
+// is killed. If it didn't complete the operation may still be running downstream;
+// we can only identify it by the session, so if there is one all operations of
+// the session are killed.
+func (p *MongoPlugin) cleanupCancelled(cmd command.Command, server driver.Server, d bsoncore.Document) {
+	ctx, cancel := context.WithTimeout(context.Background(), CancelCleanupTimeout)
+	defer cancel()
+
+	if len(d) > 0 {
+		var result bson.D
+		if err := bson.Unmarshal(d, &result); err != nil {
+			return
+		}
+		cursorIDRaw, _ := bsonutil.Lookup(result, "cursor", "id")
+		cursorID, ok := cursorIDRaw.(int64)
+		if !ok || cursorID == 0 {
+			return
+		}
+		nsRaw, _ := bsonutil.Lookup(result, "cursor", "ns")
+		ns, _ := nsRaw.(string)
+
+		err := p.killCursor(ctx, server, ns, cursorID)
+		cancelCleanupTotal.WithLabelValues("killCursors", strconv.FormatBool(err == nil)).Inc()
+		if err != nil {
+			logrus.Errorf("Error killing cursor %d of cancelled request: %v", cursorID, err)
+		}
+		return
+	}
+
+	session := cmd.GetSession()
+	if session == nil || len(session.LSID) == 0 {
+		logrus.Debugf("Unable to kill cancelled operation without a session")
+		return
+	}
+	lsidID, ok := bsonutil.Lookup(session.LSID, "id")
+	if !ok {
+		return
+	}
+
+	err := p.killSessionOps(ctx, server, lsidID)
+	cancelCleanupTotal.WithLabelValues("killOp", strconv.FormatBool(err == nil)).Inc()
+	if err != nil {
+		logrus.Errorf("Error killing operations of cancelled request: %v", err)
+	}
+}
+
+func (p *MongoPlugin) killCursor(ctx context.Context, server driver.Server, ns string, cursorID int64) error {
+	nsParts := strings.SplitN(ns, ".", 2)
+	if len(nsParts) != 2 {
+		return fmt.Errorf("invalid cursor namespace %q", ns)
+	}
+
+	_, _, err := p.runCommand(ctx, nsParts[0], &rawCommand{bson.D{
+		{"killCursors", nsParts[1]},
+		{"cursors", primitive.A{cursorID}},
+	}}, server)
+	return err
+}
+
+// killSessionOps kills all operations running on server for the given session id
+func (p *MongoPlugin) killSessionOps(ctx context.Context, server driver.Server, lsidID interface{}) error {
+	d, _, err := p.runCommand(ctx, "admin", &rawCommand{bson.D{
+		{"currentOp", 1},
+		{"lsid.id", lsidID},
+	}}, server)
+	if err != nil {
+		return err
+	}
+
+	var result bson.D
+	if err := bson.Unmarshal(d, &result); err != nil {
+		return err
+	}
+
+	inprog, _ := bsonutil.Lookup(result, "inprog")
+	ops, _ := inprog.(primitive.A)
+	for _, opRaw := range ops {
+		op, ok := opRaw.(bson.D)
+		if !ok {
+			continue
+		}
+		// On mongos this is a string of the form "shard:opid"
+		opid, ok := bsonutil.Lookup(op, "opid")
+		if !ok {
+			continue
+		}
+		logrus.Debugf("Killing op %v of cancelled request", opid)
+		if _, _, err := p.runCommand(ctx, "admin", &rawCommand{bson.D{
+			{"killOp", 1},
+			{"op", opid},
+		}}, server); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package mongo
+
+import (
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/address"
+	"go.mongodb.org/mongo-driver/mongo/description"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+// backend identifies the cluster this plugin sends commands to. Cursors are only
+// usable by a plugin for the same cluster (e.g. the plugin replacing this one on reload).
+func (p *MongoPlugin) backend() string {
+	return p.conf.MongoAddr
+}
+
+// openCursor replaces the downstream cursor ID in result (if any) with an ID minted
+// by the proxy, and records the server and downstream ID in the cursor cache. This
+// way cursor IDs from different servers or clusters never collide.
+func (p *MongoPlugin) openCursor(r *plugins.Request, result bson.D, server driver.Server) bson.D {
+	cursorIDRaw, ok := bsonutil.Lookup(result, "cursor", "id")
+	if !ok {
+		return result
+	}
+	cursorID, ok := cursorIDRaw.(int64)
+	if !ok || cursorID == 0 {
+		return result
+	}
+
+	entry := r.CursorCache.NewCursor()
+	entry.Downstream = &plugins.CursorDownstream{
+		Backend: p.backend(),
+		Server:  string(serverAddress(server)),
+		ID:      cursorID,
+	}
+	logrus.Tracef("Store cursor: %v -> %v %v", entry.ID, cursorID, entry.Downstream.Server)
+
+	result, _ = bsonutil.Set(result, entry.ID, "cursor", "id")
+	return result
+}
+
+// cursorServer returns the server the cursor was opened on and the cursor's ID on
+// that server. Cursors store the address of the server which is looked up in the
+// current topology; this way cursors remain usable when the plugin is reconfigured
+// (as the new plugin has its own topology).
+func (p *MongoPlugin) cursorServer(c *plugins.CursorCacheEntry) (driver.Server, int64, bool) {
+	if c.Downstream == nil || c.Downstream.Backend != p.backend() {
+		return nil, 0, false
+	}
+
+	server, err := p.t.FindServer(description.Server{Addr: address.Address(c.Downstream.Server)})
+	if err != nil || server == nil {
+		return nil, 0, false
+	}
+	return server, c.Downstream.ID, true
+}
+
+// killBatch is the set of cursors to kill on a single server
+type killBatch struct {
+	server  driver.Server
+	cursors primitive.A
+	// proxyIDs maps the downstream cursor IDs back to the IDs we handed out
+	proxyIDs map[int64]int64
+}
+
+// proxyCursorIDs maps a list of downstream cursor IDs from a killCursors response
+// back to the IDs we handed out
+func (b *killBatch) proxyCursorIDs(v interface{}) primitive.A {
+	ids, _ := v.(primitive.A)
+	proxyIDs := make(primitive.A, 0, len(ids))
+	for _, idRaw := range ids {
+		id, ok := idRaw.(int64)
+		if !ok {
+			continue
+		}
+		if proxyID, ok := b.proxyIDs[id]; ok {
+			proxyIDs = append(proxyIDs, proxyID)
+		}
+	}
+	return proxyIDs
+}
@@ -2,6 +2,7 @@ package mongo
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -11,6 +12,7 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/description"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
 	"go.mongodb.org/mongo-driver/x/mongo/driver"
 	"go.mongodb.org/mongo-driver/x/mongo/driver/operation"
@@ -49,16 +51,6 @@ var (
 	}, []string{"status"})
 )
 
-type contextKey string
-
-func (c contextKey) String() string {
-	return "mongo context key " + string(c)
-}
-
-var (
-	contextKeyServer = contextKey("mongo.server")
-)
-
 const Name = "mongo"
 
 func init() {
@@ -94,6 +86,13 @@ type MongoPlugin struct {
 	conf MongoPluginConfig
 	c    *mongo.Client
 	t    *topology.Topology
+
+	// txns are the servers transactions are pinned to (shared with the other plugins for
+	// the cluster, see transactionsFor)
+	txns *transactions
+
+	// cancel stops the background DNS discovery
+	cancel context.CancelFunc
 }
 
 func (p *MongoPlugin) Name() string { return Name }
@@ -187,6 +186,7 @@ func (p *MongoPlugin) Configure(d bson.D) error {
 
 	p.c = client
 	p.t = extractTopology(client)
+	p.txns = transactionsFor(p.conf.MongoAddr)
 
 	if p.conf.EnableDNSDiscovery {
 		discoveryClient, err := discovery.NewDiscoveryFromEnv()
@@ -197,7 +197,10 @@ func (p *MongoPlugin) Configure(d bson.D) error {
 		discoveryTarget := strings.TrimPrefix(p.conf.MongoAddr, "mongodb://")
 		logrus.Debugf("discover target: %s", discoveryTarget)
 
-		if err := discoveryClient.SubscribeServiceAddresses(context.TODO(), discoveryTarget, func(ctx context.Context, addrs discovery.ServiceAddresses) (err error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		p.cancel = cancel
+
+		if err := discoveryClient.SubscribeServiceAddresses(ctx, discoveryTarget, func(ctx context.Context, addrs discovery.ServiceAddresses) (err error) {
 			start := time.Now()
 			defer func() {
 				logrus.Debugf("UpdateSessions completed in %s", time.Since(start))
@@ -230,6 +233,52 @@ func (p *MongoPlugin) Configure(d bson.D) error {
 	return nil
 }
 
+// Close stops DNS discovery and disconnects from the downstream mongo
+func (p *MongoPlugin) Close(ctx context.Context) error {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	if p.c == nil {
+		return nil
+	}
+	return p.c.Disconnect(ctx)
+}
+
+// State returns the downstream topology as discovered by the plugin
+func (p *MongoPlugin) State() bson.D {
+	ret := bson.D{{"mongoAddr", plugins.RedactAddr(p.conf.MongoAddr)}}
+	if p.t == nil {
+		return ret
+	}
+
+	desc := p.t.Description()
+	servers := make([]bson.D, len(desc.Servers))
+	for i, s := range desc.Servers {
+		servers[i] = bson.D{{"addr", s.Addr.String()}, {"kind", s.Kind.String()}}
+		if s.LastError != nil {
+			servers[i] = append(servers[i], bson.E{"lastError", s.LastError.Error()})
+		}
+	}
+	return append(ret,
+		bson.E{"topology", desc.Kind.String()},
+		bson.E{"servers", servers},
+		bson.E{"logicalSessionTimeoutMinutes", int64(desc.SessionTimeoutMinutes)},
+		bson.E{"pinnedTransactions", int64(p.txns.count())},
+	)
+}
+
+// HealthCheck returns an error if no server of the downstream can be selected (for
+// reads), i.e. the proxy can't reach the cluster
+func (p *MongoPlugin) HealthCheck(ctx context.Context) error {
+	if p.t == nil {
+		return errors.New("not connected")
+	}
+	if _, err := p.t.SelectServer(ctx, description.ReadPrefSelector(readpref.Nearest())); err != nil {
+		return fmt.Errorf("no reachable server in %s topology: %v", p.t.Description().Kind, err)
+	}
+	return nil
+}
+
 func (p *MongoPlugin) runCommand(ctx context.Context, db string, cmd command.Command, server driver.Server) (bsoncore.Document, driver.Server, error) {
 	runCmdDoc, err := bson.Marshal(cmd)
 	if err != nil {
@@ -278,35 +327,61 @@ func (p *MongoPlugin) Process(ctx context.Context, r *plugins.Request, next plug
 
 	// Wrap handleCommand to output b/w metrics
 	runCommand := func(ctx context.Context, db string, cmd command.Command, server driver.Server) (bson.D, error) {
+		// All commands of a transaction must go to the server it was started on
+		if server == nil {
+			txnServer, err := p.transactionServer(cmd)
+			if err != nil {
+				errDoc, err := ErrorToDoc(err)
+				return append(bson.D{{"ok", 0}}, errDoc...), err
+			}
+			server = txnServer
+		}
+
+		// A downstream without retryable writes rejects the txnNumber; send the write as is
+		if isRetryableWrite(cmd) && !p.retryableWrites() {
+			cmd.GetSession().TxnNumber = nil
+		}
+
 		d, cmdServer, err := p.runCommand(ctx, db, cmd, server)
 		commandReceiveBytes.WithLabelValues(labels...).Add(float64(len(d)))
 
+		// If the client went away nobody will see the result; clean up anything
+		// left running downstream on its behalf
+		if ctx.Err() != nil {
+			if cmdServer != nil {
+				p.cleanupCancelled(cmd, cmdServer, d)
+			}
+			return nil, ctx.Err()
+		}
+
 		var result bson.D
 		if unmarshalErr := bson.Unmarshal(d, &result); unmarshalErr != nil {
 			return result, unmarshalErr
 		}
 
+		if cmdServer != nil {
+			p.trackTransaction(cmd, cmdServer, r.Session)
+		}
+
 		if err != nil {
-			errDoc, err := ErrorToDoc(err)
+			errDoc, err := ErrorToDoc(retryableWriteError(cmd, transactionError(cmd, err)))
 			if err != nil {
 				return result, err
 			}
 			if len(result) == 0 {
 				result = append(result, bson.E{"ok", 0})
 			}
+			// The error labels (which may have been added to) replace those in the response
+			if _, ok := bsonutil.Lookup(errDoc, "errorLabels"); ok {
+				result, _, _ = bsonutil.Pop(result, "errorLabels")
+			}
 			return append(result, errDoc...), err
 		}
 
-		// If we weren't passed in a server and we got a server in the response
-		if server == nil && cmdServer != nil {
-			// If we have a cursor in the response; store the mapping of ID -> server
-			if cursorIDRaw, ok := bsonutil.Lookup(result, "cursor", "id"); ok {
-				if cursorID, ok := cursorIDRaw.(int64); ok && cursorID > 0 {
-					logrus.Tracef("Store cursor: %v %v", cursorID, cmdServer)
-					// TODO: TTL from cmd
-					r.CursorCache.GetCursor(cursorID).Map[contextKeyServer] = cmdServer
-				}
-			}
+		// If we got a server in the response a cursor in the response (other than from
+		// a getMore) is newly opened on that server
+		if _, ok := cmd.(*command.GetMore); !ok && cmdServer != nil {
+			result = p.openCursor(r, result, cmdServer)
 		}
 
 		return result, nil
@@ -320,9 +395,9 @@ func (p *MongoPlugin) Process(ctx context.Context, r *plugins.Request, next plug
 
 		return runCommand(ctx, dbName, cmd, nil)
 
-	case *command.SaslStart:
+	case *command.SaslStart, *command.SaslContinue:
 		// Always return error; we don't want authn to happen at this layer as we don't keep
-		// connections for various clients separated.
+		// connections for various clients separated. Authentication is handled by the authn plugin.
 		return mongoerror.AuthenticationFailed.ErrMessage("Authentication failed."), nil
 
 	case *command.Count:
@@ -446,6 +521,21 @@ func (p *MongoPlugin) Process(ctx context.Context, r *plugins.Request, next plug
 		dbName := cmd.Database
 		cmd.Database = ""
 
+		p.endSessions(cmd)
+		return runCommand(ctx, dbName, cmd, nil)
+
+	case *command.CommitTransaction:
+		// TODO: some other way to not double-send the DB
+		dbName := cmd.Database
+		cmd.Database = ""
+
+		return runCommand(ctx, dbName, cmd, nil)
+
+	case *command.AbortTransaction:
+		// TODO: some other way to not double-send the DB
+		dbName := cmd.Database
+		cmd.Database = ""
+
 		return runCommand(ctx, dbName, cmd, nil)
 
 	case *command.ListDatabases:
@@ -474,17 +564,23 @@ func (p *MongoPlugin) Process(ctx context.Context, r *plugins.Request, next plug
 		dbName := cmd.Database
 		cmd.Database = ""
 
-		// TODO: move into runCommand?
-		v, ok := r.CursorCache.GetCursor(cmd.CursorID).Map[contextKeyServer]
+		server, cursorID, ok := p.cursorServer(r.CursorCache.GetCursor(cmd.CursorID))
 		if !ok {
 			return mongoerror.CursorNotFound.ErrMessage("Cursor not found."), nil
 		}
 
-		result, err := runCommand(ctx, dbName, cmd, v.(driver.Server))
+		downstreamCmd := *cmd
+		downstreamCmd.CursorID = cursorID
+		result, err := runCommand(ctx, dbName, &downstreamCmd, server)
 
+		// The client only knows the cursor by the ID we handed out
 		if cursorIDRaw, ok := bsonutil.Lookup(result, "cursor", "id"); ok {
-			if cursorID, ok := cursorIDRaw.(int64); ok && cursorID == 0 {
-				r.CursorCache.CloseCursor(cmd.CursorID)
+			if cursorID, ok := cursorIDRaw.(int64); ok {
+				if cursorID == 0 {
+					r.CursorCache.CloseCursor(cmd.CursorID)
+				} else {
+					result, _ = bsonutil.Set(result, cmd.CursorID, "cursor", "id")
+				}
 			}
 		}
 
@@ -504,52 +600,70 @@ func (p *MongoPlugin) Process(ctx context.Context, r *plugins.Request, next plug
 
 		return runCommand(ctx, dbName, cmd, nil)
 
-	// TODO: clear cursor entry from cache?
 	case *command.KillCursors:
 		// TODO: some other way to not double-send the DB
 		dbName := cmd.Database
 		cmd.Database = ""
 
 		var (
-			cursorsKilled   primitive.A
-			cursorsNotFound primitive.A
-			cursorsAlive    primitive.A
-			cursorsUnknown  primitive.A
+			cursorsKilled   = primitive.A{}
+			cursorsNotFound = primitive.A{}
+			cursorsAlive    = primitive.A{}
+			cursorsUnknown  = primitive.A{}
 		)
 
-		// TODO: optional based on the number of downstreams!
-		// Right now we use the same cursorIDs as we got from mongos; we need to map those through
+		// Group the cursors by the server they are open on so we send one killCursors per server
+		var batches []*killBatch
+		batchesByServer := map[string]*killBatch{}
 		for _, cursorIDRaw := range cmd.Cursors {
 			cursorID, ok := cursorIDRaw.(int64)
 			if !ok {
 				return nil, fmt.Errorf("invalid cursorID")
 			}
-			v, ok := r.CursorCache.GetCursor(cursorID).Map[contextKeyServer]
+			entry := r.CursorCache.GetCursor(cursorID)
+			server, downstreamID, ok := p.cursorServer(entry)
 			if !ok {
-				return mongoerror.CursorNotFound.ErrMessage("Cursor not found."), nil
+				// Don't leave an empty entry behind for a cursor we never handed out
+				if entry.Downstream == nil {
+					r.CursorCache.CloseCursor(cursorID)
+				}
+				cursorsNotFound = append(cursorsNotFound, cursorID)
+				continue
 			}
 
-			result, err := runCommand(ctx, dbName, cmd, v.(driver.Server))
+			batch, ok := batchesByServer[entry.Downstream.Server]
+			if !ok {
+				batch = &killBatch{server: server, proxyIDs: map[int64]int64{}}
+				batchesByServer[entry.Downstream.Server] = batch
+				batches = append(batches, batch)
+			}
+			batch.cursors = append(batch.cursors, downstreamID)
+			batch.proxyIDs[downstreamID] = cursorID
+		}
+
+		for _, batch := range batches {
+			batchCmd := *cmd
+			batchCmd.Cursors = batch.cursors
+			result, err := runCommand(ctx, dbName, &batchCmd, batch.server)
 			if err != nil || !bsonutil.Ok(result) {
-				cursorsUnknown = append(cursorsUnknown, cursorID)
+				cursorsUnknown = append(cursorsUnknown, batch.proxyCursorIDs(batch.cursors)...)
 				continue
 			}
 
-			v, ok = bsonutil.Lookup(result, "cursorsKilled")
-			if ok {
-				cursorsKilled = append(cursorsKilled, v.(primitive.A)...)
-			}
-			v, ok = bsonutil.Lookup(result, "cursorsNotFound")
-			if ok {
-				cursorsNotFound = append(cursorsNotFound, v.(primitive.A)...)
-			}
-			v, ok = bsonutil.Lookup(result, "cursorsAlive")
-			if ok {
-				cursorsAlive = append(cursorsAlive, v.(primitive.A)...)
-			}
-			v, ok = bsonutil.Lookup(result, "cursorsUnknown")
-			if ok {
-				cursorsUnknown = append(cursorsUnknown, v.(primitive.A)...)
+			v, _ := bsonutil.Lookup(result, "cursorsKilled")
+			killed := batch.proxyCursorIDs(v)
+			cursorsKilled = append(cursorsKilled, killed...)
+			v, _ = bsonutil.Lookup(result, "cursorsNotFound")
+			notFound := batch.proxyCursorIDs(v)
+			cursorsNotFound = append(cursorsNotFound, notFound...)
+			v, _ = bsonutil.Lookup(result, "cursorsAlive")
+			cursorsAlive = append(cursorsAlive, batch.proxyCursorIDs(v)...)
+			v, _ = bsonutil.Lookup(result, "cursorsUnknown")
+			cursorsUnknown = append(cursorsUnknown, batch.proxyCursorIDs(v)...)
+
+			// Cursors which are gone downstream are gone for the client too
+			for _, cursorID := range append(killed, notFound...) {
+				r.CursorCache.CloseCursor(cursorID.(int64))
 			}
 		}
 
@@ -0,0 +1,108 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"go.mongodb.org/mongo-driver/mongo/description"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+
+	"github.com/wish/mongoproxy/pkg/command"
+)
+
+// defaultSessionTimeoutMinutes is the session timeout assumed until the downstream is
+// discovered (mongod's default). Drivers disable sessions for the lifetime of a
+// connection whose hello has no timeout, so hellos right after startup (or a reload)
+// can't go without one.
+const defaultSessionTimeoutMinutes = 30
+
+// LogicalSessionTimeoutMinutes returns the session timeout of the downstream; false if
+// the downstream doesn't support sessions.
+func (p *MongoPlugin) LogicalSessionTimeoutMinutes() (int64, bool) {
+	if p.t == nil {
+		return 0, false
+	}
+	desc := p.t.Description()
+	if !discovered(desc) {
+		return defaultSessionTimeoutMinutes, true
+	}
+	minutes := desc.SessionTimeoutMinutes
+	return int64(minutes), minutes > 0
+}
+
+// discovered returns whether any server of the topology has been reached
+func discovered(desc description.Topology) bool {
+	for _, s := range desc.Servers {
+		if s.Kind != description.Unknown {
+			return true
+		}
+	}
+	return false
+}
+
+// retryableWrites returns whether the downstream supports retryable writes. Drivers
+// don't send a txnNumber to a standalone mongod (which rejects it) but as we look like
+// a mongos to clients they always do.
+func (p *MongoPlugin) retryableWrites() bool {
+	desc := p.t.Description()
+	if desc.SessionTimeoutMinutes == 0 {
+		return false
+	}
+	for _, s := range desc.Servers {
+		if s.Kind == description.Standalone {
+			return false
+		}
+	}
+	return true
+}
+
+// isRetryableWrite returns whether cmd is a retryable write: a command in a session
+// with a txnNumber which isn't part of a transaction
+func isRetryableWrite(cmd command.Command) bool {
+	session := cmd.GetSession()
+	return session != nil && session.TxnNumber != nil && !session.InTransaction()
+}
+
+// retryableWriteError adds the RetryableWriteError label to errors of retryable writes
+// that drivers may retry: network errors, retryable codes and failures to select a
+// server. Other errors (e.g. invalid commands or the client going away) are returned
+// unchanged.
+func retryableWriteError(cmd command.Command, err error) error {
+	if !isRetryableWrite(cmd) {
+		return err
+	}
+
+	switch e := err.(type) {
+	case driver.Error:
+		if e.RetryableWrite(nil) {
+			e.Labels = appendLabel(e.Labels, driver.RetryableWriteError)
+		}
+		return e
+	case driver.WriteCommandError:
+		if e.Retryable(nil) {
+			e.Labels = appendLabel(e.Labels, driver.RetryableWriteError)
+		}
+		return e
+	default:
+		if !retryableNetworkError(err) {
+			return err
+		}
+		return driver.Error{Message: err.Error(), Labels: []string{driver.RetryableWriteError}, Wrapped: err}
+	}
+}
+
+// retryableNetworkError returns whether err (one not returned by the downstream) is a
+// network error or a failure to select a server, after which the write may be retried.
+// The context being done (the client going away or its time limit passing) isn't.
+func retryableNetworkError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var connErr topology.ConnectionError
+	var selectionErr topology.ServerSelectionError
+	var netErr net.Error
+	return errors.As(err, &connErr) || errors.As(err, &selectionErr) || errors.Is(err, topology.ErrServerSelectionTimeout) || errors.As(err, &netErr)
+}
@@ -0,0 +1,112 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+
+	"github.com/wish/mongoproxy/pkg/command"
+)
+
+func TestRetryableWriteError(t *testing.T) {
+	lsid := bson.D{{"id", primitive.Binary{Subtype: 4, Data: []byte("0123456789abcdef")}}}
+	insert := transactionCommand(t, bson.D{
+		{"insert", "foo"},
+		{"documents", bson.A{bson.D{{"_id", 1}}}},
+		{"lsid", lsid},
+		{"txnNumber", int64(1)},
+		{"$db", "test"},
+	})
+	// Without a txnNumber the write can't be retried safely
+	plain := transactionCommand(t, bson.D{
+		{"insert", "foo"},
+		{"documents", bson.A{bson.D{{"_id", 1}}}},
+		{"lsid", lsid},
+		{"$db", "test"},
+	})
+
+	networkErr := driver.Error{Message: "connection reset", Labels: []string{driver.NetworkError}}
+	notMaster := driver.Error{Code: 10107, Name: "NotMaster"}
+	duplicateKey := driver.Error{Code: 11000, Name: "DuplicateKey"}
+	wcErr := driver.WriteCommandError{WriteConcernError: &driver.WriteConcernError{Code: 91, Name: "ShutdownInProgress"}}
+	wcTimeout := driver.WriteCommandError{WriteConcernError: &driver.WriteConcernError{Code: 64, Name: "WriteConcernFailed"}}
+
+	tests := []struct {
+		name   string
+		cmd    command.Command
+		err    error
+		labels []string
+	}{
+		{"network error", insert, networkErr, []string{driver.NetworkError, driver.RetryableWriteError}},
+		{"retryable code", insert, notMaster, []string{driver.RetryableWriteError}},
+		{"not retryable", insert, duplicateKey, nil},
+		{"write concern", insert, wcErr, []string{driver.RetryableWriteError}},
+		{"write concern timeout", insert, wcTimeout, nil},
+		{"server selection", insert, topology.ServerSelectionError{Wrapped: topology.ErrServerSelectionTimeout}, []string{driver.RetryableWriteError}},
+		{"connection", insert, topology.ConnectionError{ConnectionID: "1", Wrapped: errors.New("connection refused")}, []string{driver.RetryableWriteError}},
+		{"not retryable write", plain, networkErr, []string{driver.NetworkError}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, err := ErrorToDoc(retryableWriteError(test.cmd, test.err))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var labels []string
+			for _, e := range d {
+				if e.Key == "errorLabels" {
+					labels = e.Value.([]string)
+				}
+			}
+			if !reflect.DeepEqual(labels, test.labels) {
+				t.Fatalf("expected labels %v, got %v", test.labels, labels)
+			}
+		})
+	}
+}
+
+// TestRetryableWriteErrorUnlabeled checks that errors other than network and server
+// selection errors are returned unchanged, without the RetryableWriteError label
+func TestRetryableWriteErrorUnlabeled(t *testing.T) {
+	insert := transactionCommand(t, bson.D{
+		{"insert", "foo"},
+		{"documents", bson.A{bson.D{{"_id", 1}}}},
+		{"lsid", bson.D{{"id", primitive.Binary{Subtype: 4, Data: []byte("0123456789abcdef")}}}},
+		{"txnNumber", int64(1)},
+		{"$db", "test"},
+	})
+
+	for name, err := range map[string]error{
+		"marshal":            errors.New("cannot marshal type"),
+		"canceled":           context.Canceled,
+		"deadline":           fmt.Errorf("error running command: %w", context.DeadlineExceeded),
+		"canceled selection": topology.ServerSelectionError{Wrapped: context.Canceled},
+		"pool wait queue":    topology.WaitQueueTimeoutError{},
+	} {
+		if _, ok := retryableWriteError(insert, err).(driver.Error); ok {
+			t.Errorf("%s: error was labeled", name)
+		}
+	}
+}
+
+// TestSessionTimeoutBeforeDiscovery checks that sessions are advertised to clients
+// connecting before any downstream server has been reached
+func TestSessionTimeoutBeforeDiscovery(t *testing.T) {
+	p := &MongoPlugin{}
+	if err := p.Configure(bson.D{{"mongoAddr", "mongodb://127.0.0.1:1"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close(context.TODO())
+
+	if minutes, ok := p.LogicalSessionTimeoutMinutes(); !ok || minutes != defaultSessionTimeoutMinutes {
+		t.Fatalf("expected the default session timeout, got %d %v", minutes, ok)
+	}
+}
@@ -0,0 +1,249 @@
+package mongo
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/address"
+	"go.mongodb.org/mongo-driver/mongo/description"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var (
+	// TransactionPinTimeout is how long after its last command a transaction stays pinned
+	// to its server. This should be longer than the downstream transactionLifetimeLimitSeconds
+	// (60s by default) after which the transaction is aborted anyways.
+	TransactionPinTimeout = 2 * time.Minute
+)
+
+// transactionPin is the server a session's transaction was started on
+type transactionPin struct {
+	txnNumber int64
+	server    address.Address
+	lastUsed  time.Time
+}
+
+// transactions pins the transaction of each session to the server the transaction was
+// started on; all the commands of a transaction must be sent to the same server.
+type transactions struct {
+	lock      sync.Mutex
+	pins      map[string]*transactionPin
+	lastSweep time.Time
+}
+
+func newTransactions() *transactions {
+	return &transactions{
+		pins:      make(map[string]*transactionPin),
+		lastSweep: time.Now(),
+	}
+}
+
+var (
+	clusterTransactionsLock sync.Mutex
+	clusterTransactions     = make(map[string]*transactions)
+)
+
+// transactionsFor returns the transaction pins of the cluster at mongoAddr. These are
+// shared by all the plugins for the cluster, so that transactions stay pinned when a
+// config reload replaces the plugin.
+func transactionsFor(mongoAddr string) *transactions {
+	clusterTransactionsLock.Lock()
+	defer clusterTransactionsLock.Unlock()
+
+	t, ok := clusterTransactions[mongoAddr]
+	if !ok {
+		t = newTransactions()
+		clusterTransactions[mongoAddr] = t
+	}
+	return t
+}
+
+// get returns the server the transaction is pinned to
+func (t *transactions) get(key string, txnNumber int64) (address.Address, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	pin, ok := t.pins[key]
+	if !ok || pin.txnNumber != txnNumber {
+		return "", false
+	}
+	pin.lastUsed = time.Now()
+	return pin.server, true
+}
+
+// pin pins the transaction to server, replacing any previous transaction of the session
+func (t *transactions) pin(key string, txnNumber int64, server address.Address) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	t.pins[key] = &transactionPin{txnNumber: txnNumber, server: server, lastUsed: now}
+
+	// Drop the pins of abandoned transactions
+	if now.Sub(t.lastSweep) < TransactionPinTimeout/2 {
+		return
+	}
+	t.lastSweep = now
+	for k, pin := range t.pins {
+		if now.Sub(pin.lastUsed) > TransactionPinTimeout {
+			delete(t.pins, k)
+		}
+	}
+}
+
+// unpin removes the pin of the session's transaction
+func (t *transactions) unpin(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.pins, key)
+}
+
+// count returns the number of pinned transactions
+func (t *transactions) count() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.pins)
+}
+
+// transactionKey returns the session key and txnNumber of a command in a transaction
+func transactionKey(cmd command.Command) (string, int64, bool) {
+	session := cmd.GetSession()
+	if session == nil || !session.InTransaction() {
+		return "", 0, false
+	}
+	key, ok := plugins.LSIDKey(session.LSID)
+	if !ok {
+		return "", 0, false
+	}
+	return key, *session.TxnNumber, true
+}
+
+// transactionServer returns the server cmd must be sent to as part of a transaction
+// (nil if cmd isn't part of a transaction or starts a new one)
+func (p *MongoPlugin) transactionServer(cmd command.Command) (driver.Server, error) {
+	key, txnNumber, ok := transactionKey(cmd)
+	if !ok || bsonutil.GetBoolDefault(cmd.GetSession().StartTransaction, false) {
+		return nil, nil
+	}
+
+	addr, ok := p.txns.get(key, txnNumber)
+	if !ok {
+		switch cmd.(type) {
+		// mongos can commit (or abort) a transaction it didn't run using the recoveryToken
+		case *command.CommitTransaction, *command.AbortTransaction:
+			return nil, nil
+		}
+		return nil, noSuchTransaction(txnNumber, "")
+	}
+
+	server, err := p.t.FindServer(description.Server{Addr: addr})
+	if err != nil || server == nil {
+		return nil, noSuchTransaction(txnNumber, " (server "+addr.String()+" is no longer available)")
+	}
+	return server, nil
+}
+
+// trackTransaction updates the pin of the transaction cmd (sent to server) is part of,
+// and records it on the proxy's session (if any)
+func (p *MongoPlugin) trackTransaction(cmd command.Command, server driver.Server, session *plugins.Session) {
+	key, txnNumber, ok := transactionKey(cmd)
+	if !ok {
+		return
+	}
+
+	switch {
+	case bsonutil.GetBoolDefault(cmd.GetSession().StartTransaction, false):
+		addr := serverAddress(server)
+		p.txns.pin(key, txnNumber, addr)
+		if session != nil {
+			session.SetPinnedServer(addr.String())
+		}
+	default:
+		if _, ok := cmd.(*command.AbortTransaction); ok {
+			p.txns.unpin(key)
+			if session != nil {
+				session.SetPinnedServer("")
+			}
+		}
+	}
+}
+
+// endSessions drops the pins of the ended sessions
+func (p *MongoPlugin) endSessions(cmd *command.EndSessions) {
+	for _, doc := range cmd.SessionIDs {
+		if key := plugins.SessionIDKey(doc); key != "" {
+			p.txns.unpin(key)
+		}
+	}
+}
+
+func noSuchTransaction(txnNumber int64, reason string) error {
+	return driver.Error{
+		Code:    int32(mongoerror.NoSuchTransaction),
+		Name:    mongoerror.NoSuchTransaction.String(),
+		Message: fmt.Sprintf("Transaction %d has been aborted%s", txnNumber, reason),
+		Labels:  []string{driver.TransientTransactionError},
+	}
+}
+
+// transactionError adds the error labels that drivers rely on to retry transactions to
+// err, the result of running cmd. The driver only adds these for transactions it runs
+// itself (which we don't as each command is sent on its own).
+func transactionError(cmd command.Command, err error) error {
+	if _, _, ok := transactionKey(cmd); !ok {
+		return err
+	}
+
+	switch cmd.(type) {
+	// Errors from abortTransaction are ignored by drivers
+	case *command.AbortTransaction:
+		return err
+
+	// If the commit failed in a way that it may have been applied the result is unknown
+	case *command.CommitTransaction:
+		switch e := err.(type) {
+		case driver.Error:
+			if e.NetworkError() || e.RetryableWrite(nil) || e.Code == int32(mongoerror.MaxTimeMSExpired) {
+				e.Labels = appendLabel(e.Labels, driver.UnknownTransactionCommitResult)
+			}
+			return e
+		case driver.WriteCommandError:
+			if e.WriteConcernError != nil {
+				e.Labels = appendLabel(e.Labels, driver.UnknownTransactionCommitResult)
+			}
+			return e
+		default:
+			// e.g. server selection errors
+			return driver.Error{Message: err.Error(), Labels: []string{driver.UnknownTransactionCommitResult}, Wrapped: err}
+		}
+
+	// If the command didn't reach the server the transaction can be retried
+	default:
+		switch e := err.(type) {
+		case driver.Error:
+			if e.NetworkError() {
+				e.Labels = appendLabel(e.Labels, driver.TransientTransactionError)
+			}
+			return e
+		case driver.WriteCommandError:
+			return e
+		default:
+			return driver.Error{Message: err.Error(), Labels: []string{driver.TransientTransactionError}, Wrapped: err}
+		}
+	}
+}
+
+func appendLabel(labels []string, label string) []string {
+	for _, l := range labels {
+		if l == label {
+			return labels
+		}
+	}
+	return append(labels, label)
+}
@@ -0,0 +1,181 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/address"
+	"go.mongodb.org/mongo-driver/mongo/description"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+
+	"github.com/wish/mongoproxy/pkg/command"
+)
+
+func transactionCommand(t *testing.T, d bson.D) command.Command {
+	cmd, ok := command.GetCommand(d[0].Key)
+	if !ok {
+		t.Fatalf("unknown command %s", d[0].Key)
+	}
+	if err := cmd.FromBSOND(d); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func TestTransactions(t *testing.T) {
+	lsid := bson.D{{"id", primitive.Binary{Subtype: 4, Data: []byte("0123456789abcdef")}}}
+
+	start := transactionCommand(t, bson.D{
+		{"insert", "foo"},
+		{"documents", bson.A{bson.D{{"_id", 1}}}},
+		{"lsid", lsid},
+		{"txnNumber", int64(1)},
+		{"startTransaction", true},
+		{"autocommit", false},
+		{"$db", "test"},
+	})
+	key, txnNumber, ok := transactionKey(start)
+	if !ok || txnNumber != 1 {
+		t.Fatalf("expected command in transaction 1, got %v %d", ok, txnNumber)
+	}
+
+	// Commands outside of a transaction aren't pinned (even in a session)
+	retryable := transactionCommand(t, bson.D{
+		{"insert", "foo"},
+		{"documents", bson.A{bson.D{{"_id", 1}}}},
+		{"lsid", lsid},
+		{"txnNumber", int64(1)},
+		{"$db", "test"},
+	})
+	if _, _, ok := transactionKey(retryable); ok {
+		t.Fatal("retryable write is not part of a transaction")
+	}
+
+	txns := newTransactions()
+	txns.pin(key, 1, address.Address("a:27017"))
+	if addr, ok := txns.get(key, 1); !ok || addr != "a:27017" {
+		t.Fatalf("expected transaction pinned to a:27017, got %v %v", ok, addr)
+	}
+	if _, ok := txns.get(key, 2); ok {
+		t.Fatal("a different transaction of the session must not be pinned")
+	}
+
+	// The next transaction replaces the pin
+	txns.pin(key, 2, address.Address("b:27017"))
+	if addr, ok := txns.get(key, 2); !ok || addr != "b:27017" {
+		t.Fatalf("expected transaction pinned to b:27017, got %v %v", ok, addr)
+	}
+	txns.unpin(key)
+	if _, ok := txns.get(key, 2); ok {
+		t.Fatal("transaction still pinned after unpin")
+	}
+}
+
+func TestTransactionError(t *testing.T) {
+	lsid := bson.D{{"id", primitive.Binary{Subtype: 4, Data: []byte("0123456789abcdef")}}}
+	find := transactionCommand(t, bson.D{
+		{"find", "foo"},
+		{"lsid", lsid},
+		{"txnNumber", int64(1)},
+		{"autocommit", false},
+		{"$db", "test"},
+	})
+	commit := transactionCommand(t, bson.D{
+		{"commitTransaction", 1},
+		{"lsid", lsid},
+		{"txnNumber", int64(1)},
+		{"autocommit", false},
+		{"$db", "admin"},
+	})
+	outside := transactionCommand(t, bson.D{{"find", "foo"}, {"$db", "test"}})
+
+	networkErr := driver.Error{Message: "connection reset", Labels: []string{driver.NetworkError}}
+	writeConflict := driver.Error{Code: 112, Name: "WriteConflict", Labels: []string{driver.TransientTransactionError}}
+	wcErr := driver.WriteCommandError{WriteConcernError: &driver.WriteConcernError{Code: 64, Name: "WriteConcernFailed"}}
+
+	tests := []struct {
+		name   string
+		cmd    command.Command
+		err    error
+		labels []string
+	}{
+		{"network error", find, networkErr, []string{driver.NetworkError, driver.TransientTransactionError}},
+		{"server selection", find, errors.New("server selection timeout"), []string{driver.TransientTransactionError}},
+		{"server label", find, writeConflict, []string{driver.TransientTransactionError}},
+		{"commit network error", commit, networkErr, []string{driver.NetworkError, driver.UnknownTransactionCommitResult}},
+		{"commit write concern", commit, wcErr, []string{driver.UnknownTransactionCommitResult}},
+		{"commit server selection", commit, errors.New("server selection timeout"), []string{driver.UnknownTransactionCommitResult}},
+		{"outside transaction", outside, networkErr, []string{driver.NetworkError}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, err := ErrorToDoc(transactionError(test.cmd, test.err))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var labels []string
+			for _, e := range d {
+				if e.Key == "errorLabels" {
+					labels = e.Value.([]string)
+				}
+			}
+			if !reflect.DeepEqual(labels, test.labels) {
+				t.Fatalf("expected labels %v, got %v", test.labels, labels)
+			}
+		})
+	}
+}
+
+func TestTransactionsAcrossReload(t *testing.T) {
+	lsid := bson.D{{"id", primitive.Binary{Subtype: 4, Data: []byte("reload0123456789")}}}
+	conf := bson.D{{"mongoAddr", "mongodb://127.0.0.1:1,127.0.0.1:2"}}
+	configure := func() *MongoPlugin {
+		p := &MongoPlugin{}
+		if err := p.Configure(conf); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	// A transaction is started through the plugin before the reload
+	old := configure()
+	start := transactionCommand(t, bson.D{
+		{"insert", "foo"},
+		{"documents", bson.A{bson.D{{"_id", 1}}}},
+		{"lsid", lsid},
+		{"txnNumber", int64(1)},
+		{"startTransaction", true},
+		{"autocommit", false},
+		{"$db", "test"},
+	})
+	server, err := old.t.FindServer(description.Server{Addr: address.Address("127.0.0.1:2")})
+	if err != nil || server == nil {
+		t.Fatalf("server not found: %v", err)
+	}
+	old.trackTransaction(start, server, nil)
+
+	// The reload replaces the plugin, and the transaction continues through the new one
+	// on the server it was started on
+	reloaded := configure()
+	if err := old.Close(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close(context.TODO())
+
+	commit := transactionCommand(t, bson.D{
+		{"commitTransaction", 1},
+		{"lsid", lsid},
+		{"txnNumber", int64(1)},
+		{"autocommit", false},
+		{"$db", "admin"},
+	})
+	pinned, err := reloaded.transactionServer(commit)
+	if err != nil || serverAddress(pinned) != "127.0.0.1:2" {
+		t.Fatalf("expected transaction pinned to 127.0.0.1:2 after reload, got %v %v", serverAddress(pinned), err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/address"
 	"go.mongodb.org/mongo-driver/x/mongo/driver"
 	"go.mongodb.org/mongo-driver/x/mongo/driver/operation"
 	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
@@ -163,3 +164,15 @@ func extractServer(c *operation.Command) driver.Server {
 	}
 	return d.Interface().(driver.Server)
 }
+
+// serverAddress returns the address of a server returned from extractServer
+func serverAddress(s driver.Server) address.Address {
+	switch s := s.(type) {
+	case *topology.SelectedServer:
+		return s.Server.Description().Addr
+	case *topology.Server:
+		return s.Description().Addr
+	default:
+		return ""
+	}
+}
@@ -3,7 +3,9 @@ package schema
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -62,7 +64,10 @@ type SchemaPluginConfig struct {
 type SchemaPlugin struct {
 	conf SchemaPluginConfig
 
-	s atomic.Value
+	s    atomic.Value
+	stop chan struct{}
+
+	loadState plugins.LoadState
 }
 
 func (p *SchemaPlugin) Name() string { return Name }
@@ -76,7 +81,9 @@ func (p *SchemaPlugin) GetSchema() *ClusterSchema {
 }
 
 func (p *SchemaPlugin) LoadSchema() (err error) {
+	var version string
 	defer func() {
+		p.loadState.Record(version, err)
 		if err != nil {
 			schemaUpdates.WithLabelValues("false").Add(1)
 		} else {
@@ -95,7 +102,9 @@ func (p *SchemaPlugin) LoadSchema() (err error) {
 	}
 
 	p.s.Store(&schema)
-	schemaVersion.Set(float64(xxhash.Sum64(b)))
+	hash := xxhash.Sum64(b)
+	schemaVersion.Set(float64(hash))
+	version = strconv.FormatUint(hash, 16)
 
 	return nil
 }
@@ -118,16 +127,51 @@ func (p *SchemaPlugin) Configure(d bson.D) error {
 		return err
 	}
 
+	return nil
+}
+
+// Start starts the background reload of the schema
+func (p *SchemaPlugin) Start(_ context.Context) error {
+	p.stop = make(chan struct{})
 	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
 		for {
-			p.LoadSchema()
-			time.Sleep(5 * time.Minute)
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.LoadSchema()
+			}
 		}
 	}()
 
 	return nil
 }
 
+// Close stops the background reload of the schema
+func (p *SchemaPlugin) Close(_ context.Context) error {
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	return nil
+}
+
+// State returns the state of the loaded schema
+func (p *SchemaPlugin) State() bson.D {
+	return append(bson.D{{"schemaPath", p.conf.SchemaPath}}, p.loadState.State()...)
+}
+
+// HealthCheck returns an error if the last (re)load of the schema failed; the
+// previously loaded schema is still being enforced
+func (p *SchemaPlugin) HealthCheck(ctx context.Context) error {
+	if err := p.loadState.Err(); err != nil {
+		return fmt.Errorf("error loading schema: %v", err)
+	}
+	return nil
+}
+
 // Process is the function executed when a message is called in the pipeline.
 func (p *SchemaPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
 	switch cmd := r.Command.(type) {
@@ -0,0 +1,123 @@
+package plugins
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+)
+
+// SessionKey returns the key of a session from the "id" of its lsid
+func SessionKey(id interface{}) string {
+	if b, ok := id.(primitive.Binary); ok {
+		return string(b.Data)
+	}
+	return fmt.Sprint(id)
+}
+
+// LSIDKey returns the key of the session lsid; false if lsid has no id
+func LSIDKey(lsid bson.D) (string, bool) {
+	id, ok := bsonutil.Lookup(lsid, "id")
+	if !ok {
+		return "", false
+	}
+	return SessionKey(id), true
+}
+
+// SessionIDKey returns the key of a session from its lsid document as raw BSON (e.g.
+// those of endSessions); "" if it has no id
+func SessionIDKey(doc bsoncore.Document) string {
+	id, err := doc.LookupErr("id")
+	if err != nil {
+		return ""
+	}
+	var v interface{}
+	rv := bson.RawValue{Type: id.Type, Value: id.Data}
+	if err := rv.Unmarshal(&v); err != nil {
+		return ""
+	}
+	return SessionKey(v)
+}
+
+// Session is the state the proxy tracks for a logical session (lsid) of a client
+type Session struct {
+	Key  string
+	LSID bson.D
+	// Owner is the client that started the session; only clients coauthorized with
+	// the owner may use it
+	Owner *CursorOwner
+
+	lock     sync.Mutex
+	lastUsed time.Time
+	cursors  map[int64]struct{}
+	server   string
+}
+
+// NewSession returns the session lsid (with key) started by cc
+func NewSession(key string, lsid bson.D, cc *ClientConnection) *Session {
+	return &Session{
+		Key:      key,
+		LSID:     lsid,
+		Owner:    NewCursorOwner(cc, lsid),
+		lastUsed: time.Now(),
+		cursors:  make(map[int64]struct{}),
+	}
+}
+
+// Touch marks the session as used now
+func (s *Session) Touch() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastUsed = time.Now()
+}
+
+// LastUsed returns when the session was last used
+func (s *Session) LastUsed() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lastUsed
+}
+
+// AddCursor records a cursor opened in the session
+func (s *Session) AddCursor(cursorID int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cursors[cursorID] = struct{}{}
+}
+
+// RemoveCursor removes a cursor from the session
+func (s *Session) RemoveCursor(cursorID int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.cursors, cursorID)
+}
+
+// Cursors returns the cursors opened in the session
+func (s *Session) Cursors() []int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	cursors := make([]int64, 0, len(s.cursors))
+	for id := range s.cursors {
+		cursors = append(cursors, id)
+	}
+	return cursors
+}
+
+// SetPinnedServer sets the server the session's transaction is pinned to ("" if none)
+func (s *Session) SetPinnedServer(server string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.server = server
+}
+
+// PinnedServer returns the server the session's transaction is pinned to ("" if none)
+func (s *Session) PinnedServer() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.server
+}
@@ -3,18 +3,20 @@ package mongoproxy
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"reflect"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/ReneKroon/ttlcache/v2"
 	"github.com/getsentry/sentry-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -27,6 +29,7 @@ import (
 	"github.com/wish/mongoproxy/pkg/bsonutil"
 	"github.com/wish/mongoproxy/pkg/command"
 	"github.com/wish/mongoproxy/pkg/models"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
 	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
 	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
 	"github.com/wish/mongoproxy/pkg/mongowire"
@@ -48,9 +51,19 @@ var (
 		Name: "mongoproxy_client_message_total",
 		Help: "The total number of messages from clients",
 	}, []string{"client_ip", "opcode"})
+	configReloadCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_config_reload_total",
+		Help: "The total number of config reloads",
+	}, []string{"success"})
 
 	ErrServerClosed = errors.New("server closed")
 	SKIP_RECOVER    = false
+
+	tlsHandshakeTimeout = 10 * time.Second
+
+	// defaultSessionTimeout is the logicalSessionTimeoutMinutes advertised if no plugin
+	// has a downstream to take it from (mongod's default)
+	defaultSessionTimeout = 30
 )
 
 func init() {
@@ -65,18 +78,19 @@ func init() {
 	}
 }
 
+// NewProxy returns a proxy for the given config. If l is non-nil it is used as the
+// default listener; more listeners can be added with AddListener.
 func NewProxy(l net.Listener, cfg *config.Config) (*Proxy, error) {
-	// Create plugin chain
-	ps, err := cfg.GetPlugins()
-	if err != nil {
-		return nil, err
-	}
-
 	p := &Proxy{
-		l:           l,
-		cfg:         cfg,
-		doneChan:    make(chan struct{}),
-		cursorCache: ttlcache.NewCache(),
+		doneChan:  make(chan struct{}),
+		topology:  newTopology(),
+		stats:     newStats(),
+		admission: newAdmission(cfg),
+		sessions:  newSessionRegistry(),
+	}
+	p.cursorCache = newCursorCache(cfg, p.killCursor)
+	if l != nil {
+		p.AddListener("", l)
 	}
 
 	// Create internal ClientConnection for "admin" tasks
@@ -85,46 +99,25 @@ func NewProxy(l net.Listener, cfg *config.Config) (*Proxy, error) {
 	p.internalCC.Addr, _ = net.ResolveIPAddr("ip", "127.0.0.1")
 
 	if cfg.InternalIdentity != nil {
-		p.internalCC.Identities = []plugins.ClientIdentity{cfg.InternalIdentity}
+		p.internalCC.SetIdentities([]plugins.ClientIdentity{cfg.InternalIdentity})
 	}
 
-	p.pipe = plugins.BuildPipeline(ps, p.baseRequestHandler)
-
-	// Set up cursorCache
-	p.cursorCache.SetTTL(p.cfg.IdleCursorTimeout) // default TTL -- config
-	p.cursorCache.SetLoaderFunction(func(key string) (interface{}, time.Duration, error) {
-		cursorID, err := strconv.ParseInt(key, 10, 64)
-		if err != nil {
-			return nil, time.Duration(0), err
-		}
-
-		return plugins.NewCursorCacheEntry(cursorID), time.Duration(0), nil
-	})
-	// expiration handler to send killCursor commands
-	p.cursorCache.SetExpirationReasonCallback(func(key string, reason ttlcache.EvictionReason, value interface{}) {
-		logrus.Tracef("expire cursor %s", key)
-		i, err := strconv.ParseInt(key, 10, 64)
-		if err != nil {
-			return
-		}
-
-		// If the cursor expired (we timed out waiting) we want to kill the downstream cursor as we remove it from the cache
-		if reason == ttlcache.Expired {
-			p.HandleMongo(context.TODO(), &plugins.Request{CursorCache: p, CC: p.internalCC}, bson.D{
-				{"killCursors", "admin"},
-				{"cursors", primitive.A{i}},
-			})
-		}
-	})
+	// Create plugin chain
+	pl, err := p.loadPipeline(cfg)
+	if err != nil {
+		return nil, err
+	}
+	p.pipeline.Store(pl)
 
 	return p, nil
 }
 
 type Proxy struct {
-	l   net.Listener // Listener for incoming client connections
-	cfg *config.Config
+	listeners []*listener // Listeners for incoming client connections
 
-	pipe plugins.PipelineFunc
+	// pipeline is the current *pipeline; it is swapped out on Reload
+	pipeline   atomic.Value
+	reloadLock sync.Mutex
 
 	doneChan chan struct{}
 
@@ -134,26 +127,242 @@ type Proxy struct {
 	// Cursor cache for plugins.CursorCacheEntry this is stored at the proxy
 	// level because both the core proxy needs it (to handle OP_QUERY and OP_GETMORE)
 	// as well as the plugins (e.g. mongo)
-	cursorCache *ttlcache.Cache
+	cursorCache *cursorCache
 
 	internalCC *plugins.ClientConnection
+
+	// requestID is the last requestID used for a reply without a request
+	requestID int32
+	// connID is the id of the last client connection
+	connID int64
+	// reloadFunc reloads the config from its source (see SetReloadFunc)
+	reloadFunc func() error
+
+	topology  *topology
+	stats     *stats
+	admission *admission
+	sessions  *sessionRegistry
 }
 
-func (p *Proxy) GetCursor(cursorID int64) *plugins.CursorCacheEntry {
-	v, err := p.cursorCache.Get(strconv.FormatInt(cursorID, 10))
-	if err == ttlcache.ErrNotFound {
-		panic("can't get cursor")
+// listener is a client listener. Clients of a named listener use the listener's
+// plugin pipeline if it has one.
+type listener struct {
+	name string
+	l    net.Listener
+}
+
+// pipeline is a config and the plugin pipeline built from it. These are swapped
+// together on reload so a request sees a consistent view of both.
+type pipeline struct {
+	cfg     *config.Config
+	plugins []plugins.Plugin
+	pipe    plugins.PipelineFunc
+	// listenerPipes are the pipelines of listeners which override the plugins
+	listenerPipes map[string]plugins.PipelineFunc
+
+	// inflight tracks the requests running on this pipeline so that it can be
+	// drained before its plugins are closed
+	inflight sync.WaitGroup
+	lock     sync.RWMutex
+	closed   bool
+}
+
+// acquire marks a request as running on the pipeline. It returns false if the
+// pipeline has been closed.
+func (pl *pipeline) acquire() bool {
+	pl.lock.RLock()
+	defer pl.lock.RUnlock()
+	if pl.closed {
+		return false
+	}
+	pl.inflight.Add(1)
+	return true
+}
+
+func (pl *pipeline) release() {
+	pl.inflight.Done()
+}
+
+// close waits for all running requests to finish and then closes the plugins
+func (pl *pipeline) close(ctx context.Context) error {
+	pl.lock.Lock()
+	if pl.closed {
+		pl.lock.Unlock()
+		return nil
+	}
+	pl.closed = true
+	pl.lock.Unlock()
+
+	pl.inflight.Wait()
+
+	return plugins.ClosePlugins(ctx, pl.plugins)
+}
+
+// logicalSessionTimeout returns the session timeout to advertise to clients: the
+// lowest of the plugins implementing plugins.SessionSupporter (defaultSessionTimeout
+// if there are none). This returns false if any of them doesn't support sessions.
+func (pl *pipeline) logicalSessionTimeout() (int64, bool) {
+	timeout := int64(defaultSessionTimeout)
+	found := false
+	for _, p := range pl.plugins {
+		s, ok := p.(plugins.SessionSupporter)
+		if !ok {
+			continue
+		}
+		minutes, ok := s.LogicalSessionTimeoutMinutes()
+		if !ok {
+			return 0, false
+		}
+		if !found || minutes < timeout {
+			timeout = minutes
+		}
+		found = true
 	}
+	return timeout, true
+}
 
-	return v.(*plugins.CursorCacheEntry)
+// pipeFor returns the pipeline for clients of the named listener
+func (pl *pipeline) pipeFor(listener string) plugins.PipelineFunc {
+	if pipe, ok := pl.listenerPipes[listener]; ok {
+		return pipe
+	}
+	return pl.pipe
+}
+
+func (p *Proxy) newPipeline(cfg *config.Config, ps []plugins.Plugin) *pipeline {
+	return &pipeline{
+		cfg:     cfg,
+		plugins: ps,
+		pipe:    plugins.BuildPipeline(ps, p.baseRequestHandler),
+	}
+}
+
+// loadPipeline configures and starts the plugins (including those of listeners
+// which override them) for cfg
+func (p *Proxy) loadPipeline(cfg *config.Config) (*pipeline, error) {
+	ps, err := cfg.GetPlugins()
+	if err != nil {
+		return nil, err
+	}
+	pl := p.newPipeline(cfg, ps)
+
+	for _, lc := range cfg.GetListeners() {
+		if lc.Plugins == nil {
+			continue
+		}
+		lps, err := lc.GetPlugins()
+		if err != nil {
+			plugins.ClosePlugins(context.TODO(), pl.plugins)
+			return nil, fmt.Errorf("listener %s: %v", lc.Name, err)
+		}
+		if pl.listenerPipes == nil {
+			pl.listenerPipes = make(map[string]plugins.PipelineFunc)
+		}
+		pl.listenerPipes[lc.Name] = plugins.BuildPipeline(lps, p.baseRequestHandler)
+		pl.plugins = append(pl.plugins, lps...)
+	}
+
+	if err := plugins.StartPlugins(context.TODO(), pl.plugins); err != nil {
+		return nil, err
+	}
+
+	return pl, nil
+}
+
+func (p *Proxy) getPipeline() *pipeline {
+	return p.pipeline.Load().(*pipeline)
+}
+
+// acquirePipeline returns the current pipeline, marking a request as running on
+// it. The caller must release the pipeline once the request is complete.
+func (p *Proxy) acquirePipeline() (*pipeline, error) {
+	for {
+		pl := p.getPipeline()
+		if pl.acquire() {
+			return pl, nil
+		}
+		// If the closed pipeline is still the current one the proxy is shut down,
+		// otherwise it was replaced by a reload and we retry with the new one
+		if p.getPipeline() == pl {
+			return nil, ErrServerClosed
+		}
+	}
+}
+
+// Config returns the currently active config
+func (p *Proxy) Config() *config.Config {
+	return p.getPipeline().cfg
+}
+
+// Reload configures a new set of plugins from cfg and, if they all configure
+// successfully, atomically swaps them in for the current pipeline. Requests
+// already in flight finish on the old pipeline. Settings of the listeners
+// (e.g. BindAddr, TLS) are not changed by a reload.
+func (p *Proxy) Reload(cfg *config.Config) (err error) {
+	defer func() {
+		if err != nil {
+			configReloadCounter.WithLabelValues("false").Inc()
+		} else {
+			configReloadCounter.WithLabelValues("true").Inc()
+		}
+	}()
+
+	p.reloadLock.Lock()
+	defer p.reloadLock.Unlock()
+
+	pl, err := p.loadPipeline(cfg)
+	if err != nil {
+		return err
+	}
+
+	p.cursorCache.configure(cfg)
+	p.admission.configure(cfg)
+	old := p.getPipeline()
+	p.pipeline.Store(pl)
+	// The config may have changed what we respond to hello with
+	p.topology.increment()
+
+	// Close the old plugins once the requests still using them are done
+	go func() {
+		if err := old.close(context.TODO()); err != nil {
+			logrus.Errorf("Error closing plugins after reload: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// NewCursor mints a random cursor ID (as mongod does) for a cursor opened downstream
+func (p *Proxy) NewCursor() *plugins.CursorCacheEntry {
+	return p.cursorCache.newCursor()
+}
+
+func (p *Proxy) GetCursor(cursorID int64) *plugins.CursorCacheEntry {
+	return p.cursorCache.get(cursorID)
 }
 
 func (p *Proxy) CloseCursor(cursorID int64) {
-	p.cursorCache.Remove(strconv.FormatInt(cursorID, 10))
+	p.cursorCache.close(cursorID)
 }
 
+// killCursor kills the downstream cursor (through the pipeline) and closes it
+func (p *Proxy) killCursor(cursorID int64) {
+	defer p.CloseCursor(cursorID)
+	p.HandleMongo(context.TODO(), &plugins.Request{CursorCache: p, CC: p.internalCC}, bson.D{
+		{"killCursors", "admin"},
+		{"cursors", primitive.A{cursorID}},
+	})
+}
+
+// AddListener adds a listener to accept client connections on; clients of a named
+// listener use the listener's plugins (if configured). This must be called before Serve.
+func (p *Proxy) AddListener(name string, l net.Listener) {
+	p.listeners = append(p.listeners, &listener{name: name, l: l})
+}
+
+// Addr returns the address of the first listener
 func (p *Proxy) Addr() string {
-	return p.l.Addr().String()
+	return p.listeners[0].l.Addr().String()
 }
 
 func (p *Proxy) baseRequestHandler(ctx context.Context, r *plugins.Request) (bson.D, error) {
@@ -168,10 +377,14 @@ func (p *Proxy) baseRequestHandler(ctx context.Context, r *plugins.Request) (bso
 		users := make(map[string]struct{})
 		roles := make(map[string]struct{})
 
-		for _, identity := range r.CC.Identities {
-			userKey := identity.User() + "." + "admin"
+		for _, identity := range r.CC.Identities() {
+			db := identity.DB()
+			if db == "" {
+				db = "admin"
+			}
+			userKey := identity.User() + "." + db
 			if _, ok := users[userKey]; !ok {
-				authenticatedUsers = append(authenticatedUsers, models.AuthenticatedUser{User: identity.User(), DB: "admin"}) // TODO: different DBs?
+				authenticatedUsers = append(authenticatedUsers, models.AuthenticatedUser{User: identity.User(), DB: db})
 				users[userKey] = struct{}{}
 			}
 			for _, role := range identity.Roles() {
@@ -193,45 +406,21 @@ func (p *Proxy) baseRequestHandler(ctx context.Context, r *plugins.Request) (bso
 		}, nil
 
 	case *command.HostInfo:
-		return bson.D{
-			{"system", bson.D{
-				//{"currentTime", }
-				{"hostname", "EXAMPLEHOSTNAME"},
-				{"cpuAddrSize", 64}, // TODO: discover
-				//"memSizeMB" : <number>,
-				//"memLimitMB" : <number>,  // Available starting in MongoDB 4.0.9 (and 3.6.13)
-				//"numCores" : <number>,
-				//"cpuArch" : "<identifier>",
-				//"numaEnabled" : <boolean>
-			}},
-			{"os", bson.D{
-				//"type" : "<string>",
-				//"name" : "<string>",
-				//"version" : "<string>"
-			}},
-			{"extra", bson.D{
-				//"versionString" : "<string>",
-				//"libcVersion" : "<string>",
-				//"kernelVersion" : "<string>",
-				//"cpuFrequencyMHz" : "<string>",
-				//"cpuFeatures" : "<string>",
-				//"pageSize" : <number>,
-				//"numPages" : <number>,
-				//"maxOpenFiles" : <number>
-			}},
-		}, nil
+		return hostInfo(), nil
 
 	case *command.Logout:
-		r.CC.Identities = nil
+		r.CC.SetIdentities(nil)
 		return bson.D{
 			primitive.E{"ok", 1},
 		}, nil
 
 	case *command.BuildInfo:
+		cfg := p.Config()
 		return bson.D{
-			{"bits", 64}, //TODO dynamically pull
+			{"version", cfg.Version},
+			{"versionArray", cfg.VersionArray},
+			{"bits", strconv.IntSize},
 			{"debug", false},
-			{"version", "4.3.1"}, // TODO pull from downstream? Or have set in config
 			{"maxBsonObjectSize", bsonutil.MaxBsonObjectSize},
 			{"ok", 1},
 		}, nil
@@ -241,68 +430,192 @@ func (p *Proxy) baseRequestHandler(ctx context.Context, r *plugins.Request) (bso
 			{"ok", 1},
 		}, nil
 
-	// TODO: complete more options
-	case *command.ServerStatus:
-		return bson.D{
-			//{"host" : <string>,
-			//{"advisoryHostFQDNs" : <array>,
-			{"version", "4.3.1"}, // TODO pull from downstream? Or have set in config
-			//{"process" : <"mongod"|"mongos">,
-			//{"pid" : <num>,
-			//{"uptime" : <num>,
-			//{"uptimeMillis" : <num>,
-			//{"uptimeEstimate" : <num>,
-			//{"localTime" : ISODate(""),
+	case *command.GetLastError:
+		return p.getLastError(r.CC), nil
 
-			{"ok", 1},
-		}, nil
+	case *command.ServerStatus:
+		return p.serverStatus(cmd), nil
 
 	// Pretend we are mongoS
 	case *command.IsDBGrid:
 		return bson.D{
 			{"isdbgrid", 1},
-			{"hostname", "EXAMPLEHOSTNAME"},
+			{"hostname", hostname()},
 			{"ok", 1},
 		}, nil
 
+	case *command.Hello:
+		ret, err := p.handshake(ctx, r.CC, cmd.TopologyVersion, cmd.MaxAwaitTimeMS, cmd.Compression, cmd.DocumentSequences)
+		if err != nil || !bsonutil.Ok(ret) {
+			return ret, err
+		}
+		return append(bson.D{{"isWritablePrimary", true}}, ret...), nil
+
 	case *command.IsMaster:
-		ret := bson.D{
-			{"ismaster", true},
-			{"localTime", time.Now().Truncate(time.Millisecond)},
-			{"logicalSessionTimeoutMinutes", 30},
-			{"maxBsonObjectSize", bsonutil.MaxBsonObjectSize},
-			{"maxMessageSizeBytes", 48000000},
-			{"maxWireVersion", 8},
-			{"maxWriteBatchSize", 100000},
-			{"minWireVersion", 0},
-			{"msg", "isdbgrid"},
-			{"helloOk", false},
-			{"ok", 1},
+		ret, err := p.handshake(ctx, r.CC, cmd.TopologyVersion, cmd.MaxAwaitTimeMS, cmd.Compression, cmd.DocumentSequences)
+		if err != nil || !bsonutil.Ok(ret) {
+			return ret, err
 		}
+		return append(bson.D{{"ismaster", true}, {"helloOk", cmd.HelloOk}}, ret...), nil
+	}
+	if ret, ok := p.handleAdminCommand(r.Command); ok {
+		return ret, nil
+	}
+	return nil, fmt.Errorf("unhandled command %s: %v", r.CommandName, r.Command)
+}
 
-		// TODO: validate compressors
-		if len(p.cfg.Compressors) > 0 && len(cmd.Compression) > 0 {
-			var compressors primitive.A
-			for _, clientC := range cmd.Compression {
-				for _, serverC := range p.cfg.Compressors {
-					if clientC == serverC {
-						compressors = append(compressors, clientC)
-						break
-					}
+// serverStatus returns the serverStatus of the proxy
+func (p *Proxy) serverStatus(cmd *command.ServerStatus) bson.D {
+	now := time.Now()
+	uptime := now.Sub(p.stats.start)
+
+	ret := bson.D{
+		{"host", hostname()},
+		{"version", p.Config().Version},
+		{"process", "mongos"},
+		{"pid", int64(os.Getpid())},
+		{"uptime", uptime.Seconds()},
+		{"uptimeMillis", uptime.Milliseconds()},
+		{"uptimeEstimate", int64(uptime.Seconds())},
+		{"localTime", now.Truncate(time.Millisecond)},
+	}
+
+	if cmd.IncludeSection("connections") {
+		p.activeConnLock.Lock()
+		current := len(p.activeConn)
+		p.activeConnLock.Unlock()
+		ret = append(ret, bson.E{"connections", bson.D{
+			{"current", int32(current)},
+			{"totalCreated", atomic.LoadInt64(&p.stats.connectionsCreated)},
+		}})
+	}
+
+	if cmd.IncludeSection("opcounters") {
+		ret = append(ret, bson.E{"opcounters", p.stats.opcounters()})
+	}
+
+	opcodes, commands := p.stats.counts()
+	if cmd.IncludeSection("metrics") {
+		ret = append(ret, bson.E{"metrics", bson.D{
+			{"commands", commands},
+			{"cursor", bson.D{
+				{"open", bson.D{
+					{"total", int64(p.cursorCache.count())},
+				}},
+			}},
+		}})
+	}
+
+	if cmd.IncludeSection("logicalSessionRecordCache") {
+		ret = append(ret, bson.E{"logicalSessionRecordCache", bson.D{
+			{"activeSessionsCount", int64(p.sessions.count())},
+		}})
+	}
+
+	if cmd.IncludeSection("mongoproxy") {
+		ret = append(ret, bson.E{"mongoproxy", bson.D{
+			{"opcodes", opcodes},
+			{"cursorCacheSize", int64(p.cursorCache.c.Count())},
+		}})
+	}
+
+	return append(ret, bson.E{"ok", 1})
+}
+
+// handshake returns the response shared by hello and isMaster. If the client sent the
+// topologyVersion it last saw and maxAwaitTimeMS (an awaitable request) we respond once
+// the topology changes or maxAwaitTimeMS passes, whichever comes first. The options the
+// client negotiates are recorded on cc.
+func (p *Proxy) handshake(ctx context.Context, cc *plugins.ClientConnection, tv *command.TopologyVersion, maxAwaitTimeMS *int64, compression []string, documentSequences *bool) (bson.D, error) {
+	counter, changed := p.topology.version()
+	if tv != nil && maxAwaitTimeMS != nil && tv.ProcessID == p.topology.processID && tv.Counter == counter {
+		timer := time.NewTimer(time.Duration(*maxAwaitTimeMS) * time.Millisecond)
+		defer timer.Stop()
+
+		select {
+		case <-changed:
+			counter, _ = p.topology.version()
+		case <-timer.C:
+		case <-p.doneChan:
+			return mongoerror.ShutdownInProgress.ErrMessage("The server is in quiesce mode and will shut down"), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	ret := bson.D{
+		{"topologyVersion", p.topology.document(counter)},
+		{"localTime", time.Now().Truncate(time.Millisecond)},
+		{"maxBsonObjectSize", bsonutil.MaxBsonObjectSize},
+		{"maxMessageSizeBytes", p.Config().MaxMessageSizeBytes},
+		{"maxWireVersion", 8},
+		{"maxWriteBatchSize", 100000},
+		{"minWireVersion", 0},
+		{"msg", "isdbgrid"},
+		{"ok", 1},
+	}
+
+	// Clients only use sessions (and retryable writes) if we advertise them
+	if minutes, ok := p.getPipeline().logicalSessionTimeout(); ok {
+		ret = append(ret, bson.E{"logicalSessionTimeoutMinutes", minutes})
+	}
+
+	// The client may only send messages compressed with the negotiated compressors. As
+	// mongod a hello without compression doesn't change them.
+	cfg := p.Config()
+	if compression != nil {
+		var compressors []string
+		for _, clientC := range compression {
+			for _, serverC := range cfg.Compressors {
+				if clientC == serverC {
+					compressors = append(compressors, clientC)
+					break
 				}
 			}
+		}
+		cc.SetCompressors(compressors)
+		if len(cfg.Compressors) > 0 && len(compression) > 0 {
 			ret = append(ret, bson.E{"compression", compressors})
 		}
-		return ret, nil
 	}
-	return nil, fmt.Errorf("unhandled command %s: %v", r.CommandName, r.Command)
+
+	// Document sequences in replies are opt-in, as drivers ignore them
+	if documentSequences != nil {
+		enabled := *documentSequences && cfg.DocumentSequenceThreshold > 0
+		cc.SetDocumentSequences(enabled)
+		ret = append(ret, bson.E{"mongoproxyDocumentSequences", enabled})
+	}
+	return ret, nil
 }
 
+// Serve accepts client connections on all of the listeners. This returns
+// ErrServerClosed once the proxy is shut down, or the first error a listener
+// returns.
 func (p *Proxy) Serve() error {
+	if len(p.listeners) == 0 {
+		return errors.New("no listeners")
+	}
+
+	errs := make(chan error, len(p.listeners))
+	for _, ln := range p.listeners {
+		go func(ln *listener) {
+			errs <- p.serveListener(ln)
+		}(ln)
+	}
+
+	for range p.listeners {
+		if err := <-errs; err != ErrServerClosed {
+			return err
+		}
+	}
+	return ErrServerClosed
+}
+
+func (p *Proxy) serveListener(ln *listener) error {
 	var tempDelay time.Duration // how long to sleep on accept failure
 
 	for {
-		c, err := p.l.Accept()
+		c, err := ln.l.Accept()
 		if err != nil {
 			select {
 			case <-p.doneChan:
@@ -329,13 +642,30 @@ func (p *Proxy) Serve() error {
 			}
 			return err
 		}
-		labels := []string{
-			strings.Split(c.RemoteAddr().String(), ":")[0],
+
+		if !p.admission.allowAccept() {
+			logrus.Debugf("Rejecting connection from %v: accept rate exceeded", c.RemoteAddr())
+			go p.reject(c, "mongoproxy connection rate exceeded, try again later")
+			continue
 		}
-		clientConnectionCounter.WithLabelValues(labels...).Inc()
-		clientConnectionGauge.WithLabelValues(labels...).Inc()
 
 		go func(c net.Conn) {
+			// This may block reading a PROXY protocol header, so it isn't done in the accept loop
+			remoteAddr := c.RemoteAddr()
+			ip := addrIP(remoteAddr)
+			if !p.admission.acquire(p.Config(), ip) {
+				logrus.Debugf("Rejecting connection from %v: too many open connections", remoteAddr)
+				p.reject(c, "too many connections to mongoproxy, try again later")
+				return
+			}
+			defer p.admission.release(ip)
+
+			labels := []string{
+				strings.Split(remoteAddr.String(), ":")[0],
+			}
+			clientConnectionCounter.WithLabelValues(labels...).Inc()
+			clientConnectionGauge.WithLabelValues(labels...).Inc()
+
 			defer func() {
 				clientConnectionGauge.WithLabelValues(labels...).Dec()
 				if !SKIP_RECOVER {
@@ -347,7 +677,7 @@ func (p *Proxy) Serve() error {
 				}
 			}()
 			logrus.Debugf("Starting connection: %v", c)
-			if err := p.clientServeLoop(c); err != nil && err != io.EOF {
+			if err := p.clientServeLoop(c, ln.name); err != nil && err != io.EOF {
 				logrus.Errorf("Error serving client: %s %v -- %s", reflect.TypeOf(err), err, err.Error())
 			}
 		}(c)
@@ -363,6 +693,7 @@ func (p *Proxy) trackConn(c *conn, add bool) {
 	}
 
 	if add {
+		p.stats.connectionCreated()
 		p.activeConn[c] = struct{}{}
 	} else {
 		delete(p.activeConn, c)
@@ -404,13 +735,21 @@ func (p *Proxy) closeDoneChan() {
 func (p *Proxy) Shutdown(ctx context.Context) error {
 	p.closeDoneChan()
 
-	// Close the listener
-	lnerr := p.l.Close()
+	// Close the listeners
+	var lnerr error
+	for _, ln := range p.listeners {
+		if err := ln.l.Close(); err != nil && lnerr == nil {
+			lnerr = err
+		}
+	}
 
 	ticker := time.NewTicker(time.Millisecond * 200) // TODO: config?
 	defer ticker.Stop()
 	for {
 		if p.closeIdleConns() {
+			if err := p.getPipeline().close(ctx); err != nil {
+				return err
+			}
 			return lnerr
 		}
 
@@ -422,179 +761,351 @@ func (p *Proxy) Shutdown(ctx context.Context) error {
 	}
 }
 
-func (p *Proxy) handleOp(ctx context.Context, clientConn *plugins.ClientConnection, req *mongowire.Request) (mongowire.WireSerializer, error) {
+// replyWriter writes a reply to the client. A request may result in multiple
+// replies (exhaust cursors) or none (e.g. unacknowledged writes).
+type replyWriter func(mongowire.WireSerializer) error
+
+// handleOp handles a single request. It is the recovery boundary of the request:
+// panics and errors handling it (other than writing to the client) are returned to
+// the client as an error instead of closing the connection.
+func (p *Proxy) handleOp(ctx context.Context, c *conn, req *mongowire.Request, write replyWriter) (err error) {
+	hdr := *req.GetHeader()
+
+	var writeErr error
+	defer func() {
+		if SKIP_RECOVER {
+			return
+		}
+		if r := recover(); r != nil {
+			err = p.requestFailed(c, hdr, hdr.OpCode, r, debug.Stack(), write)
+		}
+	}()
+
+	err = p.dispatchOp(ctx, c, req, func(reply mongowire.WireSerializer) error {
+		writeErr = write(reply)
+		return writeErr
+	})
+	// Errors writing to the client (or from it going away) end the connection
+	if err == nil || err == errUnhandledOpcode || err == errInvalidMessage || writeErr != nil || ctx.Err() != nil {
+		return err
+	}
+	return p.requestFailed(c, hdr, hdr.OpCode, err, nil, write)
+}
+
+func (p *Proxy) dispatchOp(ctx context.Context, c *conn, req *mongowire.Request, write replyWriter) error {
 	logrus.Debugf("header received: %v", req.GetHeader())
 
+	clientConn := c.cc
+	requestLengthLimit := p.Config().RequestLengthLimit
+
 	clientMessageCounter.WithLabelValues(clientConn.GetIpAddr(), req.GetHeader().OpCode.String()).Inc()
+	p.stats.opcode(req.GetHeader().OpCode.String())
+
+	// Anything other than an unacknowledged write must be ordered after the
+	// unacknowledged writes already received (OP_MSG and OP_COMPRESSED check this
+	// once they know whether they are unacknowledged)
+	switch req.GetHeader().OpCode {
+	case mongowire.OpMsg, mongowire.OpCompressed:
+	default:
+		c.unack.wait()
+	}
 
 	switch req.GetHeader().OpCode {
 	case mongowire.OpQuery:
-		q := req.GetOpQuery()
+		q, err := req.GetOpQuery()
+		if err != nil {
+			return p.invalidMessage(c, req, err, write)
+		}
 		if logrus.IsLevelEnabled(logrus.DebugLevel) {
-			logrus.Debugf("IN OP_QUERY %s", mongowire.ToJson(q, p.cfg.RequestLengthLimit))
+			logrus.Debugf("IN OP_QUERY %s", mongowire.ToJson(q, requestLengthLimit))
 		}
 
 		reply, err := p.handleOpQuery(ctx, clientConn, q)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		reply.NumberReturned = int32(len(reply.Documents))
 		reply.Header.OpCode = mongowire.OpReply
 		reply.Header.ResponseTo = reply.Header.RequestID
 
+		exhaust := q.Flags.Exhaust() && reply.CursorID != 0
+		if exhaust {
+			reply.Header.RequestID = p.nextRequestID()
+		}
+
 		if logrus.IsLevelEnabled(logrus.DebugLevel) {
-			logrus.Debugf("OUT OP_QUERY %s", mongowire.ToJson(reply, p.cfg.RequestLengthLimit))
+			logrus.Debugf("OUT OP_QUERY %s", mongowire.ToJson(reply, requestLengthLimit))
+		}
+		if err := write(reply); err != nil {
+			return err
 		}
-		return reply, nil
+
+		if exhaust {
+			return p.exhaustOpQuery(ctx, clientConn, q, reply, write)
+		}
+		return nil
 
 	case mongowire.OpKillCursors:
-		q := req.GetOpKillCursors()
+		q, err := req.GetOpKillCursors()
+		if err != nil {
+			return p.invalidMessage(c, req, err, write)
+		}
 		if logrus.IsLevelEnabled(logrus.DebugLevel) {
-			logrus.Debugf("IN OP_KILL_CURSORS %s", mongowire.ToJson(q, p.cfg.RequestLengthLimit))
+			logrus.Debugf("IN OP_KILL_CURSORS %s", mongowire.ToJson(q, requestLengthLimit))
 		}
 		p.handleOpKillCursors(ctx, clientConn, q)
+		return nil
+
+	case mongowire.OpInsert:
+		m, err := req.GetOpInsert()
+		if err != nil {
+			return p.invalidMessage(c, req, err, write)
+		}
+		if logrus.IsLevelEnabled(logrus.DebugLevel) {
+			logrus.Debugf("IN OP_INSERT %s", mongowire.ToJson(m, requestLengthLimit))
+		}
+		p.handleOpInsert(clientConn, m)
+		return nil
+
+	case mongowire.OpUpdate:
+		m, err := req.GetOpUpdate()
+		if err != nil {
+			return p.invalidMessage(c, req, err, write)
+		}
+		if logrus.IsLevelEnabled(logrus.DebugLevel) {
+			logrus.Debugf("IN OP_UPDATE %s", mongowire.ToJson(m, requestLengthLimit))
+		}
+		p.handleOpUpdate(clientConn, m)
+		return nil
+
+	case mongowire.OpDelete:
+		m, err := req.GetOpDelete()
+		if err != nil {
+			return p.invalidMessage(c, req, err, write)
+		}
+		if logrus.IsLevelEnabled(logrus.DebugLevel) {
+			logrus.Debugf("IN OP_DELETE %s", mongowire.ToJson(m, requestLengthLimit))
+		}
+		p.handleOpDelete(clientConn, m)
+		return nil
 
 	case mongowire.OpGetMore:
-		q := req.GetOpMore()
+		q, err := req.GetOpMore()
+		if err != nil {
+			return p.invalidMessage(c, req, err, write)
+		}
 		if logrus.IsLevelEnabled(logrus.DebugLevel) {
-			logrus.Debugf("IN OP_GETMORE %s", mongowire.ToJson(q, p.cfg.RequestLengthLimit))
+			logrus.Debugf("IN OP_GETMORE %s", mongowire.ToJson(q, requestLengthLimit))
 		}
 
 		reply, err := p.handleOpGetMore(ctx, clientConn, q)
+		if err != nil {
+			return err
+		}
 		if logrus.IsLevelEnabled(logrus.DebugLevel) {
-			logrus.Debugf("OUT OP_GETMORE %s", mongowire.ToJson(reply, p.cfg.RequestLengthLimit))
+			logrus.Debugf("OUT OP_GETMORE %s", mongowire.ToJson(reply, requestLengthLimit))
 		}
-		return reply, err
+		return write(reply)
 
 	case mongowire.OpMsg:
-		m := req.GetOpMsg()
+		m, err := req.GetOpMsg()
+		if err != nil {
+			return p.invalidMessage(c, req, err, write)
+		}
 
 		// If the OP_MSG has set moreToCome we aren't allowed to respond
 		// https://docs.mongodb.com/manual/reference/mongodb-wire-protocol/#flag-bits
 		if m.Flags.MoreToCome() {
-			// TODO: do we want to background this? Or just run it without a return. As
-			// it stands how this causes race conditions with writeConcern=0 writes and subsequent writes
-			// from the same client on the same connection (e.g. test.test_common.TestCommon.test_mongo_client)
-			go p.handleOpMsg(ctx, clientConn, m)
-			return nil, nil
+			// Unacknowledged writes run in order in the background, with other requests
+			// on the connection waiting for them
+			c.unack.enqueue(m)
+			return nil
 		}
+		c.unack.wait()
 
-		reply, err := p.handleOpMsg(ctx, clientConn, m)
-		if err != nil {
-			return nil, err
-		}
+		for {
+			reply, err := p.handleOpMsg(ctx, clientConn, m)
+			if err != nil {
+				return err
+			}
 
-		if logrus.IsLevelEnabled(logrus.DebugLevel) {
-			logrus.Debugf("OUT OP_MSG %s", mongowire.ToJson(reply, p.cfg.RequestLengthLimit))
+			// If the client set exhaustAllowed we may stream the results of a getMore:
+			// we set moreToCome on the reply and keep running the getMore (without
+			// the client asking) until the cursor is exhausted
+			var exhaust bool
+			if m.Flags.ExhaustAllowed() {
+				exhaust = exhaustOpMsg(m, reply)
+				if exhaust {
+					reply.Flags |= mongowire.MsgFlagMoreToCome
+				}
+				reply.Header.RequestID = p.nextRequestID()
+			}
+
+			if logrus.IsLevelEnabled(logrus.DebugLevel) {
+				logrus.Debugf("OUT OP_MSG %s", mongowire.ToJson(reply, requestLengthLimit))
+			}
+			if err := write(reply); err != nil {
+				return err
+			}
+
+			if !exhaust {
+				return nil
+			}
+			// The next reply is a response to this one
+			m.Header.RequestID = reply.Header.RequestID
 		}
-		return reply, nil
 
 	case mongowire.OpCompressed:
-		m := req.GetOpCompressed()
+		m, err := req.GetOpCompressed()
+		if err != nil {
+			return p.invalidMessage(c, req, err, write)
+		}
 		if logrus.IsLevelEnabled(logrus.DebugLevel) {
-			logrus.Debugf("IN OP_COMPRESSED %s", mongowire.ToJson(req, p.cfg.RequestLengthLimit))
+			logrus.Debugf("IN OP_COMPRESSED %s", mongowire.ToJson(req, requestLengthLimit))
 		}
 
-		// Decompress
-		b, err := driver.DecompressPayload(m.CompressedMessage, driver.CompressionOpts{
-			Compressor:       m.CompressorID,
-			UncompressedSize: m.UncompressedSize,
-		})
+		// Only commands are compressed; in particular an OP_COMPRESSED can't wrap another
+		// one, which would let a single message recurse once per (noop) layer
+		if m.OriginalOpcode != mongowire.OpMsg && m.OriginalOpcode != mongowire.OpQuery {
+			return p.invalidMessage(c, req, fmt.Errorf("can't compress %v", m.OriginalOpcode), write)
+		}
+		if !negotiatedCompressor(clientConn, m.CompressorID) {
+			return p.replyError(c, *req.GetHeader(), m.OriginalOpcode, mongoerror.BadValue.ErrMessage("compressor "+mongowire.CompressorName(m.CompressorID)+" wasn't negotiated"), write)
+		}
+		// The uncompressed message is bound by the same limit as the compressed one;
+		// Decompress ensures no more than UncompressedSize is decompressed
+		if int64(m.UncompressedSize)+mongowire.HeaderLen > int64(p.Config().MaxMessageSizeBytes) {
+			return p.replyError(c, *req.GetHeader(), m.OriginalOpcode, mongoerror.BadValue.ErrMessage(fmt.Sprintf("uncompressed message size %d exceeds the maximum of %d", m.UncompressedSize, p.Config().MaxMessageSizeBytes)), write)
+		}
+
+		b, err := m.Decompress()
 		if err != nil {
-			panic(err) // TODO
+			return p.replyError(c, *req.GetHeader(), m.OriginalOpcode, mongoerror.BadValue.ErrMessage("error decompressing message: "+err.Error()), write)
 		}
 
-		newReq := mongowire.NewRequestWithHeader(*req.GetHeader(), bytes.NewReader(b))
+		newReq := mongowire.NewRequestWithHeader(*req.GetHeader(), &io.LimitedReader{R: bytes.NewReader(b), N: int64(len(b))})
 		newReq.GetHeader().OpCode = m.OriginalOpcode
 		newReq.GetHeader().MessageLength = m.UncompressedSize + mongowire.HeaderLen
-		reply, err := p.handleOp(ctx, clientConn, newReq)
-		if err != nil {
-			return nil, err
-		}
 
-		// Generate output of inner message
-		buf := bytes.NewBuffer(nil)
-		if err := reply.WriteTo(buf); err != nil {
-			return nil, err
-		}
-		// Wrap
-		compressedReply := &mongowire.OP_COMPRESSED{
-			Header:           *req.GetHeader(),
-			CompressorID:     m.CompressorID,
-			OriginalOpcode:   reply.GetHeader().OpCode,
-			UncompressedSize: int32(len(buf.Bytes()[mongowire.HeaderLen:])),
-		}
+		// Compress each reply of the inner message with the same compressor the request came in with
+		return p.handleOp(ctx, c, newReq, func(reply mongowire.WireSerializer) error {
+			// Generate output of inner message
+			buf := bytes.NewBuffer(nil)
+			if err := reply.WriteTo(buf); err != nil {
+				return err
+			}
+			// Wrap
+			compressedReply := &mongowire.OP_COMPRESSED{
+				Header:           reply.GetHeader(),
+				CompressorID:     m.CompressorID,
+				OriginalOpcode:   reply.GetHeader().OpCode,
+				UncompressedSize: int32(len(buf.Bytes()[mongowire.HeaderLen:])),
+			}
+			compressedReply.Header.OpCode = mongowire.OpCompressed
 
-		// Compress message with the same thing that it came in with
-		compressedB, err := driver.CompressPayload(buf.Bytes()[mongowire.HeaderLen:], driver.CompressionOpts{
-			Compressor: compressedReply.CompressorID,
-			// TODO: options
-			ZlibLevel: wiremessage.DefaultZlibLevel,
-			ZstdLevel: wiremessage.DefaultZstdLevel,
-		})
-		if err != nil {
-			panic(err) // TODO
-		}
-		compressedReply.CompressedMessage = compressedB
+			compressedB, err := driver.CompressPayload(buf.Bytes()[mongowire.HeaderLen:], driver.CompressionOpts{
+				Compressor: compressedReply.CompressorID,
+				// TODO: options
+				ZlibLevel: wiremessage.DefaultZlibLevel,
+				ZstdLevel: wiremessage.DefaultZstdLevel,
+			})
+			if err != nil {
+				return err
+			}
+			compressedReply.CompressedMessage = compressedB
 
-		// return
-		if logrus.IsLevelEnabled(logrus.DebugLevel) {
-			logrus.Debugf("OUT OP_COMPRESSED %s", mongowire.ToJson(compressedReply, p.cfg.RequestLengthLimit))
-		}
-		return compressedReply, nil
+			// return
+			if logrus.IsLevelEnabled(logrus.DebugLevel) {
+				logrus.Debugf("OUT OP_COMPRESSED %s", mongowire.ToJson(compressedReply, requestLengthLimit))
+			}
+			return write(compressedReply)
+		})
 
 	default:
-		logrus.Debugf("Unhandled opcode: %v", req.GetHeader().OpCode)
-		return nil, fmt.Errorf("unhandled opcode: %v", req.GetHeader().OpCode)
+		logrus.Errorf("Unhandled opcode from %s: %v", clientConn.GetAddr(), req.GetHeader().OpCode)
+		return errUnhandledOpcode
+	}
+}
+
+// negotiatedCompressor returns whether the client negotiated the compressor (noop,
+// which leaves the message as it is, is always allowed)
+func negotiatedCompressor(cc *plugins.ClientConnection, id wiremessage.CompressorID) bool {
+	if id == wiremessage.CompressorNoOp {
+		return true
+	}
+	name := mongowire.CompressorName(id)
+	for _, c := range cc.Compressors() {
+		if c == name {
+			return true
+		}
 	}
+	return false
+}
 
-	return nil, nil
+// nextRequestID returns a requestID for replies the proxy sends without a
+// matching request (exhaust)
+func (p *Proxy) nextRequestID() int32 {
+	return atomic.AddInt32(&p.requestID, 1)
 }
 
-func (p *Proxy) clientServeLoop(c net.Conn) error {
+func (p *Proxy) clientServeLoop(c net.Conn, listener string) error {
 	conn := &conn{
-		p: p,
-		c: c,
+		p:       p,
+		c:       c,
+		id:      atomic.AddInt64(&p.connID, 1),
+		created: time.Now(),
 	}
 	conn.setState(StateNew)
 
 	clientConn := plugins.NewClientConnection()
 	clientConn.Addr = c.RemoteAddr()
+	clientConn.Listener = listener
+	conn.cc = clientConn
+	conn.unack = newUnackQueue(p, clientConn, p.Config().UnacknowledgedWriteQueueSize)
 	defer func() {
 		c.Close()
+		// The client sent the queued writes before going away, so we still run them
+		conn.unack.close()
 		clientConn.Close()
 		conn.setState(StateClosed)
 
 		logrus.Debugf("Closing connection: %v", c)
 	}()
 
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		clientConn.TLS = &state
+	}
+
+	// ctx is cancelled when the client goes away so that downstream work done on
+	// its behalf is cancelled as well
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cr := newConnReader(c, cancel)
+
 	for {
 		conn.setState(StateIdle)
 		logrus.Debugf("waiting for request %v", c)
-		req, err := mongowire.NewRequest(c)
+		req, err := mongowire.ReadRequestLimit(cr, p.Config().MaxMessageSizeBytes)
 		if err != nil {
 			return err
 		}
 		conn.setState(StateActive)
 
-		// TODO: context that will close when the client connection closes
-		ctx := context.Background()
-
-		// Unpack request
-
-		// Handle Reply (write to wire)
-
-		reply, err := p.handleOp(ctx, clientConn, req)
+		// The request is fully read, watch for the client going away while we handle it
+		cr.startBackgroundRead()
+		err = p.handleOp(ctx, conn, req, func(reply mongowire.WireSerializer) error {
+			return reply.WriteTo(c)
+		})
+		cr.abortPendingRead()
 		if err != nil {
 			return err
 		}
-
-		// If we have a reply, write it back out
-		if reply != nil {
-			if err := reply.WriteTo(c); err != nil {
-				return err
-			}
-		}
 	}
 }
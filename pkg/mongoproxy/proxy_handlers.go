@@ -2,7 +2,6 @@ package mongoproxy
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"strings"
 
@@ -30,7 +29,7 @@ var (
 // HandleMongo needs to actually disbatch the command. This includes loading the command into a struct, processing the pipeline, and then returning
 func (p *Proxy) HandleMongo(ctx context.Context, req *plugins.Request, d bson.D) (bson.D, error) {
 	if len(d) == 0 {
-		return nil, errors.New("invalid bson Doc")
+		return mongoerror.FailedToParse.ErrMessage("empty command document"), nil
 	}
 
 	cmd, ok := command.GetCommand(d[0].Key)
@@ -38,6 +37,10 @@ func (p *Proxy) HandleMongo(ctx context.Context, req *plugins.Request, d bson.D)
 		return mongoerror.CommandNotFound.ErrMessage("no such command: '" + d[0].Key + "'"), nil
 	}
 	clientCommandCounter.WithLabelValues(d[0].Key).Inc()
+	p.stats.command(d[0].Key)
+	if req.CC != nil {
+		req.CC.SetLastCommand(d[0].Key)
+	}
 
 	if err := cmd.FromBSOND(d); err != nil {
 		d, err := mongo.ErrorToDoc(err)
@@ -50,8 +53,24 @@ func (p *Proxy) HandleMongo(ctx context.Context, req *plugins.Request, d bson.D)
 	req.CommandName = d[0].Key
 	req.Command = cmd
 
+	if errDoc := p.checkCursorOwner(req); errDoc != nil {
+		return errDoc, nil
+	}
+	if errDoc := p.checkSession(req); errDoc != nil {
+		return errDoc, nil
+	}
+
 	// handle error -- check if its a type we can convert; if so convert (so we don't close the connection)
-	resp, err := p.pipe(ctx, req)
+	pl, err := p.acquirePipeline()
+	if err != nil {
+		return nil, err
+	}
+	pipe := pl.pipe
+	if req.CC != nil {
+		pipe = pl.pipeFor(req.CC.Listener)
+	}
+	resp, err := pipe(ctx, req)
+	pl.release()
 	if err != nil {
 		// TODO: move this logic down; here we only want to check against some BSONError interface type; so other plugins can implement their own errors that become the same on the wire
 		d, err := mongo.ErrorToDoc(err)
@@ -60,6 +79,8 @@ func (p *Proxy) HandleMongo(ctx context.Context, req *plugins.Request, d bson.D)
 		}
 		return append(bson.D{{"ok", 0}}, d...), nil
 	}
+	p.recordCursor(req, resp)
+	p.recordSession(req, resp)
 
 	return resp, nil
 }
@@ -86,10 +107,18 @@ func (p *Proxy) handleOpQuery(ctx context.Context, cc *plugins.ClientConnection,
 		reply.Documents = append(reply.Documents, mongoerror.CommandNotFound.ErrMessage("no such command"))
 		return reply, nil
 	}
+	if len(names) < 2 || names[0] == "" || names[1] == "" {
+		reply.Documents = append(reply.Documents, mongoerror.InvalidNamespace.ErrMessage("Invalid namespace specified '"+q.FullCollectionName+"'"))
+		return reply, nil
+	}
 
 	switch names[1] {
 	// $cmd is all "command" methods
 	case "$cmd":
+		if len(q.Query) == 0 {
+			reply.Documents = append(reply.Documents, mongoerror.FailedToParse.ErrMessage("empty command"))
+			return reply, nil
+		}
 		var downstreamQuery bson.D
 		if q.Query[0].Key[0] != '$' {
 			downstreamQuery = q.Query
@@ -117,7 +146,7 @@ func (p *Proxy) handleOpQuery(ctx context.Context, cc *plugins.ClientConnection,
 		}
 
 		if logrus.IsLevelEnabled(logrus.DebugLevel) {
-			logrus.Debugf("Query Converted: %v", mongowire.ToJson(downstreamQuery, p.cfg.RequestLengthLimit))
+			logrus.Debugf("Query Converted: %v", mongowire.ToJson(downstreamQuery, p.Config().RequestLengthLimit))
 		}
 
 		// run the converted query through the handlers
@@ -194,8 +223,8 @@ func (p *Proxy) handleOpQuery(ctx context.Context, cc *plugins.ClientConnection,
 				case "hint", "snapshot", "$readPreference", "comment", "collation":
 					downstreamQuery = append(downstreamQuery, qV)
 				default:
-					fmt.Println("TODO", qV)
-					panic(fmt.Errorf("not supported qV key type:  %s", qV.Key))
+					reply.Documents = append(reply.Documents, mongoerror.BadValue.ErrMessage("unsupported query modifier: "+qV.Key))
+					return reply, nil
 				}
 
 			}
@@ -250,7 +279,7 @@ func (p *Proxy) handleOpQuery(ctx context.Context, cc *plugins.ClientConnection,
 		}
 
 		if logrus.IsLevelEnabled(logrus.DebugLevel) {
-			logrus.Debugf("Query Converted: %v", mongowire.ToJson(downstreamQuery, p.cfg.RequestLengthLimit))
+			logrus.Debugf("Query Converted: %v", mongowire.ToJson(downstreamQuery, p.Config().RequestLengthLimit))
 		}
 
 		result, err := p.HandleMongo(ctx, request, downstreamQuery)
@@ -268,12 +297,6 @@ func (p *Proxy) handleOpQuery(ctx context.Context, cc *plugins.ClientConnection,
 			return reply, nil
 		}
 
-		// This is supposed to send the docs as if we did a bunch of GET_MORE over and over for the find. Since this isn't used today
-		// we'll delay implementation
-		if q.Flags.Exhaust() {
-			return nil, fmt.Errorf("not implemented")
-		}
-
 		// Get documents
 		documents := make([]bson.D, 0, 100) // TODO: sizing?
 		if cursorDataRaw, ok := bsonutil.Lookup(result, "cursor"); ok {
@@ -301,6 +324,93 @@ func (p *Proxy) handleOpQuery(ctx context.Context, cc *plugins.ClientConnection,
 	return reply, nil
 }
 
+// exhaustOpQuery streams the remainder of an exhaust OP_QUERY cursor to the client. This
+// is the equivalent of the client sending OP_GETMORE until the cursor is exhausted, except
+// that each reply is a response to the previous reply.
+func (p *Proxy) exhaustOpQuery(ctx context.Context, cc *plugins.ClientConnection, q *mongowire.OP_QUERY, reply *mongowire.OP_REPLY, write replyWriter) error {
+	batchSize := q.NumberToReturn
+	if batchSize < 0 {
+		batchSize = -batchSize
+	}
+
+	for reply.CursorID != 0 {
+		next, err := p.handleOpGetMore(ctx, cc, &mongowire.OP_GETMORE{
+			Header:             q.Header,
+			FullCollectionName: q.FullCollectionName,
+			NumberToReturn:     batchSize,
+			CursorID:           reply.CursorID,
+		})
+		if err != nil {
+			return err
+		}
+		next.Header.RequestID = p.nextRequestID()
+		next.Header.ResponseTo = reply.Header.RequestID
+
+		if logrus.IsLevelEnabled(logrus.DebugLevel) {
+			logrus.Debugf("OUT OP_QUERY exhaust %s", mongowire.ToJson(next, p.Config().RequestLengthLimit))
+		}
+		if err := write(next); err != nil {
+			return err
+		}
+		reply = next
+	}
+
+	return nil
+}
+
+// exhaustOpMsg returns whether the reply to an OP_MSG with exhaustAllowed should be
+// streamed. This is the case for a getMore on a cursor which isn't exhausted and for
+// an awaitable hello/isMaster; for the latter the request is updated with the reply's
+// topologyVersion so the next run waits for the topology to change again.
+func exhaustOpMsg(m *mongowire.OP_MSG, reply *mongowire.OP_MSG) bool {
+	bodyIdx := -1
+	for i, section := range m.Sections {
+		if body, ok := section.(mongowire.MSGSection_Body); ok && len(body.Document) > 0 {
+			bodyIdx = i
+			break
+		}
+	}
+	if bodyIdx < 0 {
+		return false
+	}
+	request := m.Sections[bodyIdx].(mongowire.MSGSection_Body).Document
+
+	var result bson.D
+	for _, section := range reply.Sections {
+		if body, ok := section.(mongowire.MSGSection_Body); ok {
+			result = body.Document
+			break
+		}
+	}
+	if !bsonutil.Ok(result) {
+		return false
+	}
+
+	switch request[0].Key {
+	case "getMore":
+		cursorID, _ := bsonutil.Lookup(result, "cursor", "id")
+		id, ok := cursorID.(int64)
+		return ok && id != 0
+
+	case "hello", "isMaster", "ismaster":
+		if _, ok := bsonutil.Lookup(request, "maxAwaitTimeMS"); !ok {
+			return false
+		}
+		if _, ok := bsonutil.Lookup(request, "topologyVersion"); !ok {
+			return false
+		}
+		tv, ok := bsonutil.Lookup(result, "topologyVersion")
+		if !ok {
+			return false
+		}
+		request, _ = bsonutil.Set(request, tv, "topologyVersion")
+		m.Sections[bodyIdx] = mongowire.MSGSection_Body{request}
+		return true
+	}
+
+	return false
+}
+
 // Responsible to kill the requested cursors
 func (p *Proxy) handleOpKillCursors(ctx context.Context, cc *plugins.ClientConnection, q *mongowire.OP_KILL_CURSORS) error {
 	request := &plugins.Request{
@@ -341,12 +451,17 @@ func (p *Proxy) handleOpGetMore(ctx context.Context, cc *plugins.ClientConnectio
 
 	cursorEntry := p.GetCursor(q.CursorID)
 
-	result, err := p.HandleMongo(ctx, request, []primitive.E{
+	getMore := []primitive.E{
 		{Key: "getMore", Value: q.CursorID},
-		{Key: "batchSize", Value: q.NumberToReturn},
 		{Key: "$db", Value: names[0]},
 		{Key: "collection", Value: names[1]},
-	})
+	}
+	// A NumberToReturn of 0 means the default batch size
+	if q.NumberToReturn > 0 {
+		getMore = append(getMore, primitive.E{Key: "batchSize", Value: q.NumberToReturn})
+	}
+
+	result, err := p.HandleMongo(ctx, request, getMore)
 	if err != nil {
 		return nil, err
 	}
@@ -394,7 +509,7 @@ func (p *Proxy) handleOpMsg(ctx context.Context, cc *plugins.ClientConnection, m
 	reply.Header.ResponseTo = m.Header.RequestID
 
 	if logrus.IsLevelEnabled(logrus.DebugLevel) {
-		logrus.Debugf("IN OP_MSG %d %s", len(m.Sections), mongowire.ToJson(m, p.cfg.RequestLengthLimit))
+		logrus.Debugf("IN OP_MSG %d %s", len(m.Sections), mongowire.ToJson(m, p.Config().RequestLengthLimit))
 	}
 
 	var d bson.D
@@ -406,11 +521,15 @@ func (p *Proxy) handleOpMsg(ctx context.Context, cc *plugins.ClientConnection, m
 			d = append(sectionTyped.Document, d...)
 
 		case mongowire.MSGSection_DocumentSequence:
-			// TODO: handle nested fields in SequenceIdentifier (if there is a "." in there we need to do something different)
-			if strings.Contains(sectionTyped.SequenceIdentifier, ".") {
-				return nil, fmt.Errorf("not implemented")
+			// A "." in the SequenceIdentifier means the documents belong in a sub-document
+			var ok bool
+			d, ok = bsonutil.Set(d, sectionTyped.Documents, strings.Split(sectionTyped.SequenceIdentifier, ".")...)
+			if !ok {
+				reply.Sections = append(reply.Sections, mongowire.MSGSection_Body{
+					mongoerror.FailedToParse.ErrMessage("invalid document sequence identifier: " + sectionTyped.SequenceIdentifier),
+				})
+				return reply, nil
 			}
-			d = append(d, primitive.E{sectionTyped.SequenceIdentifier, sectionTyped.Documents})
 		default:
 			return nil, fmt.Errorf("not implemented")
 		}
@@ -421,8 +540,79 @@ func (p *Proxy) handleOpMsg(ctx context.Context, cc *plugins.ClientConnection, m
 	if err != nil {
 		return nil, err
 	}
-	// TODO: something smarter about the size of that result; if too big we can do a document sequence
-	reply.Sections = append(reply.Sections, mongowire.MSGSection_Body{result})
+	var threshold int
+	if cc.DocumentSequences() {
+		threshold = p.Config().DocumentSequenceThreshold
+	}
+	reply.Sections = append(reply.Sections, opMsgSections(result, threshold)...)
 
 	return reply, nil
 }
+
+// opMsgSections returns the OP_MSG sections for the given result. If threshold is set
+// (the client accepts document sequences) a cursor batch larger than it is moved out
+// of the body into a document sequence section, identified by its path (e.g.
+// "cursor.firstBatch")
+func opMsgSections(result bson.D, threshold int) []mongowire.MSGSection {
+	if threshold <= 0 {
+		return []mongowire.MSGSection{mongowire.MSGSection_Body{result}}
+	}
+
+	cursor, ok := bsonutil.Lookup(result, "cursor")
+	if !ok {
+		return []mongowire.MSGSection{mongowire.MSGSection_Body{result}}
+	}
+	cursorDoc, ok := cursor.(bson.D)
+	if !ok {
+		return []mongowire.MSGSection{mongowire.MSGSection_Body{result}}
+	}
+
+	for i, item := range cursorDoc {
+		if item.Key != "firstBatch" && item.Key != "nextBatch" {
+			continue
+		}
+		batch, ok := item.Value.(bson.A)
+		if !ok {
+			break
+		}
+
+		var size int
+		docs := make([]bson.D, len(batch))
+		for j, v := range batch {
+			doc, ok := v.(bson.D)
+			if !ok {
+				return []mongowire.MSGSection{mongowire.MSGSection_Body{result}}
+			}
+			// The size is only needed until the batch is over the threshold
+			if size <= threshold {
+				b, err := bson.Marshal(doc)
+				if err != nil {
+					return []mongowire.MSGSection{mongowire.MSGSection_Body{result}}
+				}
+				size += len(b)
+			}
+			docs[j] = doc
+		}
+		if size <= threshold {
+			break
+		}
+
+		// Copy the result and cursor so we don't modify what the plugins returned
+		newCursor := make(bson.D, 0, len(cursorDoc)-1)
+		newCursor = append(newCursor, cursorDoc[:i]...)
+		newCursor = append(newCursor, cursorDoc[i+1:]...)
+		body := make(bson.D, len(result))
+		copy(body, result)
+		body, _ = bsonutil.Set(body, newCursor, "cursor")
+
+		return []mongowire.MSGSection{
+			mongowire.MSGSection_Body{body},
+			mongowire.MSGSection_DocumentSequence{
+				SequenceIdentifier: "cursor." + item.Key,
+				Documents:          docs,
+			},
+		}
+	}
+
+	return []mongowire.MSGSection{mongowire.MSGSection_Body{result}}
+}
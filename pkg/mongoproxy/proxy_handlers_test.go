@@ -0,0 +1,132 @@
+package mongoproxy
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongowire"
+)
+
+func TestOpMsgSections(t *testing.T) {
+	result := bson.D{
+		{"cursor", bson.D{
+			{"firstBatch", bson.A{bson.D{{"_id", int32(1)}}, bson.D{{"_id", int32(2)}}}},
+			{"id", int64(0)},
+			{"ns", "test.foo"},
+		}},
+		{"ok", 1.0},
+	}
+
+	// Disabled
+	if sections := opMsgSections(result, 0); len(sections) != 1 {
+		t.Fatalf("expected a single section, got %v", sections)
+	}
+	// Under the threshold
+	if sections := opMsgSections(result, 1024); len(sections) != 1 {
+		t.Fatalf("expected a single section, got %v", sections)
+	}
+
+	sections := opMsgSections(result, 1)
+	if len(sections) != 2 {
+		t.Fatalf("expected body and document sequence, got %v", sections)
+	}
+
+	// Ensure the sections survive a round trip on the wire
+	b, err := (&mongowire.OP_MSG{
+		Header:   mongowire.MessageHeader{OpCode: mongowire.OpMsg},
+		Sections: sections,
+	}).ToWire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := mongowire.ReadRequest(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := req.GetOpMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Sections) != 2 {
+		t.Fatalf("expected 2 sections, got %v", m.Sections)
+	}
+
+	body := m.Sections[0].(mongowire.MSGSection_Body).Document
+	if !reflect.DeepEqual(body, bson.D{
+		{"cursor", bson.D{
+			{"id", int64(0)},
+			{"ns", "test.foo"},
+		}},
+		{"ok", 1.0},
+	}) {
+		t.Fatalf("unexpected body: %v", body)
+	}
+
+	seq := m.Sections[1].(mongowire.MSGSection_DocumentSequence)
+	if seq.SequenceIdentifier != "cursor.firstBatch" {
+		t.Fatalf("unexpected sequence identifier: %s", seq.SequenceIdentifier)
+	}
+	if !reflect.DeepEqual(seq.Documents, []bson.D{{{"_id", int32(1)}}, {{"_id", int32(2)}}}) {
+		t.Fatalf("unexpected documents: %v", seq.Documents)
+	}
+
+	// The original result must not be modified
+	if len(result[0].Value.(bson.D)) != 3 {
+		t.Fatalf("result was modified: %v", result)
+	}
+}
+
+func TestDocumentSequenceNegotiation(t *testing.T) {
+	cfg := &config.Config{DocumentSequenceThreshold: 1}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewProxy(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.pipeline.Store(proxy.newPipeline(cfg, []plugins.Plugin{
+		funcPlugin(func(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+			if _, ok := r.Command.(*command.Find); !ok {
+				return next(ctx, r)
+			}
+			return bson.D{
+				{"cursor", bson.D{{"firstBatch", bson.A{bson.D{{"_id", 1}}}}, {"id", int64(0)}, {"ns", "test.foo"}}},
+				{"ok", 1},
+			}, nil
+		}),
+	}))
+
+	cc := plugins.NewClientConnection()
+	run := func(d bson.D) *mongowire.OP_MSG {
+		reply, err := proxy.handleOpMsg(context.Background(), cc, &mongowire.OP_MSG{
+			Header:   mongowire.MessageHeader{OpCode: mongowire.OpMsg},
+			Sections: []mongowire.MSGSection{mongowire.MSGSection_Body{d}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	find := bson.D{{"find", "foo"}, {"$db", "test"}}
+
+	// Clients get document sequences only once they opt in
+	if reply := run(find); len(reply.Sections) != 1 {
+		t.Fatalf("document sequence sent without opting in: %v", reply.Sections)
+	}
+	hello := run(bson.D{{"hello", 1}, {"mongoproxyDocumentSequences", true}, {"$db", "admin"}}).Sections[0].(mongowire.MSGSection_Body).Document
+	if enabled, _ := bsonutil.Lookup(hello, "mongoproxyDocumentSequences"); enabled != true {
+		t.Fatalf("document sequences not negotiated: %v", hello)
+	}
+	if reply := run(find); len(reply.Sections) != 2 {
+		t.Fatalf("expected a document sequence, got %v", reply.Sections)
+	}
+}
@@ -2,10 +2,16 @@ package mongoproxy
 
 import (
 	"context"
+	"os"
+	"reflect"
+	"runtime"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 
+	"github.com/wish/mongoproxy/pkg/bsonutil"
 	"github.com/wish/mongoproxy/pkg/command"
 	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
 	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
@@ -45,3 +51,285 @@ func TestProxy(t *testing.T) {
 
 	})
 }
+
+func TestProxyReload(t *testing.T) {
+	cfg := &config.Config{}
+
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An invalid config must leave the current pipeline in place
+	badCfg := &config.Config{Plugins: []config.PluginConfig{{Name: "doesnotexist"}}}
+	if err := badCfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.Reload(badCfg); err == nil {
+		t.Fatalf("expected error reloading invalid config")
+	}
+	if proxy.Config() != cfg {
+		t.Fatalf("config changed on failed reload")
+	}
+
+	newCfg := &config.Config{Compressors: []string{"zlib"}}
+	if err := newCfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.Reload(newCfg); err != nil {
+		t.Fatal(err)
+	}
+	if proxy.Config() != newCfg {
+		t.Fatalf("config not swapped on reload")
+	}
+
+	// New requests should see the new config
+	result, err := proxy.HandleMongo(context.TODO(), &plugins.Request{
+		CursorCache: proxy,
+		CC:          plugins.NewClientConnection(),
+	}, bson.D{{"isMaster", 1}, {"compression", bson.A{"zlib"}}, {"$db", "admin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bsonutil.Lookup(result, "compression"); !ok {
+		t.Fatalf("missing compression in isMaster response: %v", result)
+	}
+}
+
+type lifecyclePlugin struct {
+	started, closed int32
+}
+
+func (p *lifecyclePlugin) Name() string             { return "lifecycletest" }
+func (p *lifecyclePlugin) Configure(d bson.D) error { return nil }
+func (p *lifecyclePlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	return next(ctx, r)
+}
+func (p *lifecyclePlugin) Start(context.Context) error {
+	atomic.AddInt32(&p.started, 1)
+	return nil
+}
+func (p *lifecyclePlugin) Close(context.Context) error {
+	atomic.AddInt32(&p.closed, 1)
+	return nil
+}
+
+func TestProxyReloadLifecycle(t *testing.T) {
+	var instances []*lifecyclePlugin
+	plugins.Register(func() plugins.Plugin {
+		p := &lifecyclePlugin{}
+		instances = append(instances, p)
+		return p
+	})
+	instances = nil // Register creates an instance to get the name
+
+	cfg := &config.Config{Plugins: []config.PluginConfig{{Name: "lifecycletest"}}}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(instances) != 1 || atomic.LoadInt32(&instances[0].started) != 1 {
+		t.Fatalf("plugin not started")
+	}
+
+	// Hold a request on the old pipeline; it must not be closed until released
+	pl, err := proxy.acquirePipeline()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := proxy.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 2 || atomic.LoadInt32(&instances[1].started) != 1 {
+		t.Fatalf("new plugin not started")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt32(&instances[0].closed) != 0 {
+		t.Fatalf("old plugin closed while a request was in flight")
+	}
+
+	pl.release()
+	for i := 0; atomic.LoadInt32(&instances[0].closed) == 0; i++ {
+		if i > 100 {
+			t.Fatalf("old plugin not closed after drain")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&instances[1].closed) != 0 {
+		t.Fatalf("new plugin closed")
+	}
+}
+
+func TestHelloAwaitable(t *testing.T) {
+	cfg := &config.Config{}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hello := func(d bson.D) bson.D {
+		result, err := proxy.HandleMongo(context.TODO(), &plugins.Request{
+			CursorCache: proxy,
+			CC:          plugins.NewClientConnection(),
+		}, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bsonutil.Ok(result) {
+			t.Fatalf("hello failed: %v", result)
+		}
+		return result
+	}
+
+	result := hello(bson.D{{"hello", 1}, {"$db", "admin"}})
+	if v, _ := bsonutil.Lookup(result, "isWritablePrimary"); v != true {
+		t.Fatalf("missing isWritablePrimary: %v", result)
+	}
+	tv, ok := bsonutil.Lookup(result, "topologyVersion")
+	if !ok {
+		t.Fatalf("missing topologyVersion: %v", result)
+	}
+
+	// Without a change we wait for maxAwaitTimeMS
+	start := time.Now()
+	result = hello(bson.D{{"hello", 1}, {"topologyVersion", tv}, {"maxAwaitTimeMS", int64(50)}, {"$db", "admin"}})
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("awaitable hello returned before maxAwaitTimeMS")
+	}
+	if counter, _ := bsonutil.Lookup(result, "topologyVersion", "counter"); counter != int64(0) {
+		t.Fatalf("unexpected topologyVersion counter: %v", counter)
+	}
+
+	// A reload changes the topologyVersion, waking the waiting client
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		if err := proxy.Reload(cfg); err != nil {
+			t.Error(err)
+		}
+	}()
+	start = time.Now()
+	result = hello(bson.D{{"isMaster", 1}, {"topologyVersion", tv}, {"maxAwaitTimeMS", int64(10000)}, {"$db", "admin"}})
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("awaitable isMaster not woken by reload")
+	}
+	if counter, _ := bsonutil.Lookup(result, "topologyVersion", "counter"); counter != int64(1) {
+		t.Fatalf("unexpected topologyVersion counter: %v", counter)
+	}
+}
+
+func TestServerInfo(t *testing.T) {
+	cfg := &config.Config{Version: "4.4.1"}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(d bson.D) bson.D {
+		result, err := proxy.HandleMongo(context.TODO(), &plugins.Request{
+			CursorCache: proxy,
+			CC:          plugins.NewClientConnection(),
+		}, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bsonutil.Ok(result) {
+			t.Fatalf("command failed: %v", result)
+		}
+		return result
+	}
+
+	result := run(bson.D{{"buildInfo", 1}, {"$db", "admin"}})
+	if v, _ := bsonutil.Lookup(result, "version"); v != "4.4.1" {
+		t.Fatalf("unexpected version: %v", result)
+	}
+	if v, _ := bsonutil.Lookup(result, "versionArray"); !reflect.DeepEqual(v, []int32{4, 4, 1, 0}) {
+		t.Fatalf("unexpected versionArray: %v", result)
+	}
+
+	result = run(bson.D{{"serverStatus", 1}, {"$db", "admin"}})
+	if v, _ := bsonutil.Lookup(result, "pid"); v != int64(os.Getpid()) {
+		t.Fatalf("unexpected pid: %v", result)
+	}
+	if _, ok := bsonutil.Lookup(result, "connections", "current"); !ok {
+		t.Fatalf("missing connections: %v", result)
+	}
+	if v, _ := bsonutil.Lookup(result, "metrics", "commands", "buildInfo", "total"); v != int64(1) {
+		t.Fatalf("unexpected buildInfo count: %v", result)
+	}
+
+	// Sections can be excluded
+	result = run(bson.D{{"serverStatus", 1}, {"metrics", 0}, {"$db", "admin"}})
+	if _, ok := bsonutil.Lookup(result, "metrics"); ok {
+		t.Fatalf("metrics not excluded: %v", result)
+	}
+
+	result = run(bson.D{{"hostInfo", 1}, {"$db", "admin"}})
+	if v, _ := bsonutil.Lookup(result, "system", "numCores"); v != runtime.NumCPU() {
+		t.Fatalf("unexpected numCores: %v", result)
+	}
+}
+
+func TestCursorExpire(t *testing.T) {
+	timeout := "100ms"
+	cfg := &config.Config{IdleCursorTimeoutMillis: &timeout}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	killed := make(chan *plugins.CursorDownstream, 1)
+	proxy.pipeline.Store(proxy.newPipeline(cfg, []plugins.Plugin{
+		funcPlugin(func(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+			cmd, ok := r.Command.(*command.KillCursors)
+			if !ok {
+				t.Errorf("unexpected command: %T", r.Command)
+				return bson.D{{"ok", 1}}, nil
+			}
+			killed <- r.CursorCache.GetCursor(cmd.Cursors[0].(int64)).Downstream
+			return bson.D{{"ok", 1}}, nil
+		}),
+	}))
+
+	entry := proxy.NewCursor()
+	if entry.ID <= 0 {
+		t.Fatalf("invalid cursor id %d", entry.ID)
+	}
+	if other := proxy.NewCursor(); other.ID == entry.ID {
+		t.Fatalf("cursor id %d minted twice", entry.ID)
+	}
+	entry.Downstream = &plugins.CursorDownstream{Backend: "test", Server: "localhost:27017", ID: 42}
+	proxy.cursorCache.opened(entry.ID, plugins.NewClientConnection(), "test.foo", false)
+
+	// The backend must be able to find the downstream cursor to kill it
+	select {
+	case downstream := <-killed:
+		if downstream == nil || downstream.ID != 42 {
+			t.Fatalf("expected downstream cursor 42, got %v", downstream)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expired cursor was not killed")
+	}
+}
@@ -0,0 +1,218 @@
+package mongoproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+)
+
+var (
+	proxyProtocolCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_client_proxy_protocol_total",
+		Help: "The total number of client connections by PROXY protocol header result",
+	}, []string{"result"})
+
+	// proxyProtocolV2Sig is the signature starting a v2 header
+	proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyProtocolHeader = errors.New("invalid PROXY protocol header")
+)
+
+const (
+	// proxyProtocolV1MaxLen is the max length of a v1 header (including the CRLF)
+	proxyProtocolV1MaxLen = 107
+)
+
+// proxyProtocolListener reads a PROXY protocol header from connections from
+// trusted sources; the address in the header becomes the RemoteAddr of the conn
+type proxyProtocolListener struct {
+	net.Listener
+	cfg *config.ProxyProtocolConfig
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if tcpAddr, ok := c.RemoteAddr().(*net.TCPAddr); !ok || !l.cfg.Trusted(tcpAddr.IP) {
+		proxyProtocolCounter.WithLabelValues("untrusted").Inc()
+		return c, nil
+	}
+
+	// The header is read on first use so that a slow client doesn't block Accept
+	return &proxyProtocolConn{
+		Conn:    c,
+		r:       bufio.NewReader(c),
+		timeout: l.cfg.HeaderTimeoutDuration,
+	}, nil
+}
+
+// proxyProtocolConn is a connection starting with a PROXY protocol header
+type proxyProtocolConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.remoteAddr, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+
+		switch {
+		case c.err != nil:
+			proxyProtocolCounter.WithLabelValues("error").Inc()
+		case c.remoteAddr == nil:
+			proxyProtocolCounter.WithLabelValues("local").Inc()
+		default:
+			proxyProtocolCounter.WithLabelValues("success").Inc()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address from the header. If the header had no
+// address (e.g. a health check from the load balancer) or couldn't be read this
+// is the address of the peer.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remoteAddr
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header, returning the source
+// address. The address is nil if the header doesn't carry one (UNKNOWN/LOCAL).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// Every header is at least as long as the v2 signature
+	b, err := r.Peek(len(proxyProtocolV2Sig))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(b, proxyProtocolV2Sig) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(b, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	return nil, errProxyProtocolHeader
+}
+
+// readProxyHeaderV1 reads a v1 (text) header, e.g. "PROXY TCP4 1.2.3.4 5.6.7.8 1234 27017\r\n"
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyProtocolV1MaxLen {
+			return nil, errProxyProtocolHeader
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyProtocolHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return nil, errProxyProtocolHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errProxyProtocolHeader
+	}
+	if len(fields) != 6 {
+		return nil, errProxyProtocolHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("%v: invalid source address %s", errProxyProtocolHeader, fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%v: invalid source port %s", errProxyProtocolHeader, fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads a v2 (binary) header
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, len(proxyProtocolV2Sig)+4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	length := binary.BigEndian.Uint16(hdr[14:])
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%v: unknown version %d", errProxyProtocolHeader, verCmd>>4)
+	}
+	switch verCmd & 0xF {
+	case 0: // LOCAL: the connection is from the proxy itself
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("%v: unknown command %d", errProxyProtocolHeader, verCmd&0xF)
+	}
+
+	// The TLVs after the addresses are ignored
+	switch fam {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errProxyProtocolHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errProxyProtocolHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	default:
+		// UNSPEC, UDP or unix; there is no client address we can use
+		return nil, nil
+	}
+}
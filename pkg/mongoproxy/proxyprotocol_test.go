@@ -0,0 +1,130 @@
+package mongoproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+)
+
+func proxyHeaderV2(cmd, fam byte, addrs []byte) []byte {
+	b := append([]byte{}, proxyProtocolV2Sig...)
+	b = append(b, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		addr string // empty for no address
+		err  bool
+	}{
+		{in: []byte("PROXY TCP4 10.1.2.3 10.0.0.1 4567 27017\r\n"), addr: "10.1.2.3:4567"},
+		{in: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 4567 27017\r\n"), addr: "[2001:db8::1]:4567"},
+		{in: []byte("PROXY UNKNOWN\r\n")},
+		{in: []byte("PROXY TCP4 2001:db8::1 10.0.0.1 4567 27017\r\n"), err: true},
+		{in: []byte("PROXY TCP4 10.1.2.3 10.0.0.1 4567\r\n"), err: true},
+		{in: []byte("PROXY TCP4 10.1.2.3 10.0.0.1 4567 27017\n"), err: true},
+		{in: append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 200)...), err: true},
+		{in: []byte("GET / HTTP/1.1\r\n"), err: true},
+		{
+			in: proxyHeaderV2(1, 0x11, []byte{
+				10, 1, 2, 3, // src
+				10, 0, 0, 1, // dst
+				0x11, 0xd7, // src port 4567
+				0x69, 0x89, // dst port 27017
+			}),
+			addr: "10.1.2.3:4567",
+		},
+		{
+			in: proxyHeaderV2(1, 0x21, append(append(
+				net.ParseIP("2001:db8::1").To16(),
+				net.ParseIP("2001:db8::2").To16()...),
+				0x11, 0xd7, 0x69, 0x89,
+			)),
+			addr: "[2001:db8::1]:4567",
+		},
+		// LOCAL
+		{in: proxyHeaderV2(0, 0x00, nil)},
+		// Truncated addresses
+		{in: proxyHeaderV2(1, 0x11, []byte{10, 1, 2, 3}), err: true},
+		// Unknown command
+		{in: proxyHeaderV2(2, 0x11, make([]byte, 12)), err: true},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			// Anything after the header must be left for the client
+			r := bufio.NewReader(bytes.NewReader(append(test.in, []byte("data")...)))
+			addr, err := readProxyHeader(r)
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.err {
+				return
+			}
+
+			if test.addr == "" {
+				if addr != nil {
+					t.Fatalf("expected no address, got %v", addr)
+				}
+			} else if addr == nil || addr.String() != test.addr {
+				t.Fatalf("expected %s, got %v", test.addr, addr)
+			}
+
+			rest, _ := ioutil.ReadAll(r)
+			if string(rest) != "data" {
+				t.Fatalf("header not fully consumed, remaining: %q", rest)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	trusted := &config.ProxyProtocolConfig{TrustedCIDRs: []string{"127.0.0.0/8"}}
+	untrusted := &config.ProxyProtocolConfig{TrustedCIDRs: []string{"10.0.0.0/8"}}
+
+	for _, test := range []struct {
+		cfg  *config.ProxyProtocolConfig
+		host string
+	}{
+		{cfg: trusted, host: "10.1.2.3"},
+		// The header isn't parsed from untrusted sources
+		{cfg: untrusted, host: "127.0.0.1"},
+	} {
+		if err := test.cfg.Load(); err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := Listen(&config.ListenerConfig{Network: "tcp", Addr: "127.0.0.1:0", ProxyProtocol: test.cfg})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			c, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+			c.Write([]byte("PROXY TCP4 10.1.2.3 10.0.0.1 4567 27017\r\n"))
+		}()
+
+		c, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if host, _, _ := net.SplitHostPort(c.RemoteAddr().String()); host != test.host {
+			t.Fatalf("expected remote host %s, got %s", test.host, c.RemoteAddr())
+		}
+		c.Close()
+		l.Close()
+	}
+}
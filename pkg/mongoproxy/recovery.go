@@ -0,0 +1,138 @@
+package mongoproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongowire"
+)
+
+// Failures handling a single request (panics and unexpected errors) are returned to
+// the client as an error reply instead of closing the connection, so that one bad
+// request doesn't disconnect a pooled driver connection. Each failure is logged and
+// reported to Sentry with an incident ID, which is included in the error returned to
+// the client so the two can be matched up.
+
+var (
+	requestFailureCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_request_failures_total",
+		Help: "The total number of requests which failed with an internal error",
+	}, []string{"kind"})
+
+	errUnhandledOpcode = errors.New("unhandled opcode")
+	errInvalidMessage  = errors.New("invalid message")
+)
+
+// newIncidentID returns a random ID identifying a failure
+func newIncidentID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// reportIncident logs failure (a recovered panic, with its stack, or an error) of a
+// request from cc and reports it to Sentry. It returns the incident ID.
+func reportIncident(cc *plugins.ClientConnection, failure interface{}, stack []byte) string {
+	id := newIncidentID()
+
+	kind := "error"
+	if stack != nil {
+		kind = "panic"
+	}
+	requestFailureCounter.WithLabelValues(kind).Inc()
+
+	entry := logrus.NewEntry(logrus.StandardLogger()).WithFields(logrus.Fields{
+		"incident": id,
+		"client":   cc.GetAddr(),
+		"command":  cc.LastCommand(),
+	})
+	if stack != nil {
+		entry.Errorf("Panic handling request: %v\n%s", failure, stack)
+	} else {
+		entry.Errorf("Error handling request: %v", failure)
+	}
+
+	// The hub is shared by all connections, so the incident is tagged on a clone
+	hub := sentry.CurrentHub().Clone()
+	hub.ConfigureScope(func(scope *sentry.Scope) {
+		scope.SetTag("incident", id)
+		scope.SetTag("command", cc.LastCommand())
+	})
+	hub.Recover(failure)
+
+	return id
+}
+
+// requestFailed replies to the request (with the given header and opcode) with an
+// error for failure. It only returns an error, closing the connection, if the error
+// couldn't be sent to the client.
+func (p *Proxy) requestFailed(c *conn, hdr mongowire.MessageHeader, opCode mongowire.OpCode, failure interface{}, stack []byte, write replyWriter) error {
+	var errDoc bson.D
+	if failure == ErrServerClosed {
+		errDoc = mongoerror.ShutdownInProgress.ErrMessage("mongoproxy is shutting down")
+	} else {
+		id := reportIncident(c.cc, failure, stack)
+		errDoc = mongoerror.InternalError.ErrMessage("internal error in mongoproxy (incident " + id + ")")
+	}
+	return p.replyError(c, hdr, opCode, errDoc, write)
+}
+
+// replyError replies to a request with errDoc. Requests without a reply record the
+// error instead: legacy writes for getLastError, killCursors not at all.
+func (p *Proxy) replyError(c *conn, hdr mongowire.MessageHeader, opCode mongowire.OpCode, errDoc bson.D, write replyWriter) error {
+	switch opCode {
+	case mongowire.OpQuery, mongowire.OpGetMore:
+		reply := &mongowire.OP_REPLY{
+			Header:         hdr,
+			NumberReturned: 1,
+			Documents:      []bson.D{errDoc},
+		}
+		reply.Header.OpCode = mongowire.OpReply
+		reply.Header.ResponseTo = hdr.RequestID
+		return write(reply)
+
+	case mongowire.OpMsg:
+		reply := &mongowire.OP_MSG{
+			Header:   hdr,
+			Sections: []mongowire.MSGSection{mongowire.MSGSection_Body{errDoc}},
+		}
+		reply.Header.OpCode = mongowire.OpMsg
+		reply.Header.ResponseTo = hdr.RequestID
+		return write(reply)
+
+	case mongowire.OpInsert:
+		c.cc.LastError = legacyLastError("insert", errDoc)
+	case mongowire.OpUpdate:
+		c.cc.LastError = legacyLastError("update", errDoc)
+	case mongowire.OpDelete:
+		c.cc.LastError = legacyLastError("delete", errDoc)
+	case mongowire.OpKillCursors:
+
+	default:
+		return fmt.Errorf("can't reply to opcode %v", opCode)
+	}
+	return nil
+}
+
+// invalidMessage replies to a request which couldn't be parsed with err. An invalid
+// OP_COMPRESSED can't be replied to (the original opcode is unknown) so it closes the
+// connection.
+func (p *Proxy) invalidMessage(c *conn, req *mongowire.Request, err error, write replyWriter) error {
+	hdr := *req.GetHeader()
+	if hdr.OpCode == mongowire.OpCompressed {
+		logrus.Errorf("Invalid %v from %s: %v", hdr.OpCode, c.cc.GetAddr(), err)
+		return errInvalidMessage
+	}
+	logrus.Debugf("Invalid %v from %s: %v", hdr.OpCode, c.cc.GetAddr(), err)
+	return p.replyError(c, hdr, hdr.OpCode, mongoerror.FailedToParse.ErrMessage(fmt.Sprintf("invalid %v: %v", hdr.OpCode, err)), write)
+}
@@ -0,0 +1,190 @@
+package mongoproxy
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongowire"
+)
+
+func TestRequestRecovery(t *testing.T) {
+	cfg := &config.Config{Compressors: []string{"zlib"}}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.pipeline.Store(proxy.newPipeline(cfg, []plugins.Plugin{
+		funcPlugin(func(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+			switch r.Command.(type) {
+			case *command.Insert:
+				panic("bad insert")
+			case *command.Delete:
+				return nil, errors.New("bad delete")
+			case *command.Hello:
+				return next(ctx, r)
+			}
+			return bson.D{{"ok", 1}}, nil
+		}),
+	}))
+
+	cc := plugins.NewClientConnection()
+	c := &conn{p: proxy, cc: cc, unack: newUnackQueue(proxy, cc, cfg.UnacknowledgedWriteQueueSize)}
+	defer c.unack.close()
+
+	// run runs the message through handleOp and returns the replies
+	run := func(b []byte) []*mongowire.OP_MSG {
+		req, err := mongowire.ReadRequest(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var replies []*mongowire.OP_MSG
+		if err := proxy.handleOp(context.Background(), c, req, func(r mongowire.WireSerializer) error {
+			replies = append(replies, r.(*mongowire.OP_MSG))
+			return nil
+		}); err != nil {
+			t.Fatalf("request closed the connection: %v", err)
+		}
+		return replies
+	}
+	// handle runs the message through handleOp and returns the body of its reply
+	handle := func(m interface{ ToWire() ([]byte, error) }) bson.D {
+		b, err := m.ToWire()
+		if err != nil {
+			t.Fatal(err)
+		}
+		replies := run(b)
+		if len(replies) != 1 || replies[0].Header.ResponseTo != 42 {
+			t.Fatalf("unexpected replies: %v", replies)
+		}
+		return replies[0].Sections[0].(mongowire.MSGSection_Body).Document
+	}
+	msg := func(d bson.D) *mongowire.OP_MSG {
+		return &mongowire.OP_MSG{
+			Header:   mongowire.MessageHeader{RequestID: 42, OpCode: mongowire.OpMsg},
+			Sections: []mongowire.MSGSection{mongowire.MSGSection_Body{Document: d}},
+		}
+	}
+	checkError := func(result bson.D, code mongoerror.ErrorCode, errmsg string) {
+		t.Helper()
+		actualCode, _ := bsonutil.Lookup(result, "code")
+		actualErrmsg, _ := bsonutil.Lookup(result, "errmsg")
+		if bsonutil.Ok(result) || actualCode != int(code) || !strings.Contains(actualErrmsg.(string), errmsg) {
+			t.Fatalf("unexpected result: %v", result)
+		}
+	}
+
+	// Panics and errors in the pipeline are returned with an incident ID
+	checkError(handle(msg(bson.D{{"insert", "foo"}, {"documents", bson.A{bson.D{}}}, {"$db", "test"}})), mongoerror.InternalError, "incident")
+	checkError(handle(msg(bson.D{{"delete", "foo"}, {"deletes", bson.A{}}, {"$db", "test"}})), mongoerror.InternalError, "incident")
+
+	// The connection keeps working
+	if result := handle(msg(bson.D{{"find", "foo"}, {"$db", "test"}})); !bsonutil.Ok(result) {
+		t.Fatalf("unexpected result: %v", result)
+	}
+
+	// Messages which can't be decompressed
+	compressed := func(id wiremessage.CompressorID, size int32, b []byte) *mongowire.OP_COMPRESSED {
+		return &mongowire.OP_COMPRESSED{
+			Header:            mongowire.MessageHeader{RequestID: 42, OpCode: mongowire.OpCompressed},
+			OriginalOpcode:    mongowire.OpMsg,
+			UncompressedSize:  size,
+			CompressorID:      id,
+			CompressedMessage: b,
+		}
+	}
+	checkError(handle(compressed(wiremessage.CompressorZLib, 100, []byte("not zlib"))), mongoerror.BadValue, "compressor zlib wasn't negotiated")
+	if result := handle(msg(bson.D{{"hello", 1}, {"compression", bson.A{"snappy", "zlib"}}, {"$db", "admin"}})); !bsonutil.Ok(result) {
+		t.Fatalf("unexpected result: %v", result)
+	}
+	checkError(handle(compressed(wiremessage.CompressorSnappy, 100, []byte("not snappy"))), mongoerror.BadValue, "compressor snappy wasn't negotiated")
+	checkError(handle(compressed(wiremessage.CompressorZLib, 100, []byte("not zlib"))), mongoerror.BadValue, "error decompressing message")
+	checkError(handle(compressed(wiremessage.CompressorZLib, int32(cfg.MaxMessageSizeBytes), nil)), mongoerror.BadValue, "exceeds the maximum")
+	// More data than the message claims
+	var bomb bytes.Buffer
+	zw := zlib.NewWriter(&bomb)
+	zw.Write(make([]byte, 1<<20))
+	zw.Close()
+	checkError(handle(compressed(wiremessage.CompressorZLib, 100, bomb.Bytes())), mongoerror.BadValue, "decompresses to 101 bytes")
+
+	// An OP_COMPRESSED wrapping another one closes the connection without unwrapping it
+	inner, err := msg(bson.D{{"ping", 1}, {"$db", "admin"}}).ToWire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		nested := compressed(wiremessage.CompressorNoOp, int32(len(inner)-mongowire.HeaderLen), inner[mongowire.HeaderLen:])
+		if i > 0 {
+			nested.OriginalOpcode = mongowire.OpCompressed
+		}
+		if inner, err = nested.ToWire(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := mongowire.ReadRequest(bytes.NewReader(inner))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.handleOp(context.Background(), c, req, func(r mongowire.WireSerializer) error {
+		t.Fatalf("unexpected reply to a nested OP_COMPRESSED: %v", r)
+		return nil
+	}); err != errInvalidMessage {
+		t.Fatalf("unexpected error for a nested OP_COMPRESSED: %v", err)
+	}
+
+	// A panic in a legacy write is reported through getLastError
+	doc, err := bson.Marshal(bson.D{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := append([]byte{0, 0, 0, 0}, "test.foo\x00"...) // flags and the namespace
+	body = append(body, doc...)
+	hdr, err := mongowire.MessageHeader{MessageLength: int32(mongowire.HeaderLen + len(body)), RequestID: 42, OpCode: mongowire.OpInsert}.ToWire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replies := run(append(hdr, body...)); len(replies) != 0 {
+		t.Fatalf("unexpected replies to OP_INSERT: %v", replies)
+	}
+	if errmsg, _ := bsonutil.Lookup(proxy.getLastError(cc), "err"); errmsg == nil || !strings.Contains(errmsg.(string), "incident") {
+		t.Fatalf("unexpected getLastError: %v", proxy.getLastError(cc))
+	}
+
+	// A message which can't be parsed is replied to with an error
+	hdr, err = mongowire.MessageHeader{MessageLength: mongowire.HeaderLen + 5, RequestID: 42, OpCode: mongowire.OpMsg}.ToWire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	replies := run(append(hdr, 0, 0, 0, 0, 2)) // flags and an unknown section kind
+	if len(replies) != 1 || replies[0].Header.ResponseTo != 42 {
+		t.Fatalf("unexpected replies: %v", replies)
+	}
+	checkError(replies[0].Sections[0].(mongowire.MSGSection_Body).Document, mongoerror.FailedToParse, "unknown section kind 2")
+
+	// Unsupported query modifiers are an error rather than a panic
+	reply, err := proxy.handleOpQuery(context.Background(), cc, &mongowire.OP_QUERY{
+		FullCollectionName: "test.foo",
+		Query:              bson.D{{"$query", bson.D{}}, {"$foo", 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkError(reply.Documents[0], mongoerror.BadValue, "unsupported query modifier: $foo")
+}
@@ -0,0 +1,251 @@
+package mongoproxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+var (
+	sessionsActiveGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_sessions_active",
+		Help: "The number of logical sessions of clients tracked by the proxy",
+	})
+	sessionsEndedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_sessions_ended_total",
+		Help: "The total number of logical sessions no longer tracked by the proxy",
+	}, []string{"reason"})
+)
+
+const (
+	sessionEnded   = "ended"
+	sessionKilled  = "killed"
+	sessionExpired = "expired"
+)
+
+// sessionRegistry tracks the logical sessions (lsid) of clients: who started them and
+// the proxy state (cursors, pinned server) to clean up once they end. As all clients
+// share the proxy's downstream user, downstream can't tell their sessions apart.
+type sessionRegistry struct {
+	lock      sync.Mutex
+	sessions  map[string]*plugins.Session
+	lastSweep time.Time
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions:  make(map[string]*plugins.Session),
+		lastSweep: time.Now(),
+	}
+}
+
+// use returns the session lsid used by cc, starting it if it isn't tracked yet (nil
+// if lsid has no id). Sessions idle for longer than timeout are dropped.
+func (r *sessionRegistry) use(lsid bson.D, cc *plugins.ClientConnection, timeout time.Duration) *plugins.Session {
+	key, ok := plugins.LSIDKey(lsid)
+	if !ok {
+		return nil
+	}
+
+	r.lock.Lock()
+	r.sweep(timeout)
+	s, ok := r.sessions[key]
+	if !ok {
+		s = plugins.NewSession(key, lsid, cc)
+		r.sessions[key] = s
+		sessionsActiveGauge.Inc()
+	}
+	r.lock.Unlock()
+
+	s.Touch()
+	return s
+}
+
+// sweep drops the sessions idle for longer than timeout; downstream has expired
+// them as well. This must be called with the lock held.
+func (r *sessionRegistry) sweep(timeout time.Duration) {
+	now := time.Now()
+	if now.Sub(r.lastSweep) < timeout/2 {
+		return
+	}
+	r.lastSweep = now
+	for key, s := range r.sessions {
+		if now.Sub(s.LastUsed()) > timeout {
+			delete(r.sessions, key)
+			sessionsActiveGauge.Dec()
+			sessionsEndedCounter.WithLabelValues(sessionExpired).Inc()
+		}
+	}
+}
+
+// get returns the session with key (nil if it isn't tracked)
+func (r *sessionRegistry) get(key string) *plugins.Session {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.sessions[key]
+}
+
+// remove stops tracking the session, returning whether it was
+func (r *sessionRegistry) remove(key, reason string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.sessions[key]; !ok {
+		return false
+	}
+	delete(r.sessions, key)
+	sessionsActiveGauge.Dec()
+	sessionsEndedCounter.WithLabelValues(reason).Inc()
+	return true
+}
+
+// list returns the tracked sessions
+func (r *sessionRegistry) list() []*plugins.Session {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sessions := make([]*plugins.Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// count returns the number of tracked sessions
+func (r *sessionRegistry) count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.sessions)
+}
+
+// sessionTimeout returns how long a session may be idle before it expires
+func (p *Proxy) sessionTimeout() time.Duration {
+	minutes, ok := p.getPipeline().logicalSessionTimeout()
+	if !ok {
+		minutes = int64(defaultSessionTimeout)
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// checkSession attaches the session of the request (if any) to it. This returns an
+// error doc if the session was started by a different user. endSessions is limited to
+// the sessions the client started; if there are none left we respond without
+// sending it on.
+func (p *Proxy) checkSession(req *plugins.Request) bson.D {
+	if req.CC == nil || req.CC == p.internalCC {
+		return nil
+	}
+
+	if cmd, ok := req.Command.(*command.EndSessions); ok {
+		var ids []bsoncore.Document
+		for _, doc := range cmd.SessionIDs {
+			if s := p.sessions.get(plugins.SessionIDKey(doc)); s != nil && s.Owner.CoauthorizedWith(req.CC) {
+				ids = append(ids, doc)
+			}
+		}
+		if len(ids) == 0 {
+			return bson.D{{"ok", 1}}
+		}
+		cmd.SessionIDs = ids
+	}
+
+	session := req.Command.GetSession()
+	if session == nil || session.LSID == nil {
+		return nil
+	}
+	s := p.sessions.use(session.LSID, req.CC, p.sessionTimeout())
+	if s == nil {
+		return nil
+	}
+	if !s.Owner.CoauthorizedWith(req.CC) {
+		return mongoerror.Unauthorized.ErrMessage("Cannot use session which was started by a different user")
+	}
+	req.Session = s
+
+	return nil
+}
+
+// recordSession cleans up the sessions ended (or killed) by the request and records
+// a cursor opened in the session of the request
+func (p *Proxy) recordSession(req *plugins.Request, resp bson.D) {
+	if req.CC == nil || req.CC == p.internalCC || !bsonutil.Ok(resp) {
+		return
+	}
+
+	switch cmd := req.Command.(type) {
+	case *command.EndSessions:
+		// checkSession left only the sessions of the client
+		for _, doc := range cmd.SessionIDs {
+			if s := p.sessions.get(plugins.SessionIDKey(doc)); s != nil {
+				p.endSession(s, sessionEnded)
+			}
+		}
+		return
+
+	case *command.KillAllSessions:
+		for _, s := range p.sessions.list() {
+			if sessionMatches(s, cmd.KillAllSessions) {
+				p.endSession(s, sessionKilled)
+			}
+		}
+		return
+
+	case *command.GetMore:
+		return
+	}
+
+	if req.Session == nil {
+		return
+	}
+	v, ok := bsonutil.Lookup(resp, "cursor", "id")
+	if !ok {
+		return
+	}
+	if cursorID, ok := v.(int64); ok && cursorID != 0 {
+		// Drop the cursors of the session that have since been closed
+		for _, id := range req.Session.Cursors() {
+			if !p.cursorCache.isOpen(id) {
+				req.Session.RemoveCursor(id)
+			}
+		}
+		req.Session.AddCursor(cursorID)
+	}
+}
+
+// endSession stops tracking the session and kills the cursors still open in it
+func (p *Proxy) endSession(s *plugins.Session, reason string) {
+	if !p.sessions.remove(s.Key, reason) {
+		return
+	}
+	logrus.Debugf("Session %s %s", s.LSID, reason)
+	for _, cursorID := range s.Cursors() {
+		if p.cursorCache.isOpen(cursorID) {
+			p.killCursor(cursorID)
+		}
+	}
+}
+
+// sessionMatches returns whether the session was started by one of the users of
+// filters (all sessions match no filters). Users without a database (e.g. the
+// internal identity) match a filter by name alone.
+func sessionMatches(s *plugins.Session, filters []command.KillAllSessionsFilter) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, f := range filters {
+		for _, u := range s.Owner.Users {
+			if u == f.User || u == f.User+"@"+f.DB {
+				return true
+			}
+		}
+	}
+	return false
+}
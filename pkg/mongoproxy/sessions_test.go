@@ -0,0 +1,122 @@
+package mongoproxy
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoerror"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+)
+
+func TestSessions(t *testing.T) {
+	cfg := &config.Config{}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		nextCursor int64 = 5
+		received   []string
+		killed     []int64
+	)
+	proxy.pipeline.Store(proxy.newPipeline(cfg, []plugins.Plugin{
+		funcPlugin(func(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+			received = append(received, r.CommandName)
+			switch cmd := r.Command.(type) {
+			case *command.Find:
+				nextCursor++
+				return bson.D{
+					{"cursor", bson.D{{"id", nextCursor}, {"ns", "test.foo"}, {"firstBatch", bson.A{}}}},
+					{"ok", 1},
+				}, nil
+			case *command.KillCursors:
+				for _, v := range cmd.Cursors {
+					killed = append(killed, v.(int64))
+				}
+				return bson.D{{"cursorsKilled", cmd.Cursors}, {"ok", 1}}, nil
+			default:
+				return bson.D{{"ok", 1}}, nil
+			}
+		}),
+	}))
+
+	lsid := bson.D{{"id", primitive.Binary{Subtype: 4, Data: []byte("0123456789abcdef")}}}
+	otherLSID := bson.D{{"id", primitive.Binary{Subtype: 4, Data: []byte("fedcba9876543210")}}}
+
+	alice := plugins.NewClientConnection()
+	alice.SetIdentities([]plugins.ClientIdentity{plugins.NewStaticIdentity("test", "alice")})
+	bob := plugins.NewClientConnection()
+	bob.SetIdentities([]plugins.ClientIdentity{plugins.NewStaticIdentity("test", "bob")})
+
+	run := func(cc *plugins.ClientConnection, d bson.D) bson.D {
+		received = nil
+		result, err := proxy.HandleMongo(context.Background(), &plugins.Request{CC: cc, CursorCache: proxy}, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	code := func(result bson.D) int {
+		for _, e := range result {
+			if e.Key == "code" {
+				return e.Value.(int)
+			}
+		}
+		return 0
+	}
+
+	run(alice, bson.D{{"find", "foo"}, {"$db", "test"}, {"lsid", lsid}})
+	key, _ := plugins.LSIDKey(lsid)
+	s := proxy.sessions.get(key)
+	if s == nil {
+		t.Fatal("session not tracked")
+	}
+	if cursors := s.Cursors(); len(cursors) != 1 || cursors[0] != 6 {
+		t.Fatalf("expected cursor 6 in the session, got %v", cursors)
+	}
+
+	// Only the user who started a session may use it
+	if c := code(run(bob, bson.D{{"ping", 1}, {"$db", "test"}, {"lsid", lsid}})); c != int(mongoerror.Unauthorized) {
+		t.Fatalf("expected Unauthorized using another user's session, got %d", c)
+	}
+	run(bob, bson.D{{"endSessions", bson.A{lsid}}, {"$db", "admin"}})
+	if len(received) != 0 {
+		t.Fatalf("endSessions of another user's session was sent on: %v", received)
+	}
+	if proxy.sessions.get(key) == nil {
+		t.Fatal("session ended by another user")
+	}
+
+	// Ending the session kills its cursors
+	run(alice, bson.D{{"endSessions", bson.A{lsid}}, {"$db", "admin"}})
+	if proxy.sessions.get(key) != nil {
+		t.Fatal("session still tracked after endSessions")
+	}
+	if len(killed) != 1 || killed[0] != 6 {
+		t.Fatalf("expected cursor 6 to be killed, got %v", killed)
+	}
+	if proxy.cursorCache.isOpen(6) {
+		t.Fatal("cursor still open after endSessions")
+	}
+
+	// killAllSessions only kills the sessions of the users in the filter
+	run(alice, bson.D{{"ping", 1}, {"$db", "test"}, {"lsid", lsid}})
+	run(bob, bson.D{{"ping", 1}, {"$db", "test"}, {"lsid", otherLSID}})
+	run(bob, bson.D{{"killAllSessions", bson.A{bson.D{{"user", "alice"}, {"db", "admin"}}}}, {"$db", "admin"}})
+	if proxy.sessions.get(key) != nil {
+		t.Fatal("session of alice still tracked after killAllSessions")
+	}
+	if n := proxy.sessions.count(); n != 1 {
+		t.Fatalf("expected 1 session, got %d", n)
+	}
+}
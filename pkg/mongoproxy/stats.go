@@ -0,0 +1,89 @@
+package mongoproxy
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// stats are the counters reported by serverStatus. These mirror the prometheus
+// metrics (e.g. clientMessageCounter) which we can't easily read back.
+type stats struct {
+	start time.Time
+
+	connectionsCreated int64
+
+	lock     sync.Mutex
+	opcodes  map[string]int64
+	commands map[string]int64
+}
+
+func newStats() *stats {
+	return &stats{
+		start:    time.Now(),
+		opcodes:  make(map[string]int64),
+		commands: make(map[string]int64),
+	}
+}
+
+func (s *stats) connectionCreated() {
+	atomic.AddInt64(&s.connectionsCreated, 1)
+}
+
+func (s *stats) opcode(name string) {
+	s.lock.Lock()
+	s.opcodes[name]++
+	s.lock.Unlock()
+}
+
+func (s *stats) command(name string) {
+	s.lock.Lock()
+	s.commands[name]++
+	s.lock.Unlock()
+}
+
+// opcounters returns the counts in the format of serverStatus "opcounters"
+func (s *stats) opcounters() bson.D {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var command int64
+	for name, count := range s.commands {
+		switch name {
+		case "insert", "find", "update", "delete", "getMore":
+		default:
+			command += count
+		}
+	}
+
+	return bson.D{
+		{"insert", s.commands["insert"]},
+		{"query", s.commands["find"]},
+		{"update", s.commands["update"]},
+		{"delete", s.commands["delete"]},
+		{"getmore", s.commands["getMore"]},
+		{"command", command},
+	}
+}
+
+// counts returns the per-opcode and per-command counts
+func (s *stats) counts() (opcodes, commands bson.D) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	opcodes = make(bson.D, 0, len(s.opcodes))
+	for name, count := range s.opcodes {
+		opcodes = append(opcodes, bson.E{name, count})
+	}
+	commands = make(bson.D, 0, len(s.commands))
+	for name, count := range s.commands {
+		commands = append(commands, bson.E{name, bson.D{{"total", count}}})
+	}
+
+	sort.Slice(opcodes, func(i, j int) bool { return opcodes[i].Key < opcodes[j].Key })
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Key < commands[j].Key })
+	return opcodes, commands
+}
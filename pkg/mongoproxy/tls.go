@@ -0,0 +1,173 @@
+package mongoproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+)
+
+var (
+	tlsReloadCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_tls_reload_total",
+		Help: "The total number of TLS certificate reloads",
+	}, []string{"success"})
+)
+
+// NewTLSListener wraps the listener with TLS using the given config. The returned
+// CertReloader will reload the certificates from disk as they change until it is closed.
+func NewTLSListener(l net.Listener, cfg *config.TLSConfig) (net.Listener, *CertReloader, error) {
+	r, err := NewCertReloader(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.Start()
+
+	return tls.NewListener(l, r.TLSConfig()), r, nil
+}
+
+// CertReloader holds the current TLS server config and reloads the certificates
+// from disk whenever the files change.
+type CertReloader struct {
+	cfg *config.TLSConfig
+
+	current  atomic.Value // *tls.Config
+	modTimes map[string]time.Time
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+func NewCertReloader(cfg *config.TLSConfig) (*CertReloader, error) {
+	r := &CertReloader{
+		cfg:  cfg,
+		stop: make(chan struct{}),
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// TLSConfig returns a tls.Config that always uses the latest loaded certificates
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current.Load().(*tls.Config), nil
+		},
+	}
+}
+
+// Reload loads the certificates from disk
+func (r *CertReloader) Reload() (err error) {
+	defer func() {
+		if err != nil {
+			tlsReloadCounter.WithLabelValues("false").Inc()
+		} else {
+			tlsReloadCounter.WithLabelValues("true").Inc()
+		}
+	}()
+
+	modTimes, err := r.fileModTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   r.cfg.ClientAuthType,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if r.cfg.ClientCAFile != "" {
+		b, err := ioutil.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates found in %s", r.cfg.ClientCAFile)
+		}
+		tlsCfg.ClientCAs = pool
+	}
+
+	r.current.Store(tlsCfg)
+	r.modTimes = modTimes
+
+	return nil
+}
+
+func (r *CertReloader) fileModTimes() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time, 3)
+	for _, pth := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.ClientCAFile} {
+		if pth == "" {
+			continue
+		}
+		info, err := os.Stat(pth)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[pth] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (r *CertReloader) changed() bool {
+	modTimes, err := r.fileModTimes()
+	if err != nil {
+		logrus.Errorf("Error checking TLS files: %v", err)
+		return false
+	}
+	for pth, t := range modTimes {
+		if !t.Equal(r.modTimes[pth]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Start starts the background reload loop
+func (r *CertReloader) Start() {
+	go func() {
+		ticker := time.NewTicker(r.cfg.ReloadIntervalDuration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				if !r.changed() {
+					continue
+				}
+				if err := r.Reload(); err != nil {
+					logrus.Errorf("Error reloading TLS certificates: %v", err)
+				} else {
+					logrus.Infof("Reloaded TLS certificates")
+				}
+			}
+		}
+	}()
+}
+
+// Close stops the background reload loop
+func (r *CertReloader) Close() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
@@ -0,0 +1,50 @@
+package mongoproxy
+
+import (
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// topology tracks the topologyVersion of the proxy. Clients doing an awaitable
+// hello/isMaster wait for it to change (e.g. on a config reload) before they get
+// a response.
+type topology struct {
+	processID primitive.ObjectID
+
+	lock    sync.Mutex
+	counter int64
+	changed chan struct{}
+}
+
+func newTopology() *topology {
+	return &topology{
+		processID: primitive.NewObjectID(),
+		changed:   make(chan struct{}),
+	}
+}
+
+// version returns the current counter and a channel which is closed when it changes
+func (t *topology) version() (int64, <-chan struct{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.counter, t.changed
+}
+
+// increment changes the topologyVersion, waking any waiting clients
+func (t *topology) increment() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.counter++
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// document returns the topologyVersion for a counter as sent to clients
+func (t *topology) document(counter int64) bson.D {
+	return bson.D{
+		{"processId", t.processID},
+		{"counter", counter},
+	}
+}
@@ -0,0 +1,121 @@
+package mongoproxy
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+
+	"github.com/wish/mongoproxy/pkg/bsonutil"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongowire"
+)
+
+var (
+	unackWriteCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_client_unacknowledged_writes_total",
+		Help: "The total number of unacknowledged (moreToCome) writes from clients",
+	}, []string{"status"})
+	unackWriteQueueGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_client_unacknowledged_writes_queued",
+		Help: "The current number of unacknowledged writes queued across all client connections",
+	})
+)
+
+// unackQueue runs the unacknowledged (OP_MSG moreToCome) writes of a client
+// connection. The writes run in the background in the order they were received;
+// any other request on the connection must wait for the queue to drain so that
+// it is ordered after the writes. The queue is bounded, once it is full we stop
+// reading from the client (backpressure).
+type unackQueue struct {
+	p  *Proxy
+	cc *plugins.ClientConnection
+
+	size    int
+	ch      chan *mongowire.OP_MSG
+	start   sync.Once
+	pending sync.WaitGroup
+}
+
+func newUnackQueue(p *Proxy, cc *plugins.ClientConnection, size int) *unackQueue {
+	return &unackQueue{
+		p:    p,
+		cc:   cc,
+		size: size,
+	}
+}
+
+// enqueue adds a write to the queue, blocking while the queue is full
+func (q *unackQueue) enqueue(m *mongowire.OP_MSG) {
+	// Most connections never send an unacknowledged write, so only start the
+	// worker once they do
+	q.start.Do(func() {
+		q.ch = make(chan *mongowire.OP_MSG, q.size)
+		go q.run()
+	})
+
+	q.pending.Add(1)
+	unackWriteQueueGauge.Inc()
+	q.ch <- m
+}
+
+// wait blocks until all queued writes have completed
+func (q *unackQueue) wait() {
+	q.pending.Wait()
+}
+
+// close runs any remaining queued writes and stops the worker
+func (q *unackQueue) close() {
+	q.start.Do(func() {}) // prevent a start after close
+	if q.ch != nil {
+		close(q.ch)
+	}
+	q.pending.Wait()
+}
+
+func (q *unackQueue) run() {
+	for m := range q.ch {
+		unackWriteQueueGauge.Dec()
+		q.handle(m)
+		q.pending.Done()
+	}
+}
+
+func (q *unackQueue) handle(m *mongowire.OP_MSG) {
+	// Nobody is waiting for a reply, so failures are only reported
+	defer func() {
+		if SKIP_RECOVER {
+			return
+		}
+		if r := recover(); r != nil {
+			reportIncident(q.cc, r, debug.Stack())
+			unackWriteCounter.WithLabelValues("dropped").Inc()
+		}
+	}()
+
+	// The client has sent the write, so it must be run even if the client goes
+	// away; we don't use the connection's context for it
+	reply, err := q.p.handleOpMsg(context.Background(), q.cc, m)
+	if err != nil {
+		logrus.Errorf("Error handling unacknowledged write: %v", err)
+		unackWriteCounter.WithLabelValues("dropped").Inc()
+		return
+	}
+
+	for _, section := range reply.Sections {
+		body, ok := section.(mongowire.MSGSection_Body)
+		if !ok {
+			continue
+		}
+		_, hasWriteErrors := bsonutil.Lookup(body.Document, "writeErrors")
+		if !bsonutil.Ok(body.Document) || hasWriteErrors {
+			logrus.Debugf("Unacknowledged write failed: %v", body.Document)
+			unackWriteCounter.WithLabelValues("failed").Inc()
+			return
+		}
+	}
+	unackWriteCounter.WithLabelValues("success").Inc()
+}
@@ -0,0 +1,80 @@
+package mongoproxy
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/wish/mongoproxy/pkg/command"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/config"
+	"github.com/wish/mongoproxy/pkg/mongoproxy/plugins"
+	"github.com/wish/mongoproxy/pkg/mongowire"
+)
+
+type funcPlugin func(context.Context, *plugins.Request, plugins.PipelineFunc) (bson.D, error)
+
+func (f funcPlugin) Name() string             { return "func" }
+func (f funcPlugin) Configure(d bson.D) error { return nil }
+func (f funcPlugin) Process(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+	return f(ctx, r, next)
+}
+
+func TestUnackQueue(t *testing.T) {
+	cfg := &config.Config{UnacknowledgedWriteQueueSize: 2}
+	if err := cfg.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := NewProxy(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		lock  sync.Mutex
+		order []string
+	)
+	proxy.pipeline.Store(proxy.newPipeline(cfg, []plugins.Plugin{
+		funcPlugin(func(ctx context.Context, r *plugins.Request, next plugins.PipelineFunc) (bson.D, error) {
+			// Slow down the writes to catch anything running out of order
+			time.Sleep(time.Millisecond)
+			lock.Lock()
+			order = append(order, r.Command.(*command.Insert).Collection)
+			lock.Unlock()
+			return bson.D{{"ok", 1}}, nil
+		}),
+	}))
+
+	q := newUnackQueue(proxy, plugins.NewClientConnection(), cfg.UnacknowledgedWriteQueueSize)
+
+	expected := []string{"a", "b", "c", "d", "e"}
+	for _, coll := range expected {
+		q.enqueue(&mongowire.OP_MSG{
+			Flags: 1 << 1, // moreToCome
+			Sections: []mongowire.MSGSection{
+				mongowire.MSGSection_Body{Document: bson.D{
+					{"insert", coll},
+					{"documents", bson.A{bson.D{{"_id", 1}}}},
+					{"$db", "test"},
+				}},
+			},
+		})
+	}
+	q.wait()
+
+	lock.Lock()
+	if len(order) != len(expected) {
+		t.Fatalf("expected %d writes, got %v", len(expected), order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("writes out of order: %v", order)
+		}
+	}
+	lock.Unlock()
+
+	q.close()
+}
@@ -0,0 +1,103 @@
+package mongowire
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+)
+
+// zstdMaxWindow is the largest zstd window allowed regardless of the message size; it is
+// the default window of encoders
+const zstdMaxWindow = 8 << 20
+
+// CompressorName returns the name a compressor is negotiated with in hello
+func CompressorName(id wiremessage.CompressorID) string {
+	switch id {
+	case wiremessage.CompressorNoOp:
+		return "noop"
+	case wiremessage.CompressorSnappy:
+		return "snappy"
+	case wiremessage.CompressorZLib:
+		return "zlib"
+	case wiremessage.CompressorZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown(%d)", id)
+	}
+}
+
+// Decompress returns the decompressed message. The message must decompress to exactly
+// UncompressedSize bytes and no more than that is decompressed, so the caller bounds
+// the memory used by bounding UncompressedSize.
+func (o *OP_COMPRESSED) Decompress() ([]byte, error) {
+	size := int(o.UncompressedSize)
+	if size < 0 {
+		return nil, fmt.Errorf("invalid uncompressed size %d", size)
+	}
+
+	var b []byte
+	switch o.CompressorID {
+	case wiremessage.CompressorNoOp:
+		b = o.CompressedMessage
+
+	case wiremessage.CompressorSnappy:
+		// Decode allocates whatever the frame says it decodes to, so that is checked first
+		n, err := snappy.DecodedLen(o.CompressedMessage)
+		if err != nil {
+			return nil, err
+		}
+		if n != size {
+			return nil, fmt.Errorf("message decompresses to %d bytes, expected %d", n, size)
+		}
+		b, err = snappy.Decode(make([]byte, size), o.CompressedMessage)
+		if err != nil {
+			return nil, err
+		}
+
+	case wiremessage.CompressorZLib:
+		r, err := zlib.NewReader(bytes.NewReader(o.CompressedMessage))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		if b, err = readUncompressed(r, size); err != nil {
+			return nil, err
+		}
+
+	case wiremessage.CompressorZstd:
+		// The decoder allocates the window the frame asks for, so that is bounded (a
+		// window larger than the message is only allowed up to the size encoders use)
+		maxWindow := uint64(zstdMaxWindow)
+		if uint64(size) > maxWindow {
+			maxWindow = uint64(size)
+		}
+		r, err := zstd.NewReader(bytes.NewReader(o.CompressedMessage), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxWindow))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		if b, err = readUncompressed(r, size); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown compressor %s", CompressorName(o.CompressorID))
+	}
+
+	if len(b) != size {
+		return nil, fmt.Errorf("message decompresses to %d bytes, expected %d", len(b), size)
+	}
+	return b, nil
+}
+
+// readUncompressed reads the decompressed message from r, reading at most one byte
+// more than size (enough to tell that the message is larger)
+func readUncompressed(r io.Reader, size int) ([]byte, error) {
+	return ioutil.ReadAll(io.LimitReader(r, int64(size)+1))
+}
@@ -0,0 +1,228 @@
+package mongowire
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+)
+
+// The fuzz targets check that malformed messages are returned as errors rather than
+// panicking (or allocating more than the message holds). The readers are limited to
+// the message as they are when read by ReadRequest.
+
+func limitedReader(b []byte) *io.LimitedReader {
+	return &io.LimitedReader{R: bytes.NewReader(b), N: int64(len(b))}
+}
+
+func mustMarshal(t testing.TB, d bson.D) []byte {
+	b, err := bson.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func FuzzOPMsgFromWire(f *testing.F) {
+	for _, m := range []*OP_MSG{
+		{Sections: []MSGSection{MSGSection_Body{bson.D{{"ping", 1}, {"$db", "admin"}}}}},
+		{Sections: []MSGSection{
+			MSGSection_Body{bson.D{{"insert", "foo"}, {"$db", "test"}}},
+			MSGSection_DocumentSequence{SequenceIdentifier: "documents", Documents: []bson.D{{{"a", 1}}, {{"b", 2}}}},
+		}},
+	} {
+		b, err := m.ToWire()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b[HeaderLen:])
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m := &OP_MSG{}
+		if err := m.FromWire(limitedReader(b), nil, len(b)); err != nil {
+			return
+		}
+		if _, err := m.ToWire(); err != nil {
+			t.Fatalf("error serializing parsed message: %v", err)
+		}
+	})
+}
+
+func FuzzOPQueryFromWire(f *testing.F) {
+	query := append([]byte{0, 0, 0, 0}, "admin.$cmd\x00"...)
+	query = append(query, 0, 0, 0, 0, 255, 255, 255, 255) // skip and return
+	query = append(query, mustMarshal(f, bson.D{{"isMaster", 1}})...)
+	f.Add(query)
+	f.Add(append(query, mustMarshal(f, bson.D{{"_id", 0}})...))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m := &OP_QUERY{}
+		if err := m.FromWire(limitedReader(b)); err == nil && m.Query == nil {
+			t.Fatalf("parsed OP_QUERY without a query")
+		}
+	})
+}
+
+func FuzzOPCompressedFromWire(f *testing.F) {
+	b, err := (&OP_COMPRESSED{
+		OriginalOpcode:    OpMsg,
+		UncompressedSize:  100,
+		CompressorID:      wiremessage.CompressorZLib,
+		CompressedMessage: []byte("compressed"),
+	}).ToWire()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(b[HeaderLen:])
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m := &OP_COMPRESSED{Header: MessageHeader{MessageLength: int32(HeaderLen + len(b)), OpCode: OpCompressed}}
+		if err := m.FromWire(limitedReader(b)); err == nil && len(m.CompressedMessage) != len(b)-9 {
+			t.Fatalf("compressed message of %d bytes in a message of %d", len(m.CompressedMessage), len(b))
+		}
+	})
+}
+
+var (
+	// snappyHuge is a snappy frame claiming to decode to 2GiB
+	snappyHuge = []byte{0x80, 0x80, 0x80, 0x80, 0x08, 0}
+	// zstdHugeWindow is an (empty) zstd frame with a 1GiB window
+	zstdHugeWindow = []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 20 << 3, 0x01, 0x00, 0x00}
+)
+
+// compressTestData returns data compressed with each compressor
+func compressTestData(t testing.TB, data []byte) map[wiremessage.CompressorID][]byte {
+	var zlibBuf bytes.Buffer
+	zw := zlib.NewWriter(&zlibBuf)
+	zw.Write(data)
+	zw.Close()
+
+	zstdEncoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zstdEncoder.Close()
+
+	return map[wiremessage.CompressorID][]byte{
+		wiremessage.CompressorNoOp:   data,
+		wiremessage.CompressorSnappy: snappy.Encode(nil, data),
+		wiremessage.CompressorZLib:   zlibBuf.Bytes(),
+		wiremessage.CompressorZstd:   zstdEncoder.EncodeAll(data, nil),
+	}
+}
+
+func FuzzOPCompressedDecompress(f *testing.F) {
+	for id, b := range compressTestData(f, []byte("a message to compress")) {
+		f.Add(uint8(id), uint16(21), b)
+	}
+	// Small frames claiming to decode to 2GiB and needing a 1GiB window
+	f.Add(uint8(wiremessage.CompressorSnappy), uint16(21), snappyHuge)
+	f.Add(uint8(wiremessage.CompressorZstd), uint16(21), zstdHugeWindow)
+
+	f.Fuzz(func(t *testing.T, id uint8, size uint16, b []byte) {
+		m := &OP_COMPRESSED{CompressorID: wiremessage.CompressorID(id), UncompressedSize: int32(size), CompressedMessage: b}
+		if out, err := m.Decompress(); err == nil && len(out) != int(size) {
+			t.Fatalf("decompressed %d bytes, expected %d", len(out), size)
+		}
+	})
+}
+
+func TestDecompress(t *testing.T) {
+	data := []byte("a message to compress")
+	for id, b := range compressTestData(t, data) {
+		m := &OP_COMPRESSED{CompressorID: id, UncompressedSize: int32(len(data)), CompressedMessage: b}
+		if out, err := m.Decompress(); err != nil || !bytes.Equal(out, data) {
+			t.Errorf("%s: unexpected result %q: %v", CompressorName(id), out, err)
+		}
+
+		// The message must decompress to exactly the size it claims
+		m.UncompressedSize = int32(len(data) - 1)
+		if _, err := m.Decompress(); err == nil {
+			t.Errorf("%s: expected an error for a larger message", CompressorName(id))
+		}
+		m.UncompressedSize = int32(len(data) + 1)
+		if _, err := m.Decompress(); err == nil {
+			t.Errorf("%s: expected an error for a smaller message", CompressorName(id))
+		}
+	}
+
+	// Small messages which decompress to much more than they claim are rejected
+	// without decompressing them
+	for id, b := range compressTestData(t, make([]byte, 64<<20)) {
+		m := &OP_COMPRESSED{CompressorID: id, UncompressedSize: 100, CompressedMessage: b}
+		if _, err := m.Decompress(); err == nil || !strings.Contains(err.Error(), "expected 100") {
+			t.Errorf("%s: unexpected error %v", CompressorName(id), err)
+		}
+	}
+	m := &OP_COMPRESSED{CompressorID: wiremessage.CompressorSnappy, UncompressedSize: 100, CompressedMessage: snappyHuge}
+	if _, err := m.Decompress(); err == nil || !strings.Contains(err.Error(), "2147483648") {
+		t.Errorf("unexpected error for a snappy frame claiming 2GiB: %v", err)
+	}
+	m = &OP_COMPRESSED{CompressorID: wiremessage.CompressorZstd, UncompressedSize: 100, CompressedMessage: zstdHugeWindow}
+	if _, err := m.Decompress(); err != zstd.ErrWindowSizeExceeded {
+		t.Errorf("unexpected error for a zstd frame with a 1GiB window: %v", err)
+	}
+}
+
+func TestMalformedMessages(t *testing.T) {
+	body := mustMarshal(t, bson.D{{"ping", 1}})
+	int32Bytes := func(n int32) []byte {
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, uint32(n))
+		return b
+	}
+	concat := func(bs ...[]byte) []byte {
+		return bytes.Join(bs, nil)
+	}
+
+	for name, b := range map[string][]byte{
+		"empty":                 {},
+		"no body":               int32Bytes(0),
+		"two bodies":            concat(int32Bytes(0), []byte{0}, body, []byte{0}, body),
+		"unknown section kind":  concat(int32Bytes(0), []byte{0}, body, []byte{2}),
+		"short document":        concat(int32Bytes(0), []byte{0}, int32Bytes(4)),
+		"truncated document":    concat(int32Bytes(0), []byte{0}, body[:len(body)-1]),
+		"huge document":         concat(int32Bytes(0), []byte{0}, int32Bytes(1<<30)),
+		"negative sequence":     concat(int32Bytes(0), []byte{0}, body, []byte{1}, int32Bytes(-1)),
+		"oversized sequence":    concat(int32Bytes(0), []byte{0}, body, []byte{1}, int32Bytes(1<<20), []byte("documents\x00")),
+		"unterminated sequence": concat(int32Bytes(0), []byte{0}, body, []byte{1}, int32Bytes(8), []byte("docu")),
+	} {
+		m := &OP_MSG{}
+		if err := m.FromWire(limitedReader(b), nil, len(b)); err == nil {
+			t.Errorf("%s: expected an error, got %v", name, m)
+		}
+	}
+
+	// A message larger than the max is rejected before its body is read
+	hdr, err := MessageHeader{MessageLength: 1 << 30, OpCode: OpMsg}.ToWire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadRequestLimit(bytes.NewReader(hdr), 1<<20); err == nil {
+		t.Fatalf("expected an error reading an oversized message")
+	}
+
+	// A truncated message only uses memory for what was sent of it
+	hdr, err = MessageHeader{MessageLength: DefaultMaxMessageSize, OpCode: OpMsg}.ToWire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := ReadRequest(bytes.NewReader(append(hdr, body...))); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error reading a truncated message: %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatalf("allocated %d bytes reading a truncated message", allocated)
+	}
+}
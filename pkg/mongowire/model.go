@@ -63,13 +63,15 @@ func (m *OP_QUERY) GetHeader() MessageHeader {
 	return m.Header
 }
 
-func (m *OP_QUERY) FromWire(r io.Reader) {
-	m.Flags = OP_QUERY_Flags(MustReadInt32(r))
-	m.FullCollectionName = ReadCString(r)
-	m.NumberToSkip = MustReadInt32(r)
-	m.NumberToReturn = MustReadInt32(r)
-	m.Query = ReadDocument(r)
-	m.ReturnFieldsSelector = ReadDocument(r)
+func (m *OP_QUERY) FromWire(r io.Reader) error {
+	f := &fieldReader{r: r}
+	m.Flags = OP_QUERY_Flags(f.int32())
+	m.FullCollectionName = f.cstring()
+	m.NumberToSkip = f.int32()
+	m.NumberToReturn = f.int32()
+	m.Query = f.document()
+	m.ReturnFieldsSelector = f.optionalDocument()
+	return f.err
 }
 
 type OP_KILL_CURSORS struct {
@@ -83,13 +85,23 @@ func (m *OP_KILL_CURSORS) GetHeader() MessageHeader {
 	return m.Header
 }
 
-func (m *OP_KILL_CURSORS) FromWire(r io.Reader) {
-	m.ZERO = MustReadInt32(r)
-	m.NumberOfCursorIDs = MustReadInt32(r)
-	m.CursorIDs = make([]int64, m.NumberOfCursorIDs)
-	for i := int32(0); i < m.NumberOfCursorIDs; i++ {
-		m.CursorIDs[i] = MustReadInt64(r)
+func (m *OP_KILL_CURSORS) FromWire(r io.Reader) error {
+	f := &fieldReader{r: r}
+	m.ZERO = f.int32()
+	m.NumberOfCursorIDs = f.int32()
+	if f.err != nil {
+		return f.err
 	}
+	if m.NumberOfCursorIDs < 0 {
+		return fmt.Errorf("invalid number of cursor ids %d", m.NumberOfCursorIDs)
+	}
+	// The ids are read as they come (rather than allocated up front) so that the
+	// number can't make us allocate more than the message holds
+	m.CursorIDs = nil
+	for i := int32(0); i < m.NumberOfCursorIDs && f.err == nil; i++ {
+		m.CursorIDs = append(m.CursorIDs, f.int64())
+	}
+	return f.err
 }
 
 type OP_GETMORE struct {
@@ -100,17 +112,104 @@ type OP_GETMORE struct {
 	CursorID           int64
 }
 
-func (m *OP_GETMORE) FromWire(r io.Reader) {
-	m.Flags = MustReadInt32(r)
-	m.FullCollectionName = ReadCString(r)
-	m.NumberToReturn = MustReadInt32(r)
-	m.CursorID = MustReadInt64(r)
+func (m *OP_GETMORE) FromWire(r io.Reader) error {
+	f := &fieldReader{r: r}
+	m.Flags = f.int32()
+	m.FullCollectionName = f.cstring()
+	m.NumberToReturn = f.int32()
+	m.CursorID = f.int64()
+	return f.err
 }
 
 func (m *OP_GETMORE) GetHeader() MessageHeader {
 	return m.Header
 }
 
+type OP_UPDATE_Flags int32
+
+func (f OP_UPDATE_Flags) Upsert() bool {
+	return hasBit(int32(f), 0)
+}
+
+func (f OP_UPDATE_Flags) MultiUpdate() bool {
+	return hasBit(int32(f), 1)
+}
+
+type OP_UPDATE struct {
+	Header             MessageHeader
+	ZERO               int32
+	FullCollectionName string
+	Flags              OP_UPDATE_Flags
+	Selector           bson.D
+	Update             bson.D
+}
+
+func (m *OP_UPDATE) GetHeader() MessageHeader {
+	return m.Header
+}
+
+func (m *OP_UPDATE) FromWire(r io.Reader) error {
+	f := &fieldReader{r: r}
+	m.ZERO = f.int32()
+	m.FullCollectionName = f.cstring()
+	m.Flags = OP_UPDATE_Flags(f.int32())
+	m.Selector = f.document()
+	m.Update = f.document()
+	return f.err
+}
+
+type OP_INSERT_Flags int32
+
+func (f OP_INSERT_Flags) ContinueOnError() bool {
+	return hasBit(int32(f), 0)
+}
+
+type OP_INSERT struct {
+	Header             MessageHeader
+	Flags              OP_INSERT_Flags
+	FullCollectionName string
+	Documents          []bson.D
+}
+
+func (m *OP_INSERT) GetHeader() MessageHeader {
+	return m.Header
+}
+
+func (m *OP_INSERT) FromWire(r io.Reader) error {
+	f := &fieldReader{r: r}
+	m.Flags = OP_INSERT_Flags(f.int32())
+	m.FullCollectionName = f.cstring()
+	m.Documents = f.documents()
+	return f.err
+}
+
+type OP_DELETE_Flags int32
+
+func (f OP_DELETE_Flags) SingleRemove() bool {
+	return hasBit(int32(f), 0)
+}
+
+type OP_DELETE struct {
+	Header             MessageHeader
+	ZERO               int32
+	FullCollectionName string
+	Flags              OP_DELETE_Flags
+	Selector           bson.D
+}
+
+func (m *OP_DELETE) GetHeader() MessageHeader {
+	return m.Header
+}
+
+func (m *OP_DELETE) FromWire(r io.Reader) error {
+	f := &fieldReader{r: r}
+	m.ZERO = f.int32()
+	m.FullCollectionName = f.cstring()
+	m.Flags = OP_DELETE_Flags(f.int32())
+	m.Selector = f.document()
+	return f.err
+}
+
 type OP_REPLY struct {
 	Header         MessageHeader
 	Flags          int32
@@ -167,6 +266,12 @@ func (o *OP_REPLY) WriteTo(w io.Writer) error {
 
 type OP_MSG_Flags int32
 
+const (
+	MsgFlagChecksumPresent OP_MSG_Flags = 1 << 0
+	MsgFlagMoreToCome      OP_MSG_Flags = 1 << 1
+	MsgFlagExhaustAllowed  OP_MSG_Flags = 1 << 16
+)
+
 func (f OP_MSG_Flags) ChecksumPresent() bool {
 	return hasBit(int32(f), 0)
 }
@@ -175,6 +280,10 @@ func (f OP_MSG_Flags) MoreToCome() bool {
 	return hasBit(int32(f), 1)
 }
 
+func (f OP_MSG_Flags) ExhaustAllowed() bool {
+	return hasBit(int32(f), 16)
+}
+
 type OP_MSG struct {
 	Header   MessageHeader
 	Flags    OP_MSG_Flags
@@ -186,46 +295,84 @@ func (m *OP_MSG) GetHeader() MessageHeader {
 	return m.Header
 }
 
+// FromWire reads the message from r; msgLen is the length of the message after the
+// header. The sections must exactly fill the message (less the checksum).
 func (o *OP_MSG) FromWire(r io.Reader, crc *Crc32c, msgLen int) error {
-	o.Flags = OP_MSG_Flags(MustReadUInt32(r))
+	flags, err := ReadUInt32(r)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	o.Flags = OP_MSG_Flags(flags)
 
 	var checksumLength int
 	if o.Flags.ChecksumPresent() {
 		checksumLength = 4
 	}
+	sectionsLength := msgLen - 4 - checksumLength
+	if sectionsLength < 0 {
+		return fmt.Errorf("invalid message length %d", msgLen)
+	}
 
-	cR := &CountingReader{reader: r, BytesRead: 4}
-	for cR.BytesRead < msgLen-checksumLength {
-		t := ReadBytes(cR, 1)
-		if t == nil {
-			break
+	o.Sections = nil
+	var bodies int
+	sr := &io.LimitedReader{R: r, N: int64(sectionsLength)}
+	for sr.N > 0 {
+		kind, err := ReadUInt8(sr)
+		if err != nil {
+			return unexpectedEOF(err)
 		}
-		switch t[0] {
+		switch kind {
 		case 0: // body
-			o.Sections = append(o.Sections, MSGSection_Body{ReadDocument(cR)})
+			doc, err := ReadDocument(sr)
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+			o.Sections = append(o.Sections, MSGSection_Body{doc})
+			bodies++
 		case 1:
-			sectionSize := MustReadInt32(cR)
-			sectionSize -= 4 // the sectionSize counts towards the length, so lets remove
-			r1 := io.LimitReader(cR, int64(sectionSize))
+			sectionSize, err := ReadInt32(sr)
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+			// The sectionSize counts towards the length and there must be room for
+			// the (terminated) identifier
+			if sectionSize < 5 || int64(sectionSize-4) > sr.N {
+				return fmt.Errorf("invalid document sequence length %d", sectionSize)
+			}
+			seq := &io.LimitedReader{R: sr, N: int64(sectionSize - 4)}
+			identifier, err := ReadCString(seq)
+			if err != nil {
+				return err
+			}
+			docs, err := ReadDocuments(seq)
+			if err != nil {
+				return err
+			}
 			o.Sections = append(o.Sections, MSGSection_DocumentSequence{
-				Size:               sectionSize,
-				SequenceIdentifier: ReadCString(r1),
-				Documents:          ReadDocuments(r1),
+				Size:               sectionSize - 4,
+				SequenceIdentifier: identifier,
+				Documents:          docs,
 			})
 		default:
-			msg := fmt.Sprintf("unknown body kind=%v", t[0])
-			panic(msg)
+			return fmt.Errorf("unknown section kind %d", kind)
 		}
 	}
+	if bodies != 1 {
+		return fmt.Errorf("OP_MSG must have exactly one body section, got %d", bodies)
+	}
 
 	if o.Flags.ChecksumPresent() {
-		if crc == nil {
+		if crc == nil || crc.table == nil {
 			err := fmt.Errorf("CRC checksum present but crc not computed")
 			logrus.Error(err)
 			return err
 		}
 		crcGen := crc.GetCrc()
-		o.Checksum = MustReadUInt32(r)
+		checksum, err := ReadUInt32(r)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		o.Checksum = checksum
 		if crcGen != o.Checksum {
 			err := fmt.Errorf("crc Check failed, Generated=%v:(0x%x), Got=%v:(0x%x)", crcGen, crcGen, o.Checksum, o.Checksum)
 			logrus.Error(err)
@@ -252,6 +399,28 @@ func (o *OP_MSG) ToWire() ([]byte, error) {
 			if _, err := bodyBuf.Write(b); err != nil {
 				return nil, err
 			}
+		case MSGSection_DocumentSequence:
+			seqBuf := bytes.NewBuffer(nil)
+			seqBuf.WriteString(sectionTyped.SequenceIdentifier)
+			seqBuf.WriteByte(0)
+			for _, doc := range sectionTyped.Documents {
+				b, err := bson.Marshal(doc)
+				if err != nil {
+					return nil, err
+				}
+				seqBuf.Write(b)
+			}
+
+			if _, err := bodyBuf.Write([]byte{1}); err != nil {
+				return nil, err
+			}
+			// The size includes itself
+			if err := binary.Write(bodyBuf, binary.LittleEndian, int32(seqBuf.Len()+4)); err != nil {
+				return nil, err
+			}
+			if _, err := bodyBuf.Write(seqBuf.Bytes()); err != nil {
+				return nil, err
+			}
 		default:
 			return nil, errors.New("unknown section type")
 		}
@@ -312,13 +481,31 @@ func (m *OP_COMPRESSED) GetHeader() MessageHeader {
 	return m.Header
 }
 
+// FromWire reads the message from r; the length of the compressed message is taken
+// from the header
 func (o *OP_COMPRESSED) FromWire(r io.Reader) error {
-	o.OriginalOpcode = OpCode(MustReadInt32(r))
-	o.UncompressedSize = MustReadInt32(r)
-	o.CompressorID = wiremessage.CompressorID(ReadBytes(r, 1)[0])
-	o.CompressedMessage = ReadBytes(r, int(o.Header.MessageLength-25)) // header (16) + original opcode (4) + uncompressed size (4) + compressor ID (1)
+	// header (16) + original opcode (4) + uncompressed size (4) + compressor ID (1)
+	compressedLength := int(o.Header.MessageLength) - 25
+	if compressedLength < 0 {
+		return fmt.Errorf("invalid message length %d", o.Header.MessageLength)
+	}
 
-	return nil
+	f := &fieldReader{r: r}
+	o.OriginalOpcode = OpCode(f.int32())
+	o.UncompressedSize = f.int32()
+	if f.err != nil {
+		return f.err
+	}
+	if o.UncompressedSize < 0 {
+		return fmt.Errorf("invalid uncompressed size %d", o.UncompressedSize)
+	}
+	compressorID, err := ReadUInt8(r)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	o.CompressorID = wiremessage.CompressorID(compressorID)
+	o.CompressedMessage, err = ReadBytes(r, compressedLength)
+	return err
 }
 
 func (o *OP_COMPRESSED) ToWire() ([]byte, error) {
@@ -3,6 +3,7 @@ package mongowire
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 
 	jsoniter "github.com/json-iterator/go"
@@ -11,27 +12,17 @@ import (
 	"github.com/wish/mongoproxy/pkg/ioutil"
 )
 
-func MustReadUInt8(r io.Reader) (n uint8) {
-	err := binary.Read(r, binary.LittleEndian, &n)
-	if err != nil {
-		panic(err)
-	}
-	return
-}
+// MaxDocumentSize is the max size of a document in a message: the max size of a
+// BSON document plus the headroom mongod allows for internal fields
+const MaxDocumentSize = 16*1024*1024 + 16*1024
 
-func MustReadUInt32(r io.Reader) (n uint32) {
-	err := binary.Read(r, binary.LittleEndian, &n)
-	if err != nil {
-		panic(err)
-	}
+func ReadUInt8(r io.Reader) (n uint8, err error) {
+	err = binary.Read(r, binary.LittleEndian, &n)
 	return
 }
 
-func MustReadInt32(r io.Reader) (n int32) {
-	err := binary.Read(r, binary.LittleEndian, &n)
-	if err != nil {
-		panic(err)
-	}
+func ReadUInt32(r io.Reader) (n uint32, err error) {
+	err = binary.Read(r, binary.LittleEndian, &n)
 	return
 }
 
@@ -40,90 +31,178 @@ func ReadInt32(r io.Reader) (n int32, err error) {
 	return
 }
 
-func MustReadInt64(r io.Reader) (n int64) {
-	err := binary.Read(r, binary.LittleEndian, &n)
-	if err != nil {
-		panic(err)
-	}
+func ReadInt64(r io.Reader) (n int64, err error) {
+	err = binary.Read(r, binary.LittleEndian, &n)
 	return
 }
-func ReadInt64(r io.Reader) *int64 {
-	var n int64
-	err := binary.Read(r, binary.LittleEndian, &n)
-	if err != nil {
-		if err == io.EOF {
-			return nil
-		}
-		panic(err)
-	}
-	return &n
-}
 
-func ReadBytes(r io.Reader, n int) []byte {
+// ReadBytes reads exactly n bytes; the caller is responsible for bounding n
+func ReadBytes(r io.Reader, n int) ([]byte, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("invalid length %d", n)
+	}
+	if err := checkRemaining(r, int64(n)); err != nil {
+		return nil, err
+	}
 	b := make([]byte, n)
-	_, err := r.Read(b)
-	if err != nil {
-		if err == io.EOF {
-			return nil
-		}
-		panic(err)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, unexpectedEOF(err)
 	}
-	return b
+	return b, nil
 }
 
-func ReadCString(r io.Reader) string {
+func ReadCString(r io.Reader) (string, error) {
 	var b []byte
-	var one = make([]byte, 1)
+	var one [1]byte
 	for {
-		_, err := r.Read(one)
-		if err != nil {
-			panic(err)
+		if _, err := io.ReadFull(r, one[:]); err != nil {
+			return "", unexpectedEOF(err)
 		}
 		if one[0] == '\x00' {
 			break
 		}
 		b = append(b, one[0])
 	}
-	return string(b)
+	return string(b), nil
 }
 
-func ReadOne(r io.Reader) []byte {
+// ReadOne reads the raw bytes of a document. It returns io.EOF if r is at its end.
+func ReadOne(r io.Reader) ([]byte, error) {
 	docLen, err := ReadInt32(r)
 	if err != nil {
 		if err == io.EOF {
-			return nil
+			return nil, io.EOF
 		}
-		panic(err)
+		return nil, unexpectedEOF(err)
+	}
+	// The smallest document is the length and the terminating null
+	if docLen < 5 || docLen > MaxDocumentSize {
+		return nil, fmt.Errorf("invalid document length %d", docLen)
 	}
+	if err := checkRemaining(r, int64(docLen-4)); err != nil {
+		return nil, err
+	}
+
 	buf := make([]byte, int(docLen))
 	binary.LittleEndian.PutUint32(buf, uint32(docLen))
 	if _, err := io.ReadFull(r, buf[4:]); err != nil {
-		panic(err)
+		return nil, unexpectedEOF(err)
 	}
-	return buf
+	return buf, nil
 }
 
-func ReadDocument(r io.Reader) (m bson.D) {
-	if one := ReadOne(r); one != nil {
-		err := bson.Unmarshal(one, &m)
-		if err != nil {
-			panic(err)
-		}
+// ReadDocument reads a document. It returns io.EOF if r is at its end.
+func ReadDocument(r io.Reader) (bson.D, error) {
+	one, err := ReadOne(r)
+	if err != nil {
+		return nil, err
+	}
+	var m bson.D
+	if err := bson.Unmarshal(one, &m); err != nil {
+		return nil, err
+	}
+	if m == nil {
+		m = bson.D{}
 	}
-	return m
+	return m, nil
 }
 
-func ReadDocuments(r io.Reader) (ms []bson.D) {
+// ReadDocuments reads documents until the end of r
+func ReadDocuments(r io.Reader) ([]bson.D, error) {
+	var ms []bson.D
 	for {
-		m := ReadDocument(r)
-		if m == nil {
-			break
+		m, err := ReadDocument(r)
+		if err == io.EOF {
+			return ms, nil
+		}
+		if err != nil {
+			return nil, err
 		}
 		ms = append(ms, m)
 	}
+}
+
+// fieldReader reads the fields of a message. Once a read fails the following reads
+// return zero values; err is the first error.
+type fieldReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *fieldReader) int32() (n int32) {
+	if f.err == nil {
+		n, f.err = ReadInt32(f.r)
+		f.err = unexpectedEOF(f.err)
+	}
+	return
+}
+
+func (f *fieldReader) uint32() (n uint32) {
+	if f.err == nil {
+		n, f.err = ReadUInt32(f.r)
+		f.err = unexpectedEOF(f.err)
+	}
+	return
+}
+
+func (f *fieldReader) int64() (n int64) {
+	if f.err == nil {
+		n, f.err = ReadInt64(f.r)
+		f.err = unexpectedEOF(f.err)
+	}
+	return
+}
+
+func (f *fieldReader) cstring() (s string) {
+	if f.err == nil {
+		s, f.err = ReadCString(f.r)
+	}
+	return
+}
+
+func (f *fieldReader) document() (d bson.D) {
+	if f.err == nil {
+		d, f.err = ReadDocument(f.r)
+		f.err = unexpectedEOF(f.err)
+	}
+	return
+}
+
+// optionalDocument reads a document if r isn't at its end
+func (f *fieldReader) optionalDocument() (d bson.D) {
+	if f.err == nil {
+		d, f.err = ReadDocument(f.r)
+		if f.err == io.EOF {
+			f.err = nil
+		}
+	}
+	return
+}
+
+func (f *fieldReader) documents() (ds []bson.D) {
+	if f.err == nil {
+		ds, f.err = ReadDocuments(f.r)
+	}
 	return
 }
 
+// checkRemaining returns an error if r is limited to less than n bytes, so that
+// lengths from the message are checked before allocating for them
+func checkRemaining(r io.Reader, n int64) error {
+	if lr, ok := r.(*io.LimitedReader); ok && n > lr.N {
+		return fmt.Errorf("length %d exceeds the %d bytes remaining", n, lr.N)
+	}
+	return nil
+}
+
+// unexpectedEOF converts an io.EOF partway through a value into io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
 func ToJson(v interface{}, l int) string {
 	w := ioutil.NewLimitedWriter(make([]byte, l))
 	jsoniter.NewEncoder(w).Encode(v)
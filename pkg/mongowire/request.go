@@ -1,6 +1,8 @@
 package mongowire
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 
 	"github.com/sirupsen/logrus"
@@ -19,6 +21,22 @@ func NewRequestWithHeader(h MessageHeader, c io.Reader) *Request {
 	}
 }
 
+// DefaultMaxMessageSize is the max size of a message, as advertised by mongod in
+// maxMessageSizeBytes
+const DefaultMaxMessageSize = 48000000
+
+// checkMessageLength returns an error if the header's message length is invalid or
+// exceeds maxMessageSize
+func checkMessageLength(h *MessageHeader, maxMessageSize int) error {
+	if h.MessageLength < HeaderLen {
+		return fmt.Errorf("invalid message length %d", h.MessageLength)
+	}
+	if int64(h.MessageLength) > int64(maxMessageSize) {
+		return fmt.Errorf("message length %d exceeds the maximum of %d", h.MessageLength, maxMessageSize)
+	}
+	return nil
+}
+
 func NewRequest(c io.Reader) (*Request, error) {
 	req := &Request{}
 	req.crc.Init()
@@ -28,52 +46,135 @@ func NewRequest(c io.Reader) (*Request, error) {
 		return nil, err
 	}
 	logrus.Debugf("Header=%s\n", h)
+	if err := checkMessageLength(h, DefaultMaxMessageSize); err != nil {
+		return nil, err
+	}
 	req.hdr = *h
 
 	req.r = io.LimitReader(tr, int64(h.MessageLength-HeaderLen))
 	return req, nil
 }
 
+// ReadRequest reads a full message from c into memory, rejecting messages larger than
+// DefaultMaxMessageSize. Unlike NewRequest the returned Request never reads from c, so
+// c can be used while the request is handled.
+func ReadRequest(c io.Reader) (*Request, error) {
+	return ReadRequestLimit(c, DefaultMaxMessageSize)
+}
+
+// ReadRequestLimit is ReadRequest with a max message size (including the header)
+func ReadRequestLimit(c io.Reader, maxMessageSize int) (*Request, error) {
+	var hb [HeaderLen]byte
+	if _, err := io.ReadFull(c, hb[:]); err != nil {
+		return nil, err
+	}
+	h := MessageHeader{}
+	h.FromWire(hb[:])
+	logrus.Debugf("Header=%s\n", &h)
+
+	if err := checkMessageLength(&h, maxMessageSize); err != nil {
+		return nil, err
+	}
+
+	// The body is read into a buffer growing as it arrives rather than allocated up
+	// front, so a header claiming a large message doesn't hold memory it never sends
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, c, int64(h.MessageLength-HeaderLen)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	body := buf.Bytes()
+
+	req := &Request{hdr: h}
+	req.crc.Init()
+	req.crc.UpdateCrc(hb[:])
+	// Limited so that lengths in the message are checked against what's left of it
+	req.r = &io.LimitedReader{R: io.TeeReader(bytes.NewReader(body), &req.crc), N: int64(len(body))}
+	return req, nil
+}
+
 func (req *Request) GetHeader() *MessageHeader {
 	return &req.hdr
 }
 
-func (req *Request) GetOpQuery() *OP_QUERY {
+func (req *Request) GetOpQuery() (*OP_QUERY, error) {
 	q := &OP_QUERY{
 		Header: req.hdr,
 	}
-	q.FromWire(req.r)
-	return q
+	if err := q.FromWire(req.r); err != nil {
+		return nil, err
+	}
+	return q, nil
 }
 
-func (req *Request) GetOpKillCursors() *OP_KILL_CURSORS {
+func (req *Request) GetOpKillCursors() (*OP_KILL_CURSORS, error) {
 	q := &OP_KILL_CURSORS{
 		Header: req.hdr,
 	}
-	q.FromWire(req.r)
-	return q
+	if err := q.FromWire(req.r); err != nil {
+		return nil, err
+	}
+	return q, nil
 }
 
-func (req *Request) GetOpMore() *OP_GETMORE {
+func (req *Request) GetOpMore() (*OP_GETMORE, error) {
 	gm := &OP_GETMORE{
 		Header: req.hdr,
 	}
-	gm.FromWire(req.r)
-	return gm
+	if err := gm.FromWire(req.r); err != nil {
+		return nil, err
+	}
+	return gm, nil
 }
 
-func (req *Request) GetOpMsg() *OP_MSG {
+func (req *Request) GetOpUpdate() (*OP_UPDATE, error) {
+	o := &OP_UPDATE{
+		Header: req.hdr,
+	}
+	if err := o.FromWire(req.r); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (req *Request) GetOpInsert() (*OP_INSERT, error) {
+	o := &OP_INSERT{
+		Header: req.hdr,
+	}
+	if err := o.FromWire(req.r); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (req *Request) GetOpDelete() (*OP_DELETE, error) {
+	o := &OP_DELETE{
+		Header: req.hdr,
+	}
+	if err := o.FromWire(req.r); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (req *Request) GetOpMsg() (*OP_MSG, error) {
 	o := &OP_MSG{
 		Header: req.hdr,
 	}
-	o.FromWire(req.r, &req.crc, int(req.hdr.MessageLength-HeaderLen))
-	return o
+	if err := o.FromWire(req.r, &req.crc, int(req.hdr.MessageLength-HeaderLen)); err != nil {
+		return nil, err
+	}
+	return o, nil
 }
 
-func (req *Request) GetOpCompressed() *OP_COMPRESSED {
+func (req *Request) GetOpCompressed() (*OP_COMPRESSED, error) {
 	o := &OP_COMPRESSED{
 		Header: req.hdr,
 	}
-	o.FromWire(req.r)
-	return o
+	if err := o.FromWire(req.r); err != nil {
+		return nil, err
+	}
+	return o, nil
 }